@@ -1,21 +1,28 @@
-// Usage: go run auth.go [auth ip:port] [frontend ip:port]
+// Usage: go run auth.go [config file] [node name]
 //
-// - [auth ip:port] : the ip and TCP port on which this authentication server is listening for metadata server connections
-// - [file-store-A ip:port] : the ip and TCP port on file storage server A is listening for auth connections.
+// - [config file] : the topology of the cluster, see cluster.json. RPCC_* environment variables override its settings.
+// - [node name] : the auth node of the config file to run, it listens on its listen address for metadata server connections
+//   and reports to the auth listeners of the front ends.
 //
 package main
 
 import (
+	"./config"
+	"./gossip"
 	"./rpcc"
+	"crypto/rand"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 	//"strconv"
 	"encoding/gob"
-	"github.com/arcaneiceman/GoVector/govec"
 )
 
 //======================================= SERVICE =======================================
@@ -27,15 +34,20 @@ type ValArgs struct {
 	Text_content string
 	Secret_info  string
 	ErrorCode    int
+	Content_ref  rpcc.PayloadRef // Text_content buffered on the first or target hop
 }
 
 type ValMetadata struct {
 	FilestoreMapA map[int]NodeInfo
 	FilestoreMapB map[int]NodeInfo
+
+	Shard_A string // logical services of the groups owning the file
+	Shard_B string
 }
 
 type ValReply struct {
 	Val string // value; depends on the call
+	Log []byte // causal log of the caller, see rpcc.PrepareSend
 }
 
 type NodeInfo struct {
@@ -45,24 +57,29 @@ type NodeInfo struct {
 	Service string
 }
 
+// a node asking for its id, the one it had if any (-1 otherwise); the reply carries the id it got
+type NodeRegistration struct {
+	Uuid string // kept by the node across restarts
+	Type int
+	Id   int
+}
+
 // Type 0 is metadata server, 1 is auth server, 2 is file storage A, 3 is file storage B
 type NodeInfoCache struct {
+	Id      int
 	Type    int
 	Addr    string
 	Service string
 	Entry   string
 	Maps    []map[string]string
+
+	Open_breakers []string // addresses this node's hops currently fail fast to
 }
 
 type CacheContent struct {
 	Maps []map[string]string
 }
 
-type Msg struct {
-	Content       string
-	RealTimestamp string
-}
-
 //======================================= VARIABLES =======================================
 const NodeType int = 2
 const NodeService string = "AuthService"
@@ -79,41 +96,67 @@ const (
 var CredentialMap map[string]string
 var ValidationMap map[string]string
 
-var Logger *govec.GoLog
+// Guards the maps, the handlers, reports and printMaps run concurrently
+var mapsMutex sync.Mutex
+
+// This node's membership in the gossip of the backend nodes
+var Members *gossip.Memberlist
+
+// the id the front end gave this node for the uuid it keeps on disk, -1 until registered
+var NodeId int = -1
+var NodeUuid string
+
+// the topology and settings of the cluster, from the config file
+var Config *config.Config
+
+// how long a hop of a chain waits for the next, in ms, and how often this node reports
+var HopTimeout int = 10000
+var ReportInterval = 1000 * time.Millisecond
+
+// reply to the reports of a node the front end gave no id, it registers again
+const UnregisteredNode string = "Unregistered node"
+
+// reply to the reports of a drained node, it leaves
+const DecommissionedNode string = "Decommissioned node"
+
+// how long a committed credential waits for a replica to connect
+const ReplicationTimeout = time.Second
 
 //======================================= SERVICE METHODS =======================================
 func (as *AuthService) AStore(chain *rpcc.RPCChain, reply *bool) error {
 
-	cmd := "STORE"
-	HandleLog(cmd, chain)
-
 	args := chain.EntityList[0].Args.(ValArgs)
 
 	validAuth := false
-	if secret, ok := CredentialMap[args.File_Name]; ok {
+	mapsMutex.Lock()
+	secret, ok := CredentialMap[args.File_Name]
+	mapsMutex.Unlock()
+	if ok {
 		//Check secret match, store in validation map to confirm overwrite
 		if secret == args.Secret_info {
 			fmt.Println("STORE RPCC:")
+			mapsMutex.Lock()
 			ValidationMap[args.File_Name] = args.Secret_info
+			mapsMutex.Unlock()
 
-			logBuf := GenerateLog(cmd, chain)
-			chain.AddLogToChain(logBuf)
 			fmt.Println(string(chain.Log))
 
-			chain.CallNext(10000)
+			chain.CallNext(HopTimeout)
 			fmt.Println(chain)
 
 			validAuth = true
 		}
 	} else {
 		//Refuse store if file name in validation map
-		if _, ok := ValidationMap[args.File_Name]; !ok {
+		mapsMutex.Lock()
+		_, pending := ValidationMap[args.File_Name]
+		if !pending {
 			ValidationMap[args.File_Name] = args.Secret_info
+		}
+		mapsMutex.Unlock()
 
-			logBuf := GenerateLog(cmd, chain)
-			chain.AddLogToChain(logBuf)
-
-			chain.CallNext(10000)
+		if !pending {
+			chain.CallNext(HopTimeout)
 			fmt.Println(chain)
 
 			validAuth = true
@@ -126,11 +169,9 @@ func (as *AuthService) AStore(chain *rpcc.RPCChain, reply *bool) error {
 		chain.FirstEntity().Args = args
 
 		//TODO
-		logBuf := GenerateReturnLogError(cmd, chain, 1)
-		chain.AddLogToChain(logBuf)
 		chain.ChangeDirection()
 
-		chain.CallIndex(1, 10000)
+		chain.CallIndex(1, HopTimeout)
 	}
 
 	fmt.Println()
@@ -140,9 +181,17 @@ func (as *AuthService) AStore(chain *rpcc.RPCChain, reply *bool) error {
 
 func (as *AuthService) StoreValidation(key *ValReply, reply *ValReply) error {
 
-	if v, ok := ValidationMap[key.Val]; ok {
+	mapsMutex.Lock()
+	v, ok := ValidationMap[key.Val]
+	if ok {
 		CredentialMap[key.Val] = v
 		delete(ValidationMap, key.Val)
+	}
+	mapsMutex.Unlock()
+
+	if ok {
+		rpcc.UnpackReceive("validated file="+key.Val+" on auth", key.Log)
+		replicateCredential(key.Val, v)
 		reply.Val = "Moved to storage map AUTH"
 		return nil
 	} else {
@@ -151,19 +200,30 @@ func (as *AuthService) StoreValidation(key *ValReply, reply *ValReply) error {
 	}
 }
 
+// the primary's credentials, merged: credentials are only added, and ones committed since its
+// report already came from the primary itself
 func (as *AuthService) UpdateConsistency(arg *CacheContent, reply *ValReply) error {
 	reply.Val = "Replica updated"
-	CredentialMap = arg.Maps[0]
+	if len(arg.Maps) == 1 {
+		mapsMutex.Lock()
+		for k, v := range arg.Maps[0] {
+			CredentialMap[k] = v
+		}
+		mapsMutex.Unlock()
+	}
 	return nil
 }
 
-func (as *AuthService) AuthRecovery(arg *CacheContent, reply *ValReply) error {
-	reply.Val = "Auth data stored"
-
-	if len(CredentialMap) == 0 {
-		CredentialMap = arg.Maps[0]
+// take over the credentials of a drained node, its entries win
+func (as *AuthService) MergeConsistency(arg *CacheContent, reply *ValReply) error {
+	reply.Val = "Replica merged"
+	if len(arg.Maps) == 1 {
+		mapsMutex.Lock()
+		for k, v := range arg.Maps[0] {
+			CredentialMap[k] = v
+		}
+		mapsMutex.Unlock()
 	}
-
 	return nil
 }
 
@@ -171,78 +231,88 @@ func (as *AuthService) AuthRecovery(arg *CacheContent, reply *ValReply) error {
 
 func main() {
 
-	Logger = govec.Initialize("auth", "auth")
-
-	// parse argsx`
-	usage := fmt.Sprintf("Usage: %s ip:port\n", os.Args[0])
+	// parse args
+	usage := fmt.Sprintf("Usage: %s [config file] [node name]\n", os.Args[0])
 	if len(os.Args) != 3 {
 		fmt.Printf(usage)
 		os.Exit(1)
 	}
 
+	var err error
+	Config, err = config.Load(os.Args[1])
+	checkError(err)
+	node, err := Config.Node(os.Args[2], config.Auth)
+	checkError(err)
+
+	checkError(rpcc.InitTracer("auth", Config.Tracer))
+	checkError(rpcc.EnableRecording("auth", Config.Storage.Records))
+	checkError(rpcc.InitBreakers(Config.Breaker))
+	checkError(rpcc.InitTimeouts(Config.AdaptiveTimeouts))
+	HopTimeout = int(Config.Timeouts.Hop.Duration / time.Millisecond)
+	ReportInterval = Config.Timeouts.Report.Duration
+
 	gob.Register(ValArgs{})
 	gob.Register(ValMetadata{})
 	gob.Register(NodeInfo{})
 
-	authAddr := os.Args[1]
-	frontendAddr := os.Args[2]
+	authAddr := node.Listen
+	frontendAddr := Config.ReportAddrs(config.Auth)
 	fmt.Println("authAddr:", authAddr, " frontendAddr:", frontendAddr)
 
 	CredentialMap = make(map[string]string)
 	ValidationMap = make(map[string]string)
 
+	rpcc.RegisterResolver(rpcc.NewRemoteResolver(frontendAddr, "FrontEndMapService.Resolve"))
+
+	// register with the front end for this node's id first, the gossip carries it;
+	// the front ends may not be up or have elected a leader yet
+	NodeUuid = nodeUuid(authAddr)
+	for {
+		serviceFE, err := dialFrontEnd(frontendAddr)
+		if err == nil {
+			err = registerToFrontEnd(serviceFE)
+			serviceFE.Close()
+			if err == nil {
+				break
+			}
+		}
+		rpcc.Sleep(ReportInterval)
+	}
+
+	joinGossip(authAddr)
 	go initListener(authAddr)
 	go printMaps()
 
-	serviceFE, err := rpc.Dial("tcp", frontendAddr)
+	serviceFE, err := dialFrontEnd(frontendAddr)
 	checkError(err)
-	//myID := "1"//HandShake(serviceFE)
+	serviceFE.Close()
 
 	//counter:=0
 	for {
 		//counter++
 		//fmt.Println(counter)
-		UpdateToFrontEnd(NodeType, NodeService, authAddr, serviceFE)
-		backupAuth(frontendAddr)
-		time.Sleep(1000 * time.Millisecond)
+		serviceFE, err = dialFrontEnd(frontendAddr)
+		if err == nil {
+			switch UpdateToFrontEnd(NodeType, NodeService, authAddr, serviceFE) {
+			case UnregisteredNode:
+				registerToFrontEnd(serviceFE)
+			case DecommissionedNode:
+				fmt.Println("Drained and deregistered by the front end, leaving")
+				Members.Leave()
+				os.Exit(0)
+			}
+			serviceFE.Close()
+		}
+		rpcc.Sleep(ReportInterval)
 	}
 
 }
 
 //======================================= HELPER FUNCTIONS =======================================
-func GenerateLog(callType string, chain *rpcc.RPCChain) []byte {
-	nextChain := chain.CurrentPosition + 1
-	logMessage := Msg{"AUTH " + callType + "log.", time.Now().String()}
-	fmt.Println(chain.EntityList[nextChain].Service_info)
-	logBuf := Logger.PrepareSend(callType+" request to "+chain.EntityList[nextChain].Service_info, logMessage)
-	return logBuf
-
-}
-
-func GenerateReturnLogError(callType string, chain *rpcc.RPCChain, returnChain int) []byte {
-	logMessage := Msg{"AUTH Return" + callType + "log.", time.Now().String()}
-	fmt.Println(chain.EntityList[returnChain].Service_info)
-	logBuf := Logger.PrepareSend(callType+" error return to "+chain.EntityList[returnChain].Service_info, logMessage)
-	return logBuf
-
-}
-
-func HandleLog(cmd string, chain *rpcc.RPCChain) {
-	logMessage := new(Msg)
-	prevChain := chain.CurrentPosition - 1
-	Logger.UnpackReceive(cmd+" request received from "+chain.EntityList[prevChain].Service_info, chain.Log, &logMessage)
-	fmt.Println(logMessage.String())
-
-}
-
-func (m Msg) String() string {
-	return "content: " + m.Content + "\ntime: " + m.RealTimestamp
-}
-
 // If error is non-nil, print it out and halt.
 func checkError(err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error ", err.Error())
+		fmt.Fprintf(os.Stderr, "Error %s\n", err.Error())
 		os.Exit(1)
 	}
 }
@@ -251,75 +321,154 @@ func checkError(err error) {
 func initListener(address string) {
 	service := new(AuthService)
 	rpc.Register(service)
+	rpcc.RegisterServices()
 	ln, e := net.Listen("tcp", address)
 	if e != nil {
 		log.Fatal("listen error:", e)
 	} else {
-		go rpc.Accept(ln)
+		go rpcc.Accept(ln)
 	}
 }
 
+// Joins the gossip of the backend nodes through the seeds of the config, alone if there are none
+func joinGossip(address string) {
+	var err error
+	Members, err = gossip.Start(gossip.Config{
+		Addr:    address,
+		Id:      NodeId,
+		Role:    NodeType,
+		Service: NodeService,
+		Seeds:   Config.Seeds,
+	})
+	checkError(err)
+}
+
 func printMaps() {
 	for {
-		fmt.Println("CredentialMap:", CredentialMap)
-		fmt.Println("ValidationMap:", ValidationMap)
+		mapsMutex.Lock()
+		credentials, validation := copyMap(CredentialMap), copyMap(ValidationMap)
+		mapsMutex.Unlock()
+
+		fmt.Println("CredentialMap:", credentials)
+		fmt.Println("ValidationMap:", validation)
+		fmt.Println("Gossip members:", Members.Members(), "replica set:", Members.Peers(NodeType))
 		fmt.Println()
-		time.Sleep(3000 * time.Millisecond)
+		rpcc.Sleep(3000 * time.Millisecond)
 	}
 }
 
 // remove temporary storage in validation map when exceeding exepected time of 60sec
 func mapGarbageCollector() {
 	for {
+		mapsMutex.Lock()
 		ValidationMap = make(map[string]string)
-		time.Sleep(60000 * time.Millisecond)
+		mapsMutex.Unlock()
+		rpcc.Sleep(60000 * time.Millisecond)
 	}
 }
 
-// handshake to get my id key in front end map
-func HandShake(dialservice *rpc.Client) string {
-	args := ValReply{Val: "hello"}
-	var kvVal ValReply
-
-	dialservice.Call("FrontEndServiceAuth.Handshake", args, &kvVal)
-	//checkError(err)
-
-	return kvVal.Val
+// Must be called with mapsMutex held, the copy can be read without it
+func copyMap(m map[string]string) map[string]string {
+	copied := make(map[string]string, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
 }
 
 // send this node's information to front end
-func UpdateToFrontEnd(typeArg int, service string, address string, dialservice *rpc.Client) {
+func UpdateToFrontEnd(typeArg int, service string, address string, dialservice *rpc.Client) string {
 	list := make([]map[string]string, 1)
-	list[0] = CredentialMap
+	mapsMutex.Lock()
+	list[0] = copyMap(CredentialMap)
+	mapsMutex.Unlock()
 
 	node := NodeInfoCache{
+		Id:      NodeId,
 		Type:    typeArg,
 		Addr:    address,
 		Service: service,
 		Maps:    list,
+
+		Open_breakers: rpcc.OpenBreakers(),
 	}
 
 	var kvVal ValReply
 
 	err := dialservice.Call("FrontEndServiceAuth.ReportServerActivity", node, &kvVal)
-	checkError(err)
+	if err != nil {
+		fmt.Println("ReportServerActivity err:", err)
+	}
 	//fmt.Println("ReportServerActivity err:",err)
 	//fmt.Println("Updated activity status:", node, kvVal.Val)
 
+	return kvVal.Val
 }
 
-func backupAuth(frontendAddr string) error {
-	maps := make([]map[string]string, 1)
-	maps[0] = CredentialMap
-	cache := CacheContent{Maps: maps}
+// send a committed credential to the other auth nodes before the store goes on, so whichever
+// is promoted when the primary dies has it
+func replicateCredential(fileName string, secret string) {
+	cache := CacheContent{Maps: []map[string]string{{fileName: secret}}}
+	self := Members.Self().Addr
 
-	dialservice, err := rpc.Dial("tcp", frontendAddr)
-	if err == nil {
+	for _, peer := range Members.Peers(NodeType) {
+		if peer.Addr == self {
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", peer.Addr, ReplicationTimeout)
+		if err != nil {
+			fmt.Println("Unable to replicate", fileName, "to", peer.Addr+":", err)
+			continue
+		}
+		dialservice := rpc.NewClient(conn)
 		var kvVal ValReply
-		serviceMethod := "FrontEndMapService" + "." + "AuthRecovery"
-		dialservice.Call(serviceMethod, cache, &kvVal)
-		//checkError(err)
+		if err := dialservice.Call(NodeService+".MergeConsistency", cache, &kvVal); err != nil {
+			fmt.Println("Unable to replicate", fileName, "to", peer.Addr+":", err)
+		}
+		dialservice.Close()
 	}
+}
 
+//Dial the first front end of the comma separated list that answers, any of them takes the reports
+func dialFrontEnd(frontendAddrs string) (*rpc.Client, error) {
+	var err error
+	for _, addr := range strings.Split(frontendAddrs, ",") {
+		var service *rpc.Client
+		if service, err = rpc.Dial("tcp", strings.TrimSpace(addr)); err == nil {
+			return service, nil
+		}
+	}
+	return nil, err
+}
+
+//Register with the front end under this node's uuid, keeping the id it had if any
+func registerToFrontEnd(dialservice *rpc.Client) error {
+	args := NodeRegistration{Uuid: NodeUuid, Type: NodeType, Id: NodeId}
+	var reply NodeRegistration
+	if err := dialservice.Call("FrontEndServiceAuth.Register", args, &reply); err != nil {
+		fmt.Println("Register err:", err)
+		return err
+	}
+
+	NodeId = reply.Id
+	fmt.Println("Registered", NodeUuid, "as node", NodeId)
 	return nil
 }
+
+//The uuid this node keeps across restarts in [service]-[address].uuid of the storage dir, made on its first start
+func nodeUuid(address string) string {
+	path := filepath.Join(Config.Storage.Dir, NodeService+"-"+strings.Replace(address, ":", "-", -1)+".uuid")
+	if content, err := ioutil.ReadFile(path); err == nil && len(strings.TrimSpace(string(content))) > 0 {
+		return strings.TrimSpace(string(content))
+	}
+
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	checkError(err)
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+
+	checkError(ioutil.WriteFile(path, []byte(uuid+"\n"), 0644))
+	return uuid
+}
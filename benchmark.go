@@ -0,0 +1,374 @@
+// Usage: go run benchmark.go [client ip:port] [front-end ip:port] [operations] [file size]
+//
+// - [client ip:port] : the ip and TCP port on which the benchmark listens for file server connections.
+// - [front-end ip:port] : the ip and TCP port on which front end is listening for client connections.
+// - [operations] : STOREs, then as many RETRIEVEs of the stored files, run in each mode.
+// - [file size] : bytes of content per file, at most 10240 like the client.
+//
+// Runs the same workload twice against the running services: once chained, and once
+// client-orchestrated, where every hop goes back through the benchmark before the next
+// service is called, like a client calling each service in turn with plain RPCs.
+// Reports latency percentiles, bytes on the wire, connections and hops per operation.
+// Every node must be built with the same rpcc to count its traffic.
+//
+package main
+
+import (
+	"./rpcc"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//======================================= SERVICE =======================================
+type ClientService int
+
+//======================================= STRUCTS =======================================
+type ValArgs struct {
+	File_Name    string
+	Secret_info  string
+	Text_content string
+	ErrorCode    int
+	Content_ref  rpcc.PayloadRef // Text_content buffered on the first or target hop
+}
+
+type ValMetadata struct {
+	FilestoreMapA map[int]NodeInfo
+	FilestoreMapB map[int]NodeInfo
+
+	Shard_A string // logical services of the groups owning the file
+	Shard_B string
+}
+
+type NodeInfo struct {
+	Id      int
+	Type    int
+	Addr    string
+	Service string
+}
+
+// The operations of one mode and kind, and the traffic they made
+type Result struct {
+	Mode      string
+	Kind      string
+	Latencies []time.Duration // of the operations that completed, sorted
+	Failed    int
+	Wire      rpcc.WireStats
+}
+
+// The callback a chain is waiting for
+type callback struct {
+	args ValArgs
+	ok   bool
+	err  string
+}
+
+//======================================= VARIABLES =======================================
+const NodeService string = "ClientService"
+const StoreEntryFunction string = "CStore"
+const RetrieveEntryFunction string = "CRetrieve"
+
+const (
+	INCOMPLETE_CHAIN     = iota
+	SUCCESSFUL_COMPLETED = iota
+	INVALID_AUTH_ERROR   = iota
+)
+
+const Secret string = "pass"
+
+var NodeAddress string
+
+// logical services whose nodes' traffic is counted, besides the front end's
+var LogicalServices = []string{"metadata", "auth", "filestoreA", "filestoreB"}
+
+// chain id -> callback, filled in by the service methods and the error handler
+var callbacks map[string]*callback
+var callbackMutex sync.Mutex
+
+//======================================= SERVICE METHODS =======================================
+
+func (cs *ClientService) CStore(chain *rpcc.RPCChain, reply *bool) error {
+	completeCall(chain.Id, chain.CurrentEntity().Args.(ValArgs))
+	*reply = true
+	return nil
+}
+
+func (cs *ClientService) CRetrieve(chain *rpcc.RPCChain, reply *bool) error {
+	args := chain.CurrentEntity().Args.(ValArgs)
+
+	// The content is left on the filestore, fetching it is part of the operation
+	if args.Content_ref.IsSet() {
+		data, err := rpcc.Fetch(args.Content_ref)
+		if err != nil {
+			failCall(chain.Id, "unable to fetch retrieved content: "+err.Error())
+			*reply = true
+			return nil
+		}
+		rpcc.Release(args.Content_ref)
+		args.Text_content = string(data)
+	}
+
+	completeCall(chain.Id, args)
+	*reply = true
+	return nil
+}
+
+//======================================= MAIN =======================================
+
+func main() {
+
+	// parse args
+	usage := fmt.Sprintf("Usage: %s [client ip:port] [front-end ip:port] [operations] [file size]\n", os.Args[0])
+	if len(os.Args) != 5 {
+		fmt.Print(usage)
+		os.Exit(1)
+	}
+
+	operations, err := strconv.Atoi(os.Args[3])
+	checkError(err)
+	size, err := strconv.Atoi(os.Args[4])
+	checkError(err)
+	if operations < 1 || size < 1 || size > 10240 {
+		fmt.Print(usage)
+		os.Exit(1)
+	}
+
+	gob.Register(ValArgs{})
+	gob.Register(ValMetadata{})
+	gob.Register(NodeInfo{})
+
+	rpcc.InitTracer("benchmark", os.Getenv("RPCC_TRACER"))
+
+	NodeAddress = os.Args[1]
+	frontendAddr := os.Args[2]
+	initListener(NodeAddress)
+
+	// Orchestrated hops to logical services are resolved here, like the front end does
+	rpcc.RegisterResolver(rpcc.NewRemoteResolver(frontendAddr, "FrontEndMapService.Resolve"))
+
+	nodes := countedNodes(frontendAddr)
+	fmt.Println("Counting traffic of", nodes)
+
+	// Same files and contents in both modes, under different names
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	contents := make([]string, operations)
+	for i := range contents {
+		contents[i] = randomContent(random, size)
+	}
+	run := strconv.FormatInt(time.Now().UnixNano()%1000000, 36)
+
+	// One untimed round trip each way, so connections and gob types are warm
+	runOperations(frontendAddr, "warmup", "STORE", "bench-"+run+"-warmup", contents[:1], nodes)
+	runOperations(frontendAddr, "warmup", "RETRIEVE", "bench-"+run+"-warmup", contents[:1], nodes)
+
+	results := make([]Result, 0)
+	for _, mode := range []string{"chained", "classic"} {
+		prefix := "bench-" + run + "-" + mode
+		results = append(results, runOperations(frontendAddr, mode, "STORE", prefix, contents, nodes))
+		results = append(results, runOperations(frontendAddr, mode, "RETRIEVE", prefix, contents, nodes))
+	}
+
+	printResults(results)
+}
+
+//======================================= HELPER FUNCTIONS =======================================
+// If error is non-nil, print it out and halt.
+func checkError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// Register RPC services and listens for incoming dialing, the relay of classic mode included
+func initListener(address string) {
+	callbacks = make(map[string]*callback)
+
+	rpc.Register(new(ClientService))
+	rpcc.RegisterServices()
+	ln, e := net.Listen("tcp", address)
+	if e != nil {
+		log.Fatal("listen error:", e)
+	}
+	go rpcc.Accept(ln)
+
+	// A chain that can't be delivered fails its operation instead of halting the run
+	rpcc.RegisterErrorHandler(func(chain *rpcc.RPCChain, error string) {
+		failCall(chain.Id, error)
+	})
+}
+
+//Dial to address, outside of rpcc so the status queries aren't counted
+func dialAddr(addr string) (*rpc.Client, error) {
+
+	service, err := rpc.Dial("tcp", addr)
+	return service, err
+}
+
+// The front end and every live node of the logical services
+func countedNodes(frontendAddr string) []string {
+	nodes := []string{frontendAddr}
+	registry := rpcc.NewRemoteResolver(frontendAddr, "FrontEndMapService.Resolve")
+	for _, logical := range LogicalServices {
+		addrs, err := registry.Resolve(rpcc.ServerEntity{Logical_service: logical})
+		if err != nil {
+			fmt.Println("No nodes for", logical+":", err)
+		}
+		nodes = append(nodes, addrs...)
+	}
+	return nodes
+}
+
+// The traffic of this process and every node, nodes that can't be asked count nothing
+func wireTotal(nodes []string) rpcc.WireStats {
+	total := rpcc.Wire()
+	for _, addr := range nodes {
+		service, err := dialAddr(addr)
+		if err != nil {
+			fmt.Println("Unable to reach", addr, "for its traffic:", err)
+			continue
+		}
+
+		var reply rpcc.StatusReply
+		err = service.Call("RPCCStatusService.Breakers", rpcc.StatusArgs{}, &reply)
+		service.Close()
+		if err != nil {
+			fmt.Println("Unable to query", addr, "for its traffic:", err)
+			continue
+		}
+		total = total.Add(reply.Wire)
+	}
+	return total
+}
+
+//======================================= WORKLOAD =======================================
+// Runs one operation per content, one after the other. Every other file is secret, stored
+// on filestore A through auth.
+func runOperations(frontendAddr string, mode string, kind string, prefix string, contents []string, nodes []string) Result {
+	result := Result{Mode: mode, Kind: kind}
+
+	before := wireTotal(nodes)
+	for i, content := range contents {
+		args := ValArgs{File_Name: fmt.Sprintf("%s-%d.txt", prefix, i), ErrorCode: INCOMPLETE_CHAIN}
+		if i%2 == 1 {
+			args.Secret_info = Secret
+		}
+
+		entryFunc, callType := RetrieveEntryFunction, "FRetrieve"
+		if kind == "STORE" {
+			entryFunc, callType = StoreEntryFunction, "FStore"
+			args.Content_ref = rpcc.Buffer(NodeAddress, []byte(content))
+		}
+
+		chain := rpcc.CreateChain()
+		chain.AddToChain(NodeAddress, NodeService, entryFunc, args, -1)
+		chain.AddToChain(frontendAddr, "FrontEndServiceClient", callType, nil, -1)
+		if mode == "classic" {
+			chain.RelayThrough(NodeAddress)
+		}
+
+		cb := &callback{}
+		callbackMutex.Lock()
+		callbacks[chain.Id] = cb
+		callbackMutex.Unlock()
+
+		start := time.Now()
+		err := chain.CallNext(10000)
+		elapsed := time.Since(start)
+		if err != nil {
+			failCall(chain.Id, err.Error())
+		}
+
+		callbackMutex.Lock()
+		delete(callbacks, chain.Id)
+		done := *cb
+		callbackMutex.Unlock()
+
+		switch {
+		case !done.ok:
+			fmt.Printf("%s %s %s failed: %s\n", mode, kind, args.File_Name, done.err)
+			result.Failed++
+		case done.args.ErrorCode != SUCCESSFUL_COMPLETED:
+			fmt.Printf("%s %s %s failed with error code %d\n", mode, kind, args.File_Name, done.args.ErrorCode)
+			result.Failed++
+		case kind == "RETRIEVE" && done.args.Text_content != content:
+			fmt.Printf("%s %s %s returned %d bytes, %d stored\n", mode, kind, args.File_Name, len(done.args.Text_content), len(content))
+			result.Failed++
+		default:
+			result.Latencies = append(result.Latencies, elapsed)
+		}
+	}
+	result.Wire = wireTotal(nodes).Sub(before)
+
+	sort.Slice(result.Latencies, func(i, j int) bool { return result.Latencies[i] < result.Latencies[j] })
+	return result
+}
+
+func completeCall(chainId string, args ValArgs) {
+	callbackMutex.Lock()
+	defer callbackMutex.Unlock()
+
+	if cb, ok := callbacks[chainId]; ok && !cb.ok {
+		cb.args = args
+		cb.ok = true
+	}
+}
+
+func failCall(chainId string, error string) {
+	callbackMutex.Lock()
+	defer callbackMutex.Unlock()
+
+	if cb, ok := callbacks[chainId]; ok && !cb.ok && cb.err == "" {
+		cb.err = error
+	}
+}
+
+func randomContent(random *rand.Rand, size int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = letters[random.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+//======================================= REPORT =======================================
+func printResults(results []Result) {
+	fmt.Println()
+	fmt.Printf("%-8s %-9s %5s %6s %9s %9s %9s %10s %9s %8s %10s\n",
+		"mode", "op", "ok", "failed", "p50", "p90", "p99", "bytes/op", "conns/op", "hops/op", "conns/hop")
+	for _, r := range results {
+		ops := float64(len(r.Latencies) + r.Failed)
+		connsPerHop := 0.0
+		if r.Wire.Hops > 0 {
+			connsPerHop = float64(r.Wire.Connections) / float64(r.Wire.Hops)
+		}
+		fmt.Printf("%-8s %-9s %5d %6d %9s %9s %9s %10.0f %9.1f %8.1f %10.2f\n",
+			r.Mode, r.Kind, len(r.Latencies), r.Failed,
+			percentile(r.Latencies, 0.5), percentile(r.Latencies, 0.9), percentile(r.Latencies, 0.99),
+			float64(r.Wire.BytesSent+r.Wire.BytesRecv)/ops, float64(r.Wire.Connections)/ops,
+			float64(r.Wire.Hops)/ops, connsPerHop)
+	}
+}
+
+// Nearest-rank percentile of sorted latencies, rounded for printing
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank].Round(10 * time.Microsecond)
+}
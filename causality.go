@@ -0,0 +1,352 @@
+// Usage: go run causality.go [rules file] [log file or directory]...
+//
+// - [rules file] : the invariants to check, see causality.rules.
+// - [log file or directory] : GoVector logs written by the nodes ([node]-Log.txt), or
+//   directories holding them. Every node of a run should be given, events of missing
+//   nodes can't be ordered.
+//
+// Rebuilds the happens-before graph of the run from the vector clocks, plus the replies
+// to chain hops (which carry no clock), and reports every event breaking an invariant
+// along with the chains involved. Exits with 1 if there are violations.
+//
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//======================================= STRUCTS =======================================
+// A line of a GoVector log
+type Event struct {
+	Node    string
+	Index   uint64            // the node's own entry in Clock, its position in the node's log
+	Clock   map[string]uint64 // as logged
+	Message string
+	Chains  []string
+
+	hb    map[string]uint64 // Clock merged with the replies this event waited on
+	state int               // 0 unvisited, 1 visiting, 2 done
+}
+
+// Every event matching After needs an event matching Before, with the same key, to happen before it
+type Rule struct {
+	Name   string
+	Before *regexp.Regexp
+	After  *regexp.Regexp
+}
+
+type Violation struct {
+	Rule   string
+	Key    string
+	Event  *Event
+	Later  []*Event // events matching Before that didn't happen before Event
+	Chains []string
+}
+
+//======================================= VARIABLES =======================================
+// node -> events in log order
+var Logs map[string][]*Event
+
+// "[entry] [direction] replied by [service] [chain]" -> callee events that replied to the hop
+var Replies map[string][]*Event
+
+var chainPattern = regexp.MustCompile(`\[chain ([^\]]+)\]`)
+
+//======================================= MAIN =======================================
+
+func main() {
+
+	// parse args
+	usage := fmt.Sprintf("Usage: %s [rules file] [log file or directory]...\n", os.Args[0])
+	if len(os.Args) < 3 {
+		fmt.Print(usage)
+		os.Exit(1)
+	}
+
+	rules, err := loadRules(os.Args[1])
+	checkError(err)
+
+	Logs = make(map[string][]*Event)
+	Replies = make(map[string][]*Event)
+	for _, path := range os.Args[2:] {
+		checkError(loadLogs(path))
+	}
+
+	events := 0
+	for _, log := range Logs {
+		events += len(log)
+	}
+	fmt.Printf("%d events from %d nodes\n", events, len(Logs))
+
+	violations := 0
+	for _, rule := range rules {
+		checked, found := checkRule(rule)
+		fmt.Printf("%s: %d checked, %d violations\n", rule.Name, checked, len(found))
+		for _, v := range found {
+			printViolation(v)
+		}
+		violations += len(found)
+	}
+
+	if violations > 0 {
+		os.Exit(1)
+	}
+}
+
+//======================================= HELPER FUNCTIONS =======================================
+// Reads "[name]: [before] -> [after]" lines, # starts a comment
+func loadRules(path string) ([]Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := make([]Rule, 0)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		colon := strings.Index(line, ":")
+		arrow := strings.LastIndex(line, " -> ")
+		if colon < 0 || arrow < colon {
+			return nil, fmt.Errorf("%s:%d: expected [name]: [before] -> [after]", path, n)
+		}
+
+		before, err := regexp.Compile(strings.TrimSpace(line[colon+1 : arrow]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err.Error())
+		}
+		after, err := regexp.Compile(strings.TrimSpace(line[arrow+4:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err.Error())
+		}
+		rules = append(rules, Rule{Name: strings.TrimSpace(line[:colon]), Before: before, After: after})
+	}
+	return rules, scanner.Err()
+}
+
+// Loads a log, or every [node]-Log.txt in a directory
+func loadLogs(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*-Log.txt"))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		if err := loadLog(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GoVector logs are pairs of lines: "[node] [clock as json]" then the message
+func loadLog(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		header := strings.TrimSpace(scanner.Text())
+		if header == "" {
+			continue
+		}
+
+		space := strings.Index(header, " ")
+		if space < 0 {
+			return fmt.Errorf("%s:%d: expected [node] [clock]", path, n)
+		}
+		event := &Event{Node: header[:space]}
+		if err := json.Unmarshal([]byte(header[space+1:]), &event.Clock); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, n, err.Error())
+		}
+		event.Index = event.Clock[event.Node]
+
+		if scanner.Scan() {
+			n++
+			event.Message = scanner.Text()
+		}
+		for _, match := range chainPattern.FindAllStringSubmatch(event.Message, -1) {
+			event.Chains = append(event.Chains, match[1])
+		}
+
+		Logs[event.Node] = append(Logs[event.Node], event)
+		if strings.Contains(event.Message, " replied by ") {
+			Replies[event.Message] = append(Replies[event.Message], event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, log := range Logs {
+		sort.Slice(log, func(i, j int) bool { return log[i].Index < log[j].Index })
+	}
+	return nil
+}
+
+// The event a node logged with its own clock at index, nil if it isn't in the logs
+func eventAt(node string, index uint64) *Event {
+	log := Logs[node]
+	i := sort.Search(len(log), func(i int) bool { return log[i].Index >= index })
+	if i < len(log) && log[i].Index == index {
+		return log[i]
+	}
+	return nil
+}
+
+// Vector clocks miss the replies to chain hops, so an event's happens-before clock also
+// merges every event before it on its node and the callee's reply it waited for
+func happensBeforeClock(event *Event) map[string]uint64 {
+	if event.state == 2 {
+		return event.hb
+	}
+	if event.state == 1 {
+		// a cycle can only come from mismatched replies, drop the edge
+		return nil
+	}
+	event.state = 1
+
+	event.hb = make(map[string]uint64)
+	merge := func(clock map[string]uint64) {
+		for node, ticks := range clock {
+			if ticks > event.hb[node] {
+				event.hb[node] = ticks
+			}
+		}
+	}
+
+	merge(event.Clock)
+	for node, ticks := range event.Clock {
+		if pred := eventAt(node, ticks); pred != nil && pred != event {
+			merge(happensBeforeClock(pred))
+		}
+	}
+	if pred := eventAt(event.Node, event.Index-1); pred != nil {
+		merge(happensBeforeClock(pred))
+	}
+	if strings.Contains(event.Message, " reply from ") {
+		key := strings.Replace(event.Message, " reply from ", " replied by ", 1)
+		for _, pred := range Replies[key] {
+			merge(happensBeforeClock(pred))
+		}
+	}
+	event.hb[event.Node] = event.Index
+
+	event.state = 2
+	return event.hb
+}
+
+func happensBefore(a *Event, b *Event) bool {
+	return a != b && happensBeforeClock(b)[a.Node] >= a.Index
+}
+
+func checkRule(rule Rule) (int, []Violation) {
+	before := make(map[string][]*Event)
+	after := make([]*Event, 0)
+	for _, node := range sortedNodes() {
+		for _, event := range Logs[node] {
+			if key, ok := ruleKey(rule.Before, event.Message); ok {
+				before[key] = append(before[key], event)
+			}
+			if _, ok := ruleKey(rule.After, event.Message); ok {
+				after = append(after, event)
+			}
+		}
+	}
+
+	violations := make([]Violation, 0)
+	for _, event := range after {
+		key, _ := ruleKey(rule.After, event.Message)
+
+		ok := false
+		for _, candidate := range before[key] {
+			if happensBefore(candidate, event) {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			continue
+		}
+
+		v := Violation{Rule: rule.Name, Key: key, Event: event, Later: before[key]}
+		v.Chains = event.Chains
+		if len(v.Chains) == 0 {
+			// the event names no chain, blame the chains of its key instead
+			for _, candidate := range before[key] {
+				v.Chains = append(v.Chains, candidate.Chains...)
+			}
+		}
+		violations = append(violations, v)
+	}
+	return len(after), violations
+}
+
+// The first group the pattern captures, or the whole match if it has none
+func ruleKey(pattern *regexp.Regexp, message string) (string, bool) {
+	match := pattern.FindStringSubmatch(message)
+	if match == nil {
+		return "", false
+	}
+	if len(match) > 1 {
+		return match[1], true
+	}
+	return match[0], true
+}
+
+func printViolation(v Violation) {
+	chains := "unknown"
+	if len(v.Chains) > 0 {
+		chains = strings.Join(v.Chains, ", ")
+	}
+
+	fmt.Printf("  VIOLATION [%s] key %q, chains %s\n", v.Rule, v.Key, chains)
+	fmt.Printf("    %s #%d: %s\n", v.Event.Node, v.Event.Index, v.Event.Message)
+	if len(v.Later) == 0 {
+		fmt.Println("    nothing matching the before pattern was logged")
+	}
+	for _, later := range v.Later {
+		fmt.Printf("    concurrent or later: %s #%d: %s\n", later.Node, later.Index, later.Message)
+	}
+}
+
+func sortedNodes() []string {
+	nodes := make([]string, 0, len(Logs))
+	for node := range Logs {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// If error is non-nil, print it out and halt.
+func checkError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
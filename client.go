@@ -10,14 +10,12 @@ import (
 	"bufio"
 	"encoding/gob"
 	"fmt"
-	"github.com/arcaneiceman/GoVector/govec"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
 	"strings"
-	"time"
 )
 
 //======================================= SERVICE =======================================
@@ -29,11 +27,15 @@ type ValArgs struct {
 	Secret_info  string
 	Text_content string
 	ErrorCode    int
+	Content_ref  rpcc.PayloadRef // Text_content buffered on the first or target hop
 }
 
 type ValMetadata struct {
 	FilestoreMapA map[int]NodeInfo
 	FilestoreMapB map[int]NodeInfo
+
+	Shard_A string // logical services of the groups owning the file
+	Shard_B string
 }
 
 type NodeInfo struct {
@@ -47,11 +49,6 @@ type ValReply struct {
 	Val string // value; depends on the call
 }
 
-type Msg struct {
-	Content       string
-	RealTimestamp string
-}
-
 //======================================= VARIABLES =======================================
 const NodeService string = "ClientService"
 const StoreEntryFunction string = "CStore"
@@ -70,20 +67,16 @@ var callBackContent string
 
 const FileBasePath = "./ClientFiles/"
 
-var Logger *govec.GoLog
-
 //======================================= SERVICE METHODS =======================================
 
 func (cs *ClientService) CStore(chain *rpcc.RPCChain, reply *bool) error {
 
-	cmd := "STORE"
-	HandleLog(cmd, chain)
-
 	args := chain.CurrentEntity().Args.(ValArgs)
 
 	if args.ErrorCode == SUCCESSFUL_COMPLETED {
 		fmt.Println("FILE NAME:", args.File_Name, "SECRET:", args.Secret_info)
 		fmt.Println("File succesfully stored, terminating.")
+		rpcc.LogLocalEvent(fmt.Sprintf("store acked file=%s [chain %s]", args.File_Name, chain.Id))
 		callBackChainID = chain.Id
 	} else if args.ErrorCode == INVALID_AUTH_ERROR {
 		fmt.Println("Unable to store. Invalid secret provided!")
@@ -97,11 +90,18 @@ func (cs *ClientService) CStore(chain *rpcc.RPCChain, reply *bool) error {
 
 func (cs *ClientService) CRetrieve(chain *rpcc.RPCChain, reply *bool) error {
 
-	cmd := "RETRIEVE"
-	HandleLog(cmd, chain)
-
 	args := chain.CurrentEntity().Args.(ValArgs)
 
+	// The content is left on the filestore, only fetch it now
+	if args.Content_ref.IsSet() {
+		data, err := rpcc.Fetch(args.Content_ref)
+		if err != nil {
+			fmt.Println("Unable to fetch retrieved content:", err)
+		}
+		rpcc.Release(args.Content_ref)
+		args.Text_content = string(data)
+	}
+
 	fmt.Println("FILE NAME:", args.File_Name, "CONTENT:", args.Text_content)
 	fmt.Println("File succesfully retrieved, terminating.")
 
@@ -116,9 +116,6 @@ func (cs *ClientService) CRetrieve(chain *rpcc.RPCChain, reply *bool) error {
 
 func (cs *ClientService) CList(chain *rpcc.RPCChain, reply *bool) error {
 
-	cmd := "LIST"
-	HandleLog(cmd, chain)
-
 	args := chain.CurrentEntity().Args.(ValArgs)
 
 	fmt.Println(args.File_Name)
@@ -132,8 +129,11 @@ func (cs *ClientService) CList(chain *rpcc.RPCChain, reply *bool) error {
 
 func main() {
 
-	// Initiate Logger
-	Logger = govec.Initialize("client", "client")
+	// Initiate tracing of chains
+	rpcc.InitTracer("client", os.Getenv("RPCC_TRACER"))
+	checkError(rpcc.EnableRecording("client", os.Getenv("RPCC_RECORD_DIR")))
+	rpcc.InitBreakers(os.Getenv("RPCC_BREAKER"))
+	rpcc.InitTimeouts(os.Getenv("RPCC_TIMEOUTS"))
 
 	// parse args
 	usage := fmt.Sprintf("Usage: %s ip:port\n", os.Args[0])
@@ -192,10 +192,6 @@ func main() {
 }
 
 //======================================= HELPER FUNCTIONS =======================================
-func (m Msg) String() string {
-	return "content: " + m.Content + "\ntime: " + m.RealTimestamp
-}
-
 // This function handles the command entered by the user.
 func handleCommand(command string, frontendAddr string) {
 
@@ -261,11 +257,20 @@ func handleCommand(command string, frontendAddr string) {
 	case "listput":
 		listFilePut()
 
+	// DRAIN
+	case "drain":
+		if filename == "" {
+			fmt.Println("Please provide a node key.")
+			return
+		}
+		drainNode(filename, frontendAddr)
+
 	case "help":
 		fmt.Println("listput -to print local files")
 		fmt.Println("listget -to print remote files")
 		fmt.Println("retrieve filename [Optional 'Yes' for secure files] -to retrieve a remote file")
 		fmt.Println("store filename [Optional Password] -to store a local file")
+		fmt.Println("drain node-key -to take a node out of the cluster, [role]-[group]-[id]")
 
 	// DEFAULT
 	default:
@@ -277,7 +282,7 @@ func handleCommand(command string, frontendAddr string) {
 // If error is non-nil, print it out and halt.
 func checkError(err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error ", err.Error())
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
 		os.Exit(1)
 	}
 }
@@ -286,11 +291,12 @@ func checkError(err error) {
 func initListener(address string) {
 	service := new(ClientService)
 	rpc.Register(service)
+	rpcc.RegisterServices()
 	ln, e := net.Listen("tcp", address)
 	if e != nil {
 		log.Fatal("listen error:", e)
 	} else {
-		go rpc.Accept(ln)
+		go rpcc.Accept(ln)
 	}
 }
 
@@ -303,12 +309,16 @@ func ServiceCall(callType string, name string, content string, secret string, ad
 		ErrorCode:    INCOMPLETE_CHAIN,
 	}
 
+	// Only the filestore needs the content, buffer it here and pass a reference
+	if content != "" {
+		args.Content_ref = rpcc.Buffer(NodeAddress, []byte(content))
+		args.Text_content = ""
+	}
+
 	chain := rpcc.CreateChain()
 
 	chain.AddToChain(NodeAddress, NodeService, entryFunc, args, -1)
 	chain.AddToChain(address, "FrontEndServiceClient", callType, nil, -1)
-	logBuf := GenerateLog(callType, chain)
-	chain.AddLogToChain(logBuf)
 
 	//fmt.Println("Calling front end with chain:", chain)
 	chain.CallNext(10000)
@@ -316,34 +326,6 @@ func ServiceCall(callType string, name string, content string, secret string, ad
 	return chain
 }
 
-func HandleLog(cmd string, chain *rpcc.RPCChain) {
-
-	if chain.IsReturnCall == false {
-		logMessage := new(Msg)
-		prevChain := chain.CurrentPosition - 1
-		Logger.UnpackReceive(cmd+" request received from "+chain.EntityList[prevChain].Service_info, chain.Log, &logMessage)
-		fmt.Println(logMessage.String())
-	}
-
-	if chain.IsReturnCall == true {
-		logMessage := new(Msg)
-		prevChain := chain.FindEntity("FrontEndServiceClient")
-		Logger.UnpackReceive(cmd+" return from "+prevChain.Service_info, chain.Log, &logMessage)
-		fmt.Println(logMessage.String())
-	}
-
-}
-
-func GenerateLog(callType string, chain *rpcc.RPCChain) []byte {
-
-	nextChain := chain.CurrentPosition + 1
-	logMessage := Msg{"Client " + callType + "log.", time.Now().String()}
-	fmt.Println(chain.EntityList[nextChain].Service_info)
-	logBuf := Logger.PrepareSend(callType+" request to "+chain.EntityList[nextChain].Service_info, logMessage)
-	return logBuf
-
-}
-
 //write the given file to client's file folder
 func saveFile(filename string, filecontent string) {
 	byteContent := []byte(filecontent)
@@ -353,6 +335,27 @@ func saveFile(filename string, filecontent string) {
 	}
 }
 
+// DRAIN command, the front end stops routing to the node, hands its data over and deregisters it.
+type DrainArgs struct {
+	Key string
+}
+
+func drainNode(key string, frontendAddr string) {
+	dialservice, err := rpc.Dial("tcp", frontendAddr)
+	if err != nil {
+		fmt.Println("Unable to reach the front end:", err)
+		return
+	}
+	defer dialservice.Close()
+
+	var reply ValReply
+	if err := dialservice.Call("FrontEndMapService.Drain", DrainArgs{Key: key}, &reply); err != nil {
+		fmt.Println("Drain failed:", err)
+		return
+	}
+	fmt.Println(reply.Val)
+}
+
 // LIST command that returns a list of files that can be retrieved from filestore.
 func listFileGet(frontendAddr string) {
 	fmt.Println("LIST ===============")
@@ -0,0 +1,427 @@
+package config
+
+import (
+	"../registry"
+	"../rpcc"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* === Headers === */
+
+// The topology of a cluster and the settings its binaries share, read from a JSON file like
+// cluster.json. Every binary loads the same file and picks its own front end or node by name.
+type Config struct {
+	FrontEnds   []FrontEnd     `json:"frontends"`
+	Nodes       []Node         `json:"nodes"`
+	Replication map[string]int `json:"replication"` // Active nodes per shard by role, DefaultReplication for the others
+	Seeds       []string       `json:"seeds"`       // Gossip seeds of the nodes, the front ends bootstrap from them too
+	Timeouts    Timeouts       `json:"timeouts"`
+	Storage     Storage        `json:"storage"`
+
+	// Specs of the rpcc and registry settings, see their parsers; empty keeps the defaults
+	Tracer           string `json:"tracer"`
+	Breaker          string `json:"breaker"`
+	AdaptiveTimeouts string `json:"adaptive_timeouts"`
+	HedgeDelay       string `json:"hedge_delay"`
+	Detector         string `json:"detector"`
+	Balancer         string `json:"balancer"`
+}
+
+// The listeners of a front end, one per kind of peer
+type FrontEnd struct {
+	Name       string `json:"name"`
+	Client     string `json:"client"`
+	Metadata   string `json:"metadata"`
+	Auth       string `json:"auth"`
+	FilestoreA string `json:"filestoreA"`
+	FilestoreB string `json:"filestoreB"`
+	Extra      string `json:"extra"` // The front ends elect their leader over it
+	Admin      string `json:"admin"` // HTTP, none if empty
+}
+
+type Node struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"` // metadata, auth, filestoreA or filestoreB
+	Listen string `json:"listen"`
+	Group  int    `json:"group"`
+}
+
+type Timeouts struct {
+	Hop       Duration `json:"hop"`       // How long a hop of a chain waits for the next
+	Report    Duration `json:"report"`    // Between the reports of a node
+	Lease     Duration `json:"lease"`     // Of the leading front end
+	Heartbeat Duration `json:"heartbeat"` // Of the leading front end
+	Drain     Duration `json:"drain"`     // How long a drain waits for the chains of the node
+}
+
+type Storage struct {
+	Dir     string `json:"dir"`     // Where nodes keep their uuid
+	Records string `json:"records"` // Where every chain received is recorded, none if empty
+}
+
+// A time.Duration written like "10s" or "250ms"
+type Duration struct {
+	time.Duration
+}
+
+const (
+	Metadata   = "metadata"
+	Auth       = "auth"
+	FilestoreA = "filestoreA"
+	FilestoreB = "filestoreB"
+)
+
+var Roles = []string{Metadata, Auth, FilestoreA, FilestoreB}
+
+const DefaultReplication = 2
+
+var DefaultTimeouts = Timeouts{
+	Hop:       Duration{10 * time.Second},
+	Report:    Duration{time.Second},
+	Lease:     Duration{3 * time.Second},
+	Heartbeat: Duration{time.Second},
+	Drain:     Duration{10 * time.Second},
+}
+
+/* === Globals === */
+
+// Environment variables overriding the settings of the file, for every binary
+var overrides = []struct {
+	name string
+	set  func(c *Config, value string) error
+}{
+	{"RPCC_GOSSIP_SEEDS", func(c *Config, value string) error { c.Seeds = split(value); return nil }},
+	{"RPCC_REPLICATION", parseReplication},
+	{"RPCC_HOP_TIMEOUT", func(c *Config, value string) error { return c.Timeouts.Hop.parse(value) }},
+	{"RPCC_REPORT_INTERVAL", func(c *Config, value string) error { return c.Timeouts.Report.parse(value) }},
+	{"RPCC_LEASE", func(c *Config, value string) error { return c.Timeouts.Lease.parse(value) }},
+	{"RPCC_HEARTBEAT", func(c *Config, value string) error { return c.Timeouts.Heartbeat.parse(value) }},
+	{"RPCC_DRAIN_TIMEOUT", func(c *Config, value string) error { return c.Timeouts.Drain.parse(value) }},
+	{"RPCC_STORAGE_DIR", func(c *Config, value string) error { c.Storage.Dir = value; return nil }},
+	{"RPCC_RECORD_DIR", func(c *Config, value string) error { c.Storage.Records = value; return nil }},
+	{"RPCC_TRACER", func(c *Config, value string) error { c.Tracer = value; return nil }},
+	{"RPCC_BREAKER", func(c *Config, value string) error { c.Breaker = value; return nil }},
+	{"RPCC_TIMEOUTS", func(c *Config, value string) error { c.AdaptiveTimeouts = value; return nil }},
+	{"RPCC_HEDGE_DELAY", func(c *Config, value string) error { c.HedgeDelay = value; return nil }},
+	{"RPCC_DETECTOR", func(c *Config, value string) error { c.Detector = value; return nil }},
+	{"RPCC_BALANCER", func(c *Config, value string) error { c.Balancer = value; return nil }},
+}
+
+/* === Functions === */
+// Reads the file, then the environment overrides, and checks the result, creating the
+// storage directories. The error lists every problem found.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s", err.Error())
+	}
+
+	c := &Config{Timeouts: DefaultTimeouts, Storage: Storage{Dir: "."}}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return nil, fmt.Errorf("config: %s: %s", path, err.Error())
+	}
+
+	problems := make([]string, 0)
+	for _, override := range overrides {
+		if value, ok := os.LookupEnv(override.name); ok {
+			if err := override.set(c, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", override.name, err.Error()))
+			}
+		}
+	}
+	problems = append(problems, c.validate()...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("config: %s: %s", path, strings.Join(problems, "; "))
+	}
+	return c, nil
+}
+
+// The front end of that name, with its admin address overridden by RPCC_ADMIN
+func (c *Config) FrontEnd(name string) (FrontEnd, error) {
+	for _, frontEnd := range c.FrontEnds {
+		if frontEnd.Name != name {
+			continue
+		}
+		if admin, ok := os.LookupEnv("RPCC_ADMIN"); ok {
+			if admin != "" {
+				if err := checkAddr(admin); err != nil {
+					return frontEnd, fmt.Errorf("config: RPCC_ADMIN: %s", err.Error())
+				}
+			}
+			frontEnd.Admin = admin
+		}
+		return frontEnd, nil
+	}
+	return FrontEnd{}, fmt.Errorf("config: no front end named %q", name)
+}
+
+// The node of that name, which has to serve the role. RPCC_LISTEN and RPCC_GROUP override
+// its address and group, so one entry can start several replicas.
+func (c *Config) Node(name string, role string) (Node, error) {
+	for _, node := range c.Nodes {
+		if node.Name != name {
+			continue
+		}
+		if node.Role != role {
+			return node, fmt.Errorf("config: node %q is a %s node, not %s", name, node.Role, role)
+		}
+		if listen, ok := os.LookupEnv("RPCC_LISTEN"); ok {
+			if err := checkAddr(listen); err != nil {
+				return node, fmt.Errorf("config: RPCC_LISTEN: %s", err.Error())
+			}
+			node.Listen = listen
+		}
+		if group, ok := os.LookupEnv("RPCC_GROUP"); ok {
+			var err error
+			if node.Group, err = strconv.Atoi(group); err != nil || node.Group < 0 {
+				return node, fmt.Errorf("config: RPCC_GROUP: bad group %q", group)
+			}
+		}
+		return node, nil
+	}
+	return Node{}, fmt.Errorf("config: no node named %q", name)
+}
+
+// The listeners of every front end for the nodes of the role, separated by commas; nodes
+// report to the first that answers. RPCC_REPORT_TO overrides them.
+func (c *Config) ReportAddrs(role string) string {
+	if addrs, ok := os.LookupEnv("RPCC_REPORT_TO"); ok {
+		return addrs
+	}
+
+	addrs := make([]string, 0, len(c.FrontEnds))
+	for _, frontEnd := range c.FrontEnds {
+		addrs = append(addrs, frontEnd.addrFor(role))
+	}
+	return strings.Join(addrs, ",")
+}
+
+// The extra addresses of every front end, the peers of their election
+func (c *Config) Peers() []string {
+	peers := make([]string, 0, len(c.FrontEnds))
+	for _, frontEnd := range c.FrontEnds {
+		peers = append(peers, frontEnd.Extra)
+	}
+	return peers
+}
+
+func (c *Config) ReplicationOf(role string) int {
+	if replication, ok := c.Replication[role]; ok {
+		return replication
+	}
+	return DefaultReplication
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations are strings like \"10s\", not %s", string(data))
+	}
+	return d.parse(s)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+/* == Private Functions == */
+// Every problem of the topology, described by where it is
+func (c *Config) validate() []string {
+	problems := make([]string, 0)
+	addrs := make(map[string]string) // Address -> where it's used first
+	names := make(map[string]bool)
+	checkUnique := func(where string, addr string) {
+		if err := checkAddr(addr); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", where, err.Error()))
+			return
+		}
+		if first, ok := addrs[addr]; ok {
+			problems = append(problems, fmt.Sprintf("%s: %s is used by %s already", where, addr, first))
+			return
+		}
+		addrs[addr] = where
+	}
+	checkName := func(where string, name string) {
+		switch {
+		case name == "":
+			problems = append(problems, where+": missing name")
+		case names[name]:
+			problems = append(problems, fmt.Sprintf("%s: name %q is taken", where, name))
+		}
+		names[name] = true
+	}
+
+	if len(c.FrontEnds) == 0 {
+		problems = append(problems, "frontends: at least one front end is needed")
+	}
+	for i, frontEnd := range c.FrontEnds {
+		where := fmt.Sprintf("frontends[%d]", i)
+		checkName(where, frontEnd.Name)
+		checkUnique(where+".client", frontEnd.Client)
+		for _, role := range Roles {
+			checkUnique(where+"."+role, frontEnd.addrFor(role))
+		}
+		checkUnique(where+".extra", frontEnd.Extra)
+		if frontEnd.Admin != "" {
+			checkUnique(where+".admin", frontEnd.Admin)
+		}
+	}
+
+	for i, node := range c.Nodes {
+		where := fmt.Sprintf("nodes[%d]", i)
+		checkName(where, node.Name)
+		if !isRole(node.Role) {
+			problems = append(problems, fmt.Sprintf("%s.role: unknown role %q, one of %s", where, node.Role, strings.Join(Roles, ", ")))
+		}
+		checkUnique(where+".listen", node.Listen)
+		if node.Group < 0 {
+			problems = append(problems, fmt.Sprintf("%s.group: negative group %d", where, node.Group))
+		}
+	}
+
+	for role, replication := range c.Replication {
+		if !isRole(role) {
+			problems = append(problems, fmt.Sprintf("replication: unknown role %q", role))
+		}
+		if replication < 1 {
+			problems = append(problems, fmt.Sprintf("replication.%s: needs at least 1 active node, not %d", role, replication))
+		}
+	}
+
+	for i, seed := range c.Seeds {
+		if err := checkAddr(seed); err != nil {
+			problems = append(problems, fmt.Sprintf("seeds[%d]: %s", i, err.Error()))
+		}
+	}
+
+	timeouts := []struct {
+		name     string
+		duration Duration
+	}{
+		{"hop", c.Timeouts.Hop}, {"report", c.Timeouts.Report}, {"lease", c.Timeouts.Lease},
+		{"heartbeat", c.Timeouts.Heartbeat}, {"drain", c.Timeouts.Drain},
+	}
+	for _, timeout := range timeouts {
+		if timeout.duration.Duration <= 0 {
+			problems = append(problems, fmt.Sprintf("timeouts.%s: must be positive", timeout.name))
+		}
+	}
+	if c.Timeouts.Heartbeat.Duration >= c.Timeouts.Lease.Duration {
+		problems = append(problems, "timeouts.heartbeat: must be shorter than the lease for the leader to renew it")
+	}
+	// The specs are parsed here too, so a bad one stops every binary before it starts
+	specs := []struct {
+		name  string
+		spec  string
+		parse func(string) error
+	}{
+		{"tracer", c.Tracer, func(s string) error { _, err := rpcc.ParseTracer(s); return err }},
+		{"breaker", c.Breaker, func(s string) error { _, err := rpcc.ParseBreakerConfig(s); return err }},
+		{"adaptive_timeouts", c.AdaptiveTimeouts, func(s string) error { _, err := rpcc.ParseTimeoutConfig(s); return err }},
+		{"hedge_delay", c.HedgeDelay, func(s string) error { _, err := rpcc.ParseHedgeDelay(s); return err }},
+		{"detector", c.Detector, func(s string) error { _, err := registry.ParseDetectorConfig(s); return err }},
+		{"balancer", c.Balancer, func(s string) error { _, err := registry.ParsePolicy(s); return err }},
+	}
+	for _, spec := range specs {
+		if err := spec.parse(spec.spec); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", spec.name, err.Error()))
+		}
+	}
+
+	if c.Storage.Dir == "" {
+		problems = append(problems, "storage.dir: missing, \".\" for the working directory")
+	} else if err := os.MkdirAll(c.Storage.Dir, 0755); err != nil {
+		problems = append(problems, "storage.dir: "+err.Error())
+	}
+	if c.Storage.Records != "" {
+		if err := os.MkdirAll(c.Storage.Records, 0755); err != nil {
+			problems = append(problems, "storage.records: "+err.Error())
+		}
+	}
+	return problems
+}
+
+func (frontEnd FrontEnd) addrFor(role string) string {
+	switch role {
+	case Metadata:
+		return frontEnd.Metadata
+	case Auth:
+		return frontEnd.Auth
+	case FilestoreA:
+		return frontEnd.FilestoreA
+	case FilestoreB:
+		return frontEnd.FilestoreB
+	}
+	return ""
+}
+
+// Reads a spec like "metadata=3,filestoreA=2" over the replication of the file
+func parseReplication(c *Config, spec string) error {
+	if c.Replication == nil {
+		c.Replication = make(map[string]int)
+	}
+	for _, field := range split(spec) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("bad replication setting %q", field)
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return fmt.Errorf("bad replication setting %q", field)
+		}
+		c.Replication[kv[0]] = n
+	}
+	return nil
+}
+
+func (d *Duration) parse(s string) error {
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func checkAddr(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("missing address")
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("bad address %q: %s", addr, err.Error())
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("bad port in %q", addr)
+	}
+	return nil
+}
+
+func isRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func split(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
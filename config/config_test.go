@@ -0,0 +1,206 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCluster = `{
+	"frontends": [
+		{
+			"name": "frontend-1",
+			"client": "127.0.0.1:2001",
+			"metadata": "127.0.0.1:2002",
+			"auth": "127.0.0.1:2003",
+			"filestoreA": "127.0.0.1:2004",
+			"filestoreB": "127.0.0.1:2005",
+			"extra": "127.0.0.1:2006"
+		}
+	],
+	"nodes": [
+		{"name": "metadata-1", "role": "metadata", "listen": "127.0.0.1:2011"},
+		{"name": "filestoreA-1", "role": "filestoreA", "listen": "127.0.0.1:2013", "group": 1}
+	],
+	"replication": {"filestoreA": 3},
+	"seeds": ["127.0.0.1:2011"]
+}`
+
+// Writes the test cluster to a file, storage goes in the same temporary directory
+func writeCluster(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cluster.json")
+	if err := ioutil.WriteFile(path, []byte(testCluster), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RPCC_STORAGE_DIR", dir)
+	return path, dir
+}
+
+func TestLoadOverrides(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(c *Config) bool // nil when Load has to fail
+		err   string               // Part of the error expected
+	}{
+		{
+			name:  "file only",
+			check: func(c *Config) bool { return c.ReplicationOf(FilestoreA) == 3 && c.Timeouts == DefaultTimeouts },
+		},
+		{
+			name:  "seeds",
+			env:   map[string]string{"RPCC_GOSSIP_SEEDS": "127.0.0.1:3011, 127.0.0.1:3012,"},
+			check: func(c *Config) bool { return reflect.DeepEqual(c.Seeds, []string{"127.0.0.1:3011", "127.0.0.1:3012"}) },
+		},
+		{
+			// Over the file's, the roles not given keep theirs
+			name: "replication",
+			env:  map[string]string{"RPCC_REPLICATION": "metadata=3,auth=1"},
+			check: func(c *Config) bool {
+				return c.ReplicationOf(Metadata) == 3 && c.ReplicationOf(Auth) == 1 && c.ReplicationOf(FilestoreA) == 3 &&
+					c.ReplicationOf(FilestoreB) == DefaultReplication
+			},
+		},
+		{
+			name: "timeouts",
+			env:  map[string]string{"RPCC_HOP_TIMEOUT": "2s", "RPCC_LEASE": "6s", "RPCC_HEARTBEAT": "2s"},
+			check: func(c *Config) bool {
+				return c.Timeouts.Hop.Duration == 2*time.Second && c.Timeouts.Lease.Duration == 6*time.Second &&
+					c.Timeouts.Heartbeat.Duration == 2*time.Second && c.Timeouts.Drain == DefaultTimeouts.Drain
+			},
+		},
+		{
+			name: "specs",
+			env: map[string]string{
+				"RPCC_TRACER": "none", "RPCC_BREAKER": "failures=5", "RPCC_TIMEOUTS": "off",
+				"RPCC_HEDGE_DELAY": "150ms", "RPCC_DETECTOR": "suspect=2", "RPCC_BALANCER": "round-robin",
+			},
+			check: func(c *Config) bool {
+				return c.Tracer == "none" && c.Breaker == "failures=5" && c.AdaptiveTimeouts == "off" &&
+					c.HedgeDelay == "150ms" && c.Detector == "suspect=2" && c.Balancer == "round-robin"
+			},
+		},
+		{name: "bad duration", env: map[string]string{"RPCC_HOP_TIMEOUT": "soon"}, err: "RPCC_HOP_TIMEOUT"},
+		{name: "bad replication", env: map[string]string{"RPCC_REPLICATION": "metadata"}, err: "RPCC_REPLICATION"},
+		{name: "bad seed", env: map[string]string{"RPCC_GOSSIP_SEEDS": "127.0.0.1"}, err: "seeds[0]"},
+		{name: "heartbeat past the lease", env: map[string]string{"RPCC_HEARTBEAT": "5s"}, err: "timeouts.heartbeat"},
+		{name: "bad tracer", env: map[string]string{"RPCC_TRACER": "xray"}, err: "tracer"},
+		{name: "bad breaker", env: map[string]string{"RPCC_BREAKER": "failures=many"}, err: "breaker"},
+		{name: "bad adaptive timeouts", env: map[string]string{"RPCC_TIMEOUTS": "p99"}, err: "adaptive_timeouts"},
+		{name: "bad hedge delay", env: map[string]string{"RPCC_HEDGE_DELAY": "-1s"}, err: "hedge_delay"},
+		{name: "bad detector", env: map[string]string{"RPCC_DETECTOR": "late=1"}, err: "detector"},
+		{name: "bad balancer", env: map[string]string{"RPCC_BALANCER": "random"}, err: "balancer"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, _ := writeCluster(t)
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			c, err := Load(path)
+			if test.check == nil {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("error %v, expected one about %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(c) {
+				t.Errorf("overrides not applied: %+v", c)
+			}
+		})
+	}
+}
+
+func TestLoadStorage(t *testing.T) {
+	path, dir := writeCluster(t)
+	storage := filepath.Join(dir, "nodes", "uuids")
+	records := filepath.Join(dir, "records")
+	t.Setenv("RPCC_STORAGE_DIR", storage)
+	t.Setenv("RPCC_RECORD_DIR", records)
+	if _, err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, created := range []string{storage, records} {
+		if info, err := os.Stat(created); err != nil || !info.IsDir() {
+			t.Errorf("%s not created: %v", created, err)
+		}
+	}
+
+	// A file in the way is rejected
+	blocked := filepath.Join(dir, "cluster.json", "uuids")
+	t.Setenv("RPCC_STORAGE_DIR", blocked)
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "storage.dir") {
+		t.Errorf("error %v, expected one about storage.dir", err)
+	}
+}
+
+func TestNodeOverrides(t *testing.T) {
+	path, _ := writeCluster(t)
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		node  Node
+		admin string
+		err   bool
+	}{
+		{
+			name: "file only",
+			node: Node{Name: "filestoreA-1", Role: FilestoreA, Listen: "127.0.0.1:2013", Group: 1},
+		},
+		{
+			name:  "listen, group and admin",
+			env:   map[string]string{"RPCC_LISTEN": "127.0.0.1:3013", "RPCC_GROUP": "2", "RPCC_ADMIN": "127.0.0.1:8080"},
+			node:  Node{Name: "filestoreA-1", Role: FilestoreA, Listen: "127.0.0.1:3013", Group: 2},
+			admin: "127.0.0.1:8080",
+		},
+		{name: "bad listen", env: map[string]string{"RPCC_LISTEN": "3013"}, err: true},
+		{name: "negative group", env: map[string]string{"RPCC_GROUP": "-1"}, err: true},
+		{name: "bad admin", env: map[string]string{"RPCC_ADMIN": "127.0.0.1:http"}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			node, nodeErr := c.Node("filestoreA-1", FilestoreA)
+			frontEnd, frontEndErr := c.FrontEnd("frontend-1")
+			if test.err {
+				if nodeErr == nil && frontEndErr == nil {
+					t.Error("bad override accepted")
+				}
+				return
+			}
+			if nodeErr != nil || frontEndErr != nil {
+				t.Fatal(nodeErr, frontEndErr)
+			}
+			if node != test.node || frontEnd.Admin != test.admin {
+				t.Errorf("node %+v with admin %q, expected %+v with %q", node, frontEnd.Admin, test.node, test.admin)
+			}
+		})
+	}
+
+	if _, err := c.Node("filestoreA-1", Metadata); err == nil {
+		t.Error("node served a role it doesn't have")
+	}
+	t.Setenv("RPCC_REPORT_TO", "127.0.0.1:4002")
+	if addrs := c.ReportAddrs(Metadata); addrs != "127.0.0.1:4002" {
+		t.Errorf("reporting to %s, expected RPCC_REPORT_TO", addrs)
+	}
+}
@@ -0,0 +1,327 @@
+package election
+
+import (
+	"../rpcc"
+	"log"
+	"math/rand"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+/* === Headers === */
+
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+type Config struct {
+	Self      string
+	Peers     []string      // Every instance, Self included
+	Lease     time.Duration // How long a majority's acknowledgement keeps a leader in place
+	Heartbeat time.Duration // How often the leader renews its lease
+}
+
+// Lease based leader election among a fixed set of peers. A candidate needs the votes of
+// a majority for a new term, and a peer doesn't vote while the lease of a leader it heard
+// from is running, so there's at most one leader at a time as long as clocks run at about
+// the same rate. The leader's heartbeats carry its state to the followers. Leases and
+// heartbeats are timed on rpcc's clock. Safe for concurrent use.
+type Elector struct {
+	config  Config
+	state   func() []byte
+	install func([]byte)
+
+	mutex      sync.Mutex
+	role       Role
+	term       uint64
+	votedFor   string // In term
+	leader     string
+	leaseUntil time.Time // Of the leader this peer follows, or of its own leadership
+	handlers   []Handler
+	random     *rand.Rand
+}
+
+// Called when this peer's role or the leader it follows changes, once the elector is unlocked
+type Handler func(role Role, leader string, term uint64)
+
+var DefaultConfig = Config{
+	Lease:     3 * time.Second,
+	Heartbeat: time.Second,
+}
+
+/* === Functions === */
+// Serves the election RPCs on the default RPC server and starts campaigning once no
+// leader is heard from. The leader sends state() with its heartbeats, followers pass
+// it to install. A peer alone leads right away.
+func Start(config Config, state func() []byte, install func([]byte)) (*Elector, error) {
+	e := newElector(config, state, install)
+	if err := rpc.RegisterName("ElectionService", &ElectionService{e: e}); err != nil {
+		return nil, err
+	}
+
+	go e.run()
+	return e, nil
+}
+
+func (e *Elector) IsLeader() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.role == Leader && rpcc.Now().Before(e.leaseUntil)
+}
+
+// The leader this peer knows of, false while there's none
+func (e *Elector) Leader() (string, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.leader == "" || rpcc.Now().After(e.leaseUntil) {
+		return "", false
+	}
+	return e.leader, true
+}
+
+func (e *Elector) Term() uint64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.term
+}
+
+func (e *Elector) Role() Role {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.role
+}
+
+func (e *Elector) Subscribe(handler Handler) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.handlers = append(e.handlers, handler)
+}
+
+func (role Role) String() string {
+	switch role {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+/* == Private Functions == */
+// The elector Start serves and runs, unset durations take their defaults
+func newElector(config Config, state func() []byte, install func([]byte)) *Elector {
+	if config.Lease <= 0 {
+		config.Lease = DefaultConfig.Lease
+	}
+	if config.Heartbeat <= 0 {
+		config.Heartbeat = DefaultConfig.Heartbeat
+	}
+	if !contains(config.Peers, config.Self) {
+		config.Peers = append(config.Peers, config.Self)
+	}
+
+	e := &Elector{
+		config:  config,
+		state:   state,
+		install: install,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	if len(config.Peers) == 1 {
+		e.role = Leader
+		e.term = 1
+		e.leader = config.Self
+		e.leaseUntil = rpcc.Now().Add(config.Lease)
+	} else {
+		// Give a running leader the time to be heard from before campaigning
+		e.leaseUntil = rpcc.Now().Add(config.Lease)
+	}
+	return e
+}
+
+func (e *Elector) run() {
+	lastBeat := time.Time{}
+	for {
+		<-rpcc.After(e.config.Heartbeat / 4)
+		now := rpcc.Now()
+		switch e.Role() {
+		case Leader:
+			if now.Sub(lastBeat) >= e.config.Heartbeat {
+				lastBeat = now
+				e.heartbeat()
+			}
+		default:
+			if e.leaseExpired(now) {
+				e.campaign()
+			}
+		}
+	}
+}
+
+// Past the lease of the leader, plus up to a heartbeat of jitter so peers don't all campaign at once
+func (e *Elector) leaseExpired(now time.Time) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	jitter := time.Duration(e.random.Int63n(int64(e.config.Heartbeat)))
+	return now.After(e.leaseUntil.Add(jitter))
+}
+
+// Asks every peer for its vote in a new term, leading if a majority grants it
+func (e *Elector) campaign() {
+	started := rpcc.Now()
+
+	e.mutex.Lock()
+	e.role = Candidate
+	e.term++
+	e.votedFor = e.config.Self
+	e.leader = ""
+	args := VoteArgs{Term: e.term, Candidate: e.config.Self}
+	e.mutex.Unlock()
+
+	granted := 1
+	for _, reply := range e.broadcast("ElectionService.RequestVote", args, func() interface{} { return &VoteReply{} }) {
+		vote := reply.(*VoteReply)
+		if e.observeTerm(vote.Term) {
+			return
+		}
+		if vote.Granted {
+			granted++
+		}
+	}
+
+	e.mutex.Lock()
+	if e.role != Candidate || e.term != args.Term || granted <= len(e.config.Peers)/2 {
+		if e.role == Candidate {
+			// Lost, wait a heartbeat or so before trying again so a winner can be heard from
+			e.role = Follower
+			e.leaseUntil = rpcc.Now().Add(e.config.Heartbeat)
+		}
+		e.mutex.Unlock()
+		return
+	}
+	e.role = Leader
+	e.leader = e.config.Self
+	e.leaseUntil = started.Add(e.config.Lease)
+	e.mutex.Unlock()
+
+	log.Println("election: leading term", args.Term, "with", granted, "votes of", len(e.config.Peers))
+	e.notify()
+	e.heartbeat()
+}
+
+// Renews the lease with a majority's acknowledgement, stepping down when it runs out
+func (e *Elector) heartbeat() {
+	started := rpcc.Now()
+
+	e.mutex.Lock()
+	args := HeartbeatArgs{Term: e.term, Leader: e.config.Self}
+	e.mutex.Unlock()
+	if e.state != nil {
+		args.State = e.state()
+	}
+
+	acked := 1
+	for _, reply := range e.broadcast("ElectionService.Heartbeat", args, func() interface{} { return &HeartbeatReply{} }) {
+		ack := reply.(*HeartbeatReply)
+		if e.observeTerm(ack.Term) {
+			return
+		}
+		if ack.Ok {
+			acked++
+		}
+	}
+
+	e.mutex.Lock()
+	if e.role != Leader || e.term != args.Term {
+		e.mutex.Unlock()
+		return
+	}
+	if acked > len(e.config.Peers)/2 {
+		e.leaseUntil = started.Add(e.config.Lease)
+		e.mutex.Unlock()
+		return
+	}
+	if rpcc.Now().Before(e.leaseUntil) {
+		e.mutex.Unlock()
+		return
+	}
+	e.role = Follower
+	e.leader = ""
+	e.mutex.Unlock()
+
+	log.Println("election: lost the majority, stepping down from term", args.Term)
+	e.notify()
+}
+
+// Steps down to follower on a newer term, true if it did
+func (e *Elector) observeTerm(term uint64) bool {
+	e.mutex.Lock()
+	if term <= e.term {
+		e.mutex.Unlock()
+		return false
+	}
+	e.term = term
+	e.role = Follower
+	e.votedFor = ""
+	e.leader = ""
+	e.mutex.Unlock()
+
+	e.notify()
+	return true
+}
+
+// Calls every other peer at once, the replies of the ones that answered within a heartbeat
+func (e *Elector) broadcast(serviceMethod string, args interface{}, newReply func() interface{}) []interface{} {
+	replies := make(chan interface{}, len(e.config.Peers))
+	peers := 0
+	for _, peer := range e.config.Peers {
+		if peer == e.config.Self {
+			continue
+		}
+		peers++
+		go func(peer string) {
+			reply := newReply()
+			if err := rpcc.CallTimeout(peer, serviceMethod, args, reply, e.config.Heartbeat); err != nil {
+				replies <- nil
+				return
+			}
+			replies <- reply
+		}(peer)
+	}
+
+	answered := make([]interface{}, 0, peers)
+	for i := 0; i < peers; i++ {
+		if reply := <-replies; reply != nil {
+			answered = append(answered, reply)
+		}
+	}
+	return answered
+}
+
+func (e *Elector) notify() {
+	e.mutex.Lock()
+	role, leader, term := e.role, e.leader, e.term
+	handlers := append([]Handler{}, e.handlers...)
+	e.mutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(role, leader, term)
+	}
+}
+
+func contains(peers []string, peer string) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package election
+
+import (
+	"../rpcc"
+	"testing"
+	"time"
+)
+
+// Electors a, b and c hosted on the simulator, a leading the first term
+func newTestElection(t *testing.T) (*rpcc.Simulator, *rpcc.FakeClock, map[string]*Elector) {
+	fake := rpcc.NewFakeClock(time.Unix(0, 0))
+	rpcc.SetClock(fake)
+	sim := rpcc.NewSimulator()
+	t.Cleanup(func() {
+		sim.Close()
+		rpcc.SetClock(rpcc.RealClock{})
+	})
+
+	peers := []string{"a", "b", "c"}
+	electors := make(map[string]*Elector)
+	for _, peer := range peers {
+		config := Config{Self: peer, Peers: peers, Lease: 3 * time.Second, Heartbeat: time.Second}
+		electors[peer] = newElector(config, nil, nil)
+		if err := sim.Host(peer, "ElectionService", &ElectionService{e: electors[peer]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	electors["a"].campaign()
+	if !electors["a"].IsLeader() || electors["a"].Term() != 1 {
+		t.Fatalf("a %s in term %d, expected leading the first", electors["a"].Role(), electors["a"].Term())
+	}
+	return sim, fake, electors
+}
+
+func TestElectionLease(t *testing.T) {
+	tests := []struct {
+		name      string
+		drop      bool          // a's heartbeats to b and c are lost
+		advance   time.Duration // Before a heartbeats again
+		heartbeat bool
+		after     time.Duration // Before the checks
+		leads     bool          // a still leads
+		follows   bool          // b still follows a
+		wins      bool          // b wins if it campaigns then
+	}{
+		{name: "lease running", advance: 2 * time.Second, leads: true, follows: true},
+		{
+			name:    "lease renewed",
+			advance: 2 * time.Second, heartbeat: true, after: 2 * time.Second,
+			leads: true, follows: true,
+		},
+		{name: "lease expired", advance: 3*time.Second + time.Millisecond, wins: true},
+		{
+			// Without a majority's acknowledgement a leads until its lease is out, not after
+			name: "partitioned", drop: true,
+			advance: 2 * time.Second, heartbeat: true, after: time.Second + time.Millisecond,
+			wins: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim, fake, electors := newTestElection(t)
+			a, b := electors["a"], electors["b"]
+			if test.drop {
+				sim.Inject("b", "ElectionService.Heartbeat", rpcc.Fault{Drop: true})
+				sim.Inject("c", "ElectionService.Heartbeat", rpcc.Fault{Drop: true})
+			}
+
+			fake.Advance(test.advance)
+			if test.heartbeat {
+				a.heartbeat()
+				if test.drop && !a.IsLeader() {
+					t.Error("a stepped down before its lease ran out")
+				}
+			}
+			fake.Advance(test.after)
+
+			if a.IsLeader() != test.leads {
+				t.Errorf("a leading %v, expected %v", a.IsLeader(), test.leads)
+			}
+			if leader, ok := b.Leader(); (ok && leader == "a") != test.follows {
+				t.Errorf("b follows %q (%v), expected following a %v", leader, ok, test.follows)
+			}
+
+			b.campaign()
+			if b.IsLeader() != test.wins {
+				t.Errorf("b won %v in term %d, expected %v", b.IsLeader(), b.Term(), test.wins)
+			}
+			if a.IsLeader() && b.IsLeader() {
+				t.Error("a and b both lead")
+			}
+		})
+	}
+}
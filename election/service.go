@@ -0,0 +1,99 @@
+package election
+
+import (
+	"../rpcc"
+)
+
+/* === Headers === */
+
+// The election RPCs, served on the default RPC server next to the instance's own services
+type ElectionService struct {
+	e *Elector
+}
+
+type VoteArgs struct {
+	Term      uint64
+	Candidate string
+}
+
+type VoteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+type HeartbeatArgs struct {
+	Term   uint64
+	Leader string
+	State  []byte // The leader's state for the followers to install
+}
+
+type HeartbeatReply struct {
+	Term uint64
+	Ok   bool
+}
+
+/* === Functions === */
+// Grants one vote per term, none while the lease of another leader is running
+func (s *ElectionService) RequestVote(args VoteArgs, reply *VoteReply) error {
+	e := s.e
+	e.mutex.Lock()
+
+	now := rpcc.Now()
+	leased := e.leader != "" && e.leader != args.Candidate && now.Before(e.leaseUntil)
+	if args.Term < e.term || leased {
+		reply.Term = e.term
+		e.mutex.Unlock()
+		return nil
+	}
+
+	stepped := false
+	if args.Term > e.term {
+		stepped = e.role != Follower
+		e.term = args.Term
+		e.role = Follower
+		e.votedFor = ""
+		e.leader = ""
+	}
+	if e.votedFor == "" || e.votedFor == args.Candidate {
+		e.votedFor = args.Candidate
+		reply.Granted = true
+		// A granted vote waits for the candidate's heartbeat before campaigning
+		e.leaseUntil = now.Add(e.config.Lease)
+	}
+	reply.Term = e.term
+	e.mutex.Unlock()
+
+	if stepped {
+		e.notify()
+	}
+	return nil
+}
+
+// Follows the leader of the newest term and installs its state
+func (s *ElectionService) Heartbeat(args HeartbeatArgs, reply *HeartbeatReply) error {
+	e := s.e
+	e.mutex.Lock()
+
+	if args.Term < e.term {
+		reply.Term = e.term
+		e.mutex.Unlock()
+		return nil
+	}
+
+	changed := e.role != Follower || e.leader != args.Leader
+	e.term = args.Term
+	e.role = Follower
+	e.leader = args.Leader
+	e.leaseUntil = rpcc.Now().Add(e.config.Lease)
+	reply.Term = e.term
+	reply.Ok = true
+	e.mutex.Unlock()
+
+	if changed {
+		e.notify()
+	}
+	if e.install != nil && args.State != nil {
+		e.install(args.State)
+	}
+	return nil
+}
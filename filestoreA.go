@@ -1,26 +1,29 @@
-// Usage: go run filestoreA.go [file-store-A ip:port] [frontend ip:port] r
+// Usage: go run filestoreA.go [config file] [node name]
 //
-// - [file-store-A ip:port] : the ip and TCP port on which this client is listening for file server connections
-// - [client ip:port] : the ip and TCP port on which client is listening for client connections.
-// - r : replication factor
+// - [config file] : the topology of the cluster, see cluster.json. RPCC_* environment variables override its settings.
+// - [node name] : the filestore A node of the config file to run, it listens on its listen address for file server connections
+//   and reports to the filestoreA listeners of the front ends.
 //
 package main 
 
 import (
+	"./config"
+	"./gossip"
 	"./rpcc"
+	"crypto/rand"
 	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
+	"path/filepath"
 	"time"
-	//"strconv"
-	//"io/ioutil"
+	"io/ioutil"
 	"bufio"
 	"encoding/gob"
-	"github.com/arcaneiceman/GoVector/govec"
 	"io"
 	"strings"
+	"sync"
 )
 
 //======================================= SERVICE =======================================
@@ -32,15 +35,20 @@ type ValArgs struct {
 	Text_content string
 	Secret_info  string
 	ErrorCode    int
+	Content_ref  rpcc.PayloadRef // Text_content buffered on the first or target hop
 }
 
 type ValReply struct {
 	Val string // value; depends on the call
+	Log []byte // causal log of the caller, see rpcc.PrepareSend
 }
 
 type ValMetadata struct {
 	FilestoreMapA map[int]NodeInfo
 	FilestoreMapB map[int]NodeInfo
+
+	Shard_A string // logical services of the groups owning the file
+	Shard_B string
 }
 
 // Type 0 is metadata server, 1 is auth server, 2 is file storage A, 3 is file storage B
@@ -50,6 +58,9 @@ type NodeInfoCache struct {
 	Addr    string
 	Service string
 	Maps    []map[string]string
+	Group   int // the group of files this node holds
+
+	Open_breakers []string // addresses this node's hops currently fail fast to
 }
 
 type NodeInfo struct {
@@ -59,13 +70,22 @@ type NodeInfo struct {
 	Service string
 }
 
+// a node asking for its id, the one it had if any (-1 otherwise); the reply carries the id it got
+type NodeRegistration struct {
+	Uuid string // kept by the node across restarts
+	Type int
+	Id   int
+}
+
 type CacheContent struct {
 	Maps []map[string]string
 }
 
-type Msg struct {
-	Content       string
-	RealTimestamp string
+// a file stored on a replica set, kept aside until the store is validated, see FACommit
+type StagedFile struct {
+	File_Name string
+	Content   string
+	Staged    time.Time
 }
 
 //======================================= VARIABLES =======================================
@@ -74,6 +94,8 @@ const NodeService string = "FilestoreServiceA"
 const StoreEntryFunction string = "FAStore"
 const RetrieveEntryFunction string = "FARetrieve"
 const ListEntryFunction string = "FAList"
+const ReplicateFunction string = "FAReplicate"
+const CommitFunction string = "FACommit"
 
 const (
 	INCOMPLETE_CHAIN     = iota
@@ -88,57 +110,121 @@ const AuthService string = "AuthService"
 const FileBasePath = "./StorageFilesA/"
 
 var FileContentMapA map[string]string
-var CredentialMap map[string]string
 
-var Logger *govec.GoLog
+// the files of the stores still being replicated, by the id of the chain that staged them
+var StagedFilesA map[string]StagedFile
+
+// how long a staged file waits for its store to be validated
+const StagedTTL = 60 * time.Second
+
+// Guards FileContentMapA and StagedFilesA, the handlers, reports and printMaps run concurrently
+var fileContentMutex sync.Mutex
+
+var NodeAddress string
+
+// The group of files this node holds, set by its group in the config when filestores are split in groups
+var Group int
+
+// This node's membership in the gossip of the backend nodes
+var Members *gossip.Memberlist
+
+// the id the front end gave this node for the uuid it keeps on disk, -1 until registered
+var NodeId int = -1
+var NodeUuid string
+
+// the topology and settings of the cluster, from the config file
+var Config *config.Config
+
+// how long a hop of a chain waits for the next, in ms, and how often this node reports
+var HopTimeout int = 10000
+var ReportInterval = 1000 * time.Millisecond
+
+// reply to the reports of a node the front end gave no id, it registers again
+const UnregisteredNode string = "Unregistered node"
+
+// reply to the reports of a drained node, it leaves
+const DecommissionedNode string = "Decommissioned node"
 
 //======================================= SERVICE METHODS =======================================
 func (fsa *FilestoreServiceA) FAStore(chain rpcc.RPCChain, reply *bool) error {
 	fmt.Println("STORE RPCC:")
 
-	cmd := "STORE"
-	HandleLog(cmd, chain)
+	args := chain.FirstEntity().Args.(ValArgs)
 
-	dbEntity := chain.FindEntity(MetadataService)
-	auEntity := chain.FindEntity(AuthService)
+	// Dereference the content buffered by the client before acknowledging,
+	// the acknowledgement goes back without it
+	content := args.Text_content
+	if args.Content_ref.IsSet() {
+		data, err := rpcc.Fetch(args.Content_ref)
+		if err != nil {
+			fmt.Println("Unable to fetch stored content:", err)
+			*reply = false
+			return nil
+		}
+		rpcc.Release(args.Content_ref)
+		content = string(data)
+		args.Content_ref = rpcc.PayloadRef{}
+	}
+	args.Text_content = ""
+	chain.FirstEntity().Args = args
+
+	// with replicas in the group, the file is staged on all of them and FACommit commits it
+	if replicas := replicaSet(); len(replicas) > 0 {
+		replicateStore(&chain, args.File_Name, content, replicas)
+	} else {
+		commitStore(&chain, content)
+	}
 
-	if dbEntity != nil && auEntity != nil {
-		dbConn, dbErr := rpcc.Dial(*dbEntity)
-		auConn, auErr := rpcc.Dial(*auEntity)
+	fmt.Println(chain)
 
-		if dbErr == nil && auErr == nil {
-			args := chain.FirstEntity().Args.(ValArgs)
-			args.ErrorCode = SUCCESSFUL_COMPLETED
-			chain.FirstEntity().Args = args
+	*reply = true
+	return nil
+}
 
-			logBuf := GenerateReturnLog(cmd, chain, 1)
-			chain.AddLogToChain(logBuf)
-			chain.ChangeDirection()
+// a hop of the sub-chain replicating a store: the replica stages the file for the primary's
+// FACommit. A replica that fails hands the sub-chain back early, the ones after it are left out
+func (fsa *FilestoreServiceA) FAReplicate(chain rpcc.RPCChain, reply *bool) error {
+	args := chain.CurrentEntity().Args.(ValArgs)
+	data, err := rpcc.Fetch(args.Content_ref)
+	if err != nil {
+		fmt.Println("Unable to fetch", args.File_Name, "to replicate:", err)
+		chain.Fail("replica "+NodeAddress+" unable to fetch "+args.File_Name+": "+err.Error(), HopTimeout)
+		*reply = false
+		return nil
+	}
+	stageFile(chain.Id, args.File_Name, string(data))
 
-			err := chain.CallIndex(1, 10000)
+	// FACommit only commits a store once, failing after a timeout can't commit it twice
+	if err := chain.CallNext(HopTimeout); err != nil {
+		fmt.Println("Replicating", args.File_Name, "past", NodeAddress, "failed:", err)
+		chain.Fail("replica after "+NodeAddress+" failed: "+err.Error(), HopTimeout)
+	}
 
-			if err == nil {
-				arg := ValReply{
-					Val: args.File_Name,
-				}
-
-				var kvVal ValReply
-				var kvVal2 ValReply
-				serviceMethod := dbEntity.Service_info + "." + "StoreValidation"
-				err := dbConn.Call(serviceMethod, arg, &kvVal)
-				fmt.Println(kvVal.Val)
-				checkError(err)
-				dbConn.Close()
-
-				serviceMethod = auEntity.Service_info + "." + "StoreValidation"
-				err = auConn.Call(serviceMethod, arg, &kvVal2)
-				checkError(err)
-				fmt.Println(kvVal.Val)
-				auConn.Close()
-
-				FileContentMapA[args.File_Name] = args.Text_content
-			}
-		}
+	*reply = true
+	return nil
+}
+
+// the last hop of a replicated store, back on the primary: validates the store, commits the
+// file staged here and has the replicas commit theirs. The first to get here commits, a chain
+// that gets here again finds nothing staged.
+func (fsa *FilestoreServiceA) FACommit(chain rpcc.RPCChain, reply *bool) error {
+	args := chain.CurrentEntity().Args.(ValArgs)
+	rpcc.Release(args.Content_ref)
+	chain.CurrentEntity().Args = ValArgs{File_Name: args.File_Name}
+
+	staged, ok := unstageFile(chain.Id)
+	if !ok {
+		fmt.Println("Store of", args.File_Name, "in chain", chain.Id, "already committed or expired")
+		*reply = true
+		return nil
+	}
+
+	sub := chain.LastSubChain()
+	if sub != nil && sub.Err != "" {
+		fmt.Println("Replicas of", args.File_Name, "not all staged:", sub.Err)
+	}
+	if commitStore(&chain, staged.Content) && sub != nil {
+		commitReplicas(sub, args.File_Name)
 	}
 
 	fmt.Println(chain)
@@ -150,27 +236,32 @@ func (fsa *FilestoreServiceA) FARetrieve(chain rpcc.RPCChain, reply *bool) error
 
 	fmt.Println("RETRIEVE RPCC:")
 
-	cmd := "RETRIEVE"
-	HandleLog(cmd, chain)
-
 	args := chain.FirstEntity().Args.(ValArgs)
 
 	// Populate the return value with the content
-	if _, ok := FileContentMapA[args.File_Name]; ok {
-		args.Text_content = FileContentMapA[args.File_Name]
+	fileContentMutex.Lock()
+	content, ok := FileContentMapA[args.File_Name]
+	fileContentMutex.Unlock()
+	if ok {
+		args.Text_content = content
+		rpcc.LogLocalEvent(fmt.Sprintf("serve RETRIEVE file=%s [chain %s]", args.File_Name, chain.Id))
 	} else {
 		args.Text_content = ""
 	}
 
+	// Leave the content here for the client to fetch instead of carrying it back
+	if args.Text_content != "" {
+		args.Content_ref = rpcc.Buffer(NodeAddress, []byte(args.Text_content))
+		args.Text_content = ""
+	}
+
 	args.ErrorCode = SUCCESSFUL_COMPLETED
 
-	logBuf := GenerateReturnLog(cmd, chain, 1)
-	chain.AddLogToChain(logBuf)
 	chain.ChangeDirection()
 
 	// Update the args and call frontend
 	chain.FirstEntity().Args = args
-	chain.CallIndex(1, 10000)
+	chain.CallIndex(1, HopTimeout)
 
 	fmt.Println(chain)
 	*reply = true
@@ -179,9 +270,6 @@ func (fsa *FilestoreServiceA) FARetrieve(chain rpcc.RPCChain, reply *bool) error
 
 func (fsa *FilestoreServiceA) FAList(chain rpcc.RPCChain, reply *bool) error {
 
-	cmd := "LIST"
-	HandleLog(cmd, chain)
-
 	fmt.Println("LIST RPCC:")
 	//updatedPos.Args.File_Name = "A name1 name2 name3"
 	lfg := listFilesGet() // array of strings format
@@ -196,28 +284,74 @@ func (fsa *FilestoreServiceA) FAList(chain rpcc.RPCChain, reply *bool) error {
 	}
 	chain.FirstEntity().Args = args
 
-	logBuf := GenerateReturnLog(cmd, chain, 1)
-	chain.AddLogToChain(logBuf)
 	chain.ChangeDirection()
 
-	chain.CallNext(10000)
+	chain.CallNext(HopTimeout)
 	fmt.Println(chain)
 
 	*reply = true
 	return nil
 }
 
+// Files the frontend moved here from a group that no longer owns them
+func (fsa *FilestoreServiceA) ImportFiles(arg *CacheContent, reply *ValReply) error {
+	fileContentMutex.Lock()
+	for name, content := range arg.Maps[0] {
+		FileContentMapA[name] = content
+	}
+	fileContentMutex.Unlock()
+	reply.Val = "Files imported"
+	return nil
+}
+
+// Files the frontend moved to the group owning them
+func (fsa *FilestoreServiceA) DropFiles(arg *CacheContent, reply *ValReply) error {
+	fileContentMutex.Lock()
+	for name := range arg.Maps[0] {
+		delete(FileContentMapA, name)
+	}
+	fileContentMutex.Unlock()
+	reply.Val = "Files dropped"
+	return nil
+}
+
 func (fsa *FilestoreServiceA) UpdateConsistency(arg *CacheContent, reply *ValReply) error {
 	reply.Val = "Replica updated"
 	if len(arg.Maps) == 1 {
+		fileContentMutex.Lock()
 		FileContentMapA = arg.Maps[0]
+		fileContentMutex.Unlock()
 	}
 	return nil
 }
 
-func (fsa *FilestoreServiceA) AuthRecovery(arg *CacheContent, reply *ValReply) error {
-	reply.Val = "Auth data stored"
-	CredentialMap = arg.Maps[0]
+// take over the files of a drained node, its entries win
+func (fsa *FilestoreServiceA) MergeConsistency(arg *CacheContent, reply *ValReply) error {
+	reply.Val = "Replica merged"
+	if len(arg.Maps) == 1 {
+		fileContentMutex.Lock()
+		for k, v := range arg.Maps[0] {
+			FileContentMapA[k] = v
+		}
+		fileContentMutex.Unlock()
+	}
+	return nil
+}
+
+// commit a file staged by FAReplicate, once the primary validated its store
+func (fsa *FilestoreServiceA) StoreValidation(key *ValReply, reply *ValReply) error {
+	staged, ok := unstageFile(key.Val)
+	if !ok {
+		reply.Val = "Not in staged files FILESTORE A"
+		return nil
+	}
+
+	rpcc.UnpackReceive("validated file="+staged.File_Name+" on filestoreA replica", key.Log)
+	fileContentMutex.Lock()
+	FileContentMapA[staged.File_Name] = staged.Content
+	fileContentMutex.Unlock()
+	rpcc.LogLocalEvent(fmt.Sprintf("commit replica file=%s [chain %s]", staged.File_Name, key.Val))
+	reply.Val = "Moved to storage map FILESTORE A"
 	return nil
 }
 
@@ -225,30 +359,65 @@ func (fsa *FilestoreServiceA) AuthRecovery(arg *CacheContent, reply *ValReply) e
 
 func main() {
 
-	Logger = govec.Initialize("fsA", "fsA")
-
 	// parse args
-	usage := fmt.Sprintf("Usage: %s ip:port\n", os.Args[0])
-	if len(os.Args) != 5 {
+	usage := fmt.Sprintf("Usage: %s [config file] [node name]\n", os.Args[0])
+	if len(os.Args) != 3 {
 		fmt.Printf(usage)
 		os.Exit(1)
 	}
 
+	var err error
+	Config, err = config.Load(os.Args[1])
+	checkError(err)
+	node, err := Config.Node(os.Args[2], config.FilestoreA)
+	checkError(err)
+
+	checkError(rpcc.InitTracer("fsA", Config.Tracer))
+	checkError(rpcc.EnableRecording("fsA", Config.Storage.Records))
+	checkError(rpcc.InitBreakers(Config.Breaker))
+	checkError(rpcc.InitTimeouts(Config.AdaptiveTimeouts))
+	HopTimeout = int(Config.Timeouts.Hop.Duration / time.Millisecond)
+	ReportInterval = Config.Timeouts.Report.Duration
+
 	gob.Register(ValArgs{})
 	gob.Register(ValMetadata{})
 	gob.Register(NodeInfo{})
 
-	filestoreAddr := os.Args[1]
-	frontendAddr := os.Args[2]
-	authAddr := os.Args[3]
-	replicationFactor := os.Args[4]
-	fmt.Println("filestoreAddrB:", filestoreAddr, " frontendAddr:", frontendAddr, "authAddr:", authAddr, " replicationFactor:", replicationFactor)
+	filestoreAddr := node.Listen
+	NodeAddress = filestoreAddr
+	frontendAddr := Config.ReportAddrs(config.FilestoreA)
+	Group = node.Group
+	fmt.Println("filestoreAddrA:", filestoreAddr, " frontendAddr:", frontendAddr, " group:", Group)
 
 	FileContentMapA = make(map[string]string)
-	CredentialMap = make(map[string]string)
+	StagedFilesA = make(map[string]StagedFile)
+
+	rpcc.RegisterResolver(rpcc.NewRemoteResolver(frontendAddr, "FrontEndMapService.Resolve"))
+
+	// a replica that went down mid store fails its hop, it doesn't take this node down with it
+	rpcc.RegisterErrorHandler(func(chain *rpcc.RPCChain, error string) {
+		fmt.Println("Chain", chain.Id, "failed:", error)
+	})
+
+	// register with the front end for this node's id first, the gossip carries it;
+	// the front ends may not be up or have elected a leader yet
+	NodeUuid = nodeUuid(filestoreAddr)
+	for {
+		serviceFE, err := dialFrontEnd(frontendAddr)
+		if err == nil {
+			err = registerToFrontEnd(serviceFE)
+			serviceFE.Close()
+			if err == nil {
+				break
+			}
+		}
+		rpcc.Sleep(ReportInterval)
+	}
 
+	joinGossip(filestoreAddr)
 	go initListener(filestoreAddr)
 	go printMaps()
+	go stagedGarbageCollector()
 
 	//this is how you get the list of all files file storage has in its folder FileStorage
 	// lfg := listFilesGet()
@@ -265,9 +434,10 @@ func main() {
 
 	//counter:=0
 
-	serviceFE, err := rpc.Dial("tcp", frontendAddr)
+	serviceFE, err := dialFrontEnd(frontendAddr)
 	checkError(err)
 	UpdateToFrontEnd(NodeType, NodeService, filestoreAddr, serviceFE)
+	serviceFE.Close()
 	//counter:=0
 	for {
 		//counter++
@@ -275,54 +445,29 @@ func main() {
 		//UpdateToFrontEnd(myID, NodeType, NodeService, metadataAddr, serviceFE)
 		//time.Sleep(1000*time.Millisecond)
 
-		serviceFE, err = rpc.Dial("tcp", frontendAddr)
+		serviceFE, err = dialFrontEnd(frontendAddr)
 		if err == nil {
-			UpdateToFrontEnd(NodeType, NodeService, filestoreAddr, serviceFE)
-		}
-
-		if len(CredentialMap) != 0 {
-			backupAuth(authAddr)
+			switch UpdateToFrontEnd(NodeType, NodeService, filestoreAddr, serviceFE) {
+			case UnregisteredNode:
+				registerToFrontEnd(serviceFE)
+			case DecommissionedNode:
+				fmt.Println("Drained and deregistered by the front end, leaving")
+				Members.Leave()
+				os.Exit(0)
+			}
+			serviceFE.Close()
 		}
 
-		time.Sleep(1000 * time.Millisecond)
+		rpcc.Sleep(ReportInterval)
 	}
 
 }
 
 //======================================= HELPER FUNCTIONS =======================================
-func GenerateLog(callType string, chain rpcc.RPCChain) []byte {
-	nextChain := chain.CurrentPosition + 1
-	logMessage := Msg{"Client " + callType + "log.", time.Now().String()}
-	fmt.Println(chain.EntityList[nextChain].Service_info)
-	logBuf := Logger.PrepareSend(callType+" request to "+chain.EntityList[nextChain].Service_info, logMessage)
-	return logBuf
-
-}
-
-func GenerateReturnLog(callType string, chain rpcc.RPCChain, returnChain int) []byte {
-	logMessage := Msg{"FSB Return" + callType + "log.", time.Now().String()}
-	fmt.Println(chain.EntityList[returnChain].Service_info)
-	logBuf := Logger.PrepareSend(callType+" return to "+chain.EntityList[returnChain].Service_info, logMessage)
-	return logBuf
-
-}
-
-func HandleLog(cmd string, chain rpcc.RPCChain) {
-	logMessage := new(Msg)
-	prevChain := chain.CurrentPosition - 1
-	Logger.UnpackReceive(cmd+" request received from "+chain.EntityList[prevChain].Service_info, chain.Log, &logMessage)
-	fmt.Println(logMessage.String())
-
-}
-
-func (m Msg) String() string {
-	return "content: " + m.Content + "\ntime: " + m.RealTimestamp
-}
-
 // If error is non-nil, print it out and halt.
 func checkError(err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error ", err.Error())
+		fmt.Fprintf(os.Stderr, "Error %s\n", err.Error())
 		os.Exit(1)
 	}
 }
@@ -331,39 +476,187 @@ func checkError(err error) {
 func initListener(address string) {
 	service := new(FilestoreServiceA)
 	rpc.Register(service)
+	rpcc.RegisterServices()
 	ln, e := net.Listen("tcp", address)
 	if e != nil {
 		log.Fatal("listen error:", e)
 	} else {
-		go rpc.Accept(ln)
+		go rpcc.Accept(ln)
 	}
 }
 
+// Joins the gossip of the backend nodes through the seeds of the config, alone if there are none
+func joinGossip(address string) {
+	var err error
+	Members, err = gossip.Start(gossip.Config{
+		Addr:    address,
+		Id:      NodeId,
+		Role:    NodeType,
+		Group:   Group,
+		Service: NodeService,
+		Seeds:   Config.Seeds,
+	})
+	checkError(err)
+}
+
 func printMaps() {
 	for {
 		fmt.Println()
-		fmt.Println("CredentialMap:", CredentialMap)
+		fmt.Println("Gossip members:", Members.Members(), "replica set:", Members.Peers(NodeType))
 		fmt.Println("Printing stored files...")
 		fileCount := 1
-		for k, v := range FileContentMapA {
+		for k, v := range storedFiles() {
 			fmt.Println(fileCount, "FILENAME:", k)
 			fmt.Println("  CONTENT:", v)
 			fileCount++
 		}
-		time.Sleep(3000 * time.Millisecond)
+		rpcc.Sleep(3000 * time.Millisecond)
+	}
+}
+
+// acknowledge a store to the front end, then validate it with metadata and auth and commit it.
+// False if it wasn't committed
+func commitStore(chain *rpcc.RPCChain, content string) bool {
+	dbEntity := chain.FindEntity(MetadataService)
+	auEntity := chain.FindEntity(AuthService)
+	if dbEntity == nil || auEntity == nil {
+		return false
+	}
+
+	dbConn, dbErr := rpcc.Dial(*dbEntity)
+	auConn, auErr := rpcc.Dial(*auEntity)
+	if dbErr != nil || auErr != nil {
+		return false
+	}
+	defer dbConn.Close()
+	defer auConn.Close()
+
+	args := chain.FirstEntity().Args.(ValArgs)
+	args.ErrorCode = SUCCESSFUL_COMPLETED
+	chain.FirstEntity().Args = args
+
+	chain.ChangeDirection()
+
+	err := chain.CallIndex(1, HopTimeout)
+	if err != nil {
+		return false
+	}
+
+	arg := ValReply{
+		Val: args.File_Name,
+		Log: rpcc.PrepareSend(fmt.Sprintf("validate file=%s [chain %s]", args.File_Name, chain.Id)),
+	}
+
+	var kvVal ValReply
+	var kvVal2 ValReply
+	serviceMethod := dbEntity.Service_info + "." + "StoreValidation"
+	err = dbConn.Call(serviceMethod, arg, &kvVal)
+	fmt.Println(kvVal.Val)
+	checkError(err)
+
+	serviceMethod = auEntity.Service_info + "." + "StoreValidation"
+	err = auConn.Call(serviceMethod, arg, &kvVal2)
+	checkError(err)
+	fmt.Println(kvVal.Val)
+
+	fileContentMutex.Lock()
+	FileContentMapA[args.File_Name] = content
+	fileContentMutex.Unlock()
+	rpcc.LogLocalEvent(fmt.Sprintf("commit file=%s [chain %s]", args.File_Name, chain.Id))
+	return true
+}
+
+// the live replicas of this node's group, by gossip
+func replicaSet() []gossip.Member {
+	replicas := make([]gossip.Member, 0)
+	for _, peer := range Members.Peers(NodeType) {
+		if peer.Addr != NodeAddress && peer.Group == Group && peer.State == gossip.Alive {
+			replicas = append(replicas, peer)
+		}
+	}
+	return replicas
+}
+
+// stage the file here and run the store on through a sub-chain of FAReplicate hops, one per
+// replica, back to this node's FACommit. The content is buffered here for the replicas to fetch.
+// Only FACommit commits: if the chain fails on the way, the staged files expire uncommitted
+func replicateStore(chain *rpcc.RPCChain, fileName string, content string, replicas []gossip.Member) {
+	stageFile(chain.Id, fileName, content)
+	ref := rpcc.Buffer(NodeAddress, []byte(content))
+
+	sub := rpcc.CreateChain()
+	for _, replica := range replicas {
+		sub.AddToChain(replica.Addr, replica.Service, ReplicateFunction, ValArgs{File_Name: fileName, Content_ref: ref}, -1)
+	}
+	chain.AddSubChainToChain(sub, -1)
+	chain.AddToChain(NodeAddress, NodeService, CommitFunction, ValArgs{File_Name: fileName, Content_ref: ref}, -1)
+
+	if err := chain.CallNext(HopTimeout); err != nil {
+		fmt.Println("Store of", fileName, "failed through its replicas:", err)
+	}
+}
+
+// have the replicas that staged the file of the sub-chain commit it
+func commitReplicas(sub *rpcc.RPCChain, fileName string) {
+	for _, replica := range sub.EntityList {
+		arg := ValReply{
+			Val: sub.Id,
+			Log: rpcc.PrepareSend(fmt.Sprintf("validate replica file=%s [chain %s]", fileName, sub.Id)),
+		}
+		var kvVal ValReply
+		timeout := time.Duration(HopTimeout) * time.Millisecond
+		err := rpcc.CallTimeout(replica.Connection_info, replica.Service_info+".StoreValidation", arg, &kvVal, timeout)
+		if err != nil {
+			fmt.Println("Unable to commit", fileName, "on replica", replica.Connection_info+":", err)
+			continue
+		}
+		fmt.Println(kvVal.Val)
+	}
+}
+
+func stageFile(chainId string, fileName string, content string) {
+	fileContentMutex.Lock()
+	defer fileContentMutex.Unlock()
+	StagedFilesA[chainId] = StagedFile{File_Name: fileName, Content: content, Staged: rpcc.Now()}
+}
+
+// take the file staged by a chain, false if there's none
+func unstageFile(chainId string) (StagedFile, bool) {
+	fileContentMutex.Lock()
+	defer fileContentMutex.Unlock()
+	staged, ok := StagedFilesA[chainId]
+	delete(StagedFilesA, chainId)
+	return staged, ok
+}
+
+// drop the staged files whose store never got validated
+func stagedGarbageCollector() {
+	for {
+		rpcc.Sleep(StagedTTL)
+		fileContentMutex.Lock()
+		for chainId, staged := range StagedFilesA {
+			if rpcc.Now().Sub(staged.Staged) > StagedTTL {
+				delete(StagedFilesA, chainId)
+			}
+		}
+		fileContentMutex.Unlock()
 	}
 }
 
 // send this node's information to front end
-func UpdateToFrontEnd(typeArg int, service string, address string, dialservice *rpc.Client) {
+func UpdateToFrontEnd(typeArg int, service string, address string, dialservice *rpc.Client) string {
 	list := make([]map[string]string, 1)
-	list[0] = FileContentMapA
+	list[0] = storedFiles()
 
 	node := NodeInfoCache{
+		Id:      NodeId,
 		Type:    typeArg,
 		Addr:    address,
 		Service: service,
 		Maps:    list,
+		Group:   Group,
+
+		Open_breakers: rpcc.OpenBreakers(),
 	}
 
 	var kvVal ValReply
@@ -373,22 +666,19 @@ func UpdateToFrontEnd(typeArg int, service string, address string, dialservice *
 	//fmt.Println("ReportServerActivity err:",err)
 	//fmt.Println("Updated activity status:", node, kvVal.Val)
 
+	return kvVal.Val
 }
 
-func backupAuth(authAddr string) error {
-	maps := make([]map[string]string, 1)
-	maps[0] = CredentialMap
-	cache := CacheContent{Maps: maps}
+// A copy of the stored files, to read without holding the lock
+func storedFiles() map[string]string {
+	fileContentMutex.Lock()
+	defer fileContentMutex.Unlock()
 
-	dialservice, err := dialAddr(authAddr)
-	if err == nil {
-		var kvVal ValReply
-		serviceMethod := "AuthService" + "." + "AuthRecovery"
-		dialservice.Call(serviceMethod, cache, &kvVal)
-		//checkError(err)
+	files := make(map[string]string, len(FileContentMapA))
+	for k, v := range FileContentMapA {
+		files[k] = v
 	}
-
-	return nil
+	return files
 }
 
 //Test Dial
@@ -408,10 +698,55 @@ func dialAddr(addr string) (*rpc.Client, error) {
 	return service, err
 }
 
+//Dial the first front end of the comma separated list that answers, any of them takes the reports
+func dialFrontEnd(frontendAddrs string) (*rpc.Client, error) {
+	var err error
+	for _, addr := range strings.Split(frontendAddrs, ",") {
+		var service *rpc.Client
+		if service, err = dialAddr(strings.TrimSpace(addr)); err == nil {
+			return service, nil
+		}
+	}
+	return nil, err
+}
+
+//Register with the front end under this node's uuid, keeping the id it had if any
+func registerToFrontEnd(dialservice *rpc.Client) error {
+	args := NodeRegistration{Uuid: NodeUuid, Type: NodeType, Id: NodeId}
+	var reply NodeRegistration
+	if err := dialservice.Call("FrontEndServiceFilestoreA.Register", args, &reply); err != nil {
+		fmt.Println("Register err:", err)
+		return err
+	}
+
+	NodeId = reply.Id
+	fmt.Println("Registered", NodeUuid, "as node", NodeId)
+	return nil
+}
+
+//The uuid this node keeps across restarts in [service]-[address].uuid of the storage dir, made on its first start
+func nodeUuid(address string) string {
+	path := filepath.Join(Config.Storage.Dir, NodeService+"-"+strings.Replace(address, ":", "-", -1)+".uuid")
+	if content, err := ioutil.ReadFile(path); err == nil && len(strings.TrimSpace(string(content))) > 0 {
+		return strings.TrimSpace(string(content))
+	}
+
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	checkError(err)
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+
+	checkError(ioutil.WriteFile(path, []byte(uuid+"\n"), 0644))
+	return uuid
+}
+
 //func returns a list of all the files in that directory StorageFiles which has all the storage files
 //*assumption that the file is being run from the parent directory
 func listFilesGet() string {
-	fileList := make([]string, len(FileContentMapA))
+	files := storedFiles()
+	fileList := make([]string, len(files))
 	// files, _ := ioutil.ReadDir(FileBasePath)//"./StorageFiles")
 	// for _, f := range files {
 	// 	fileList = append(fileList, f.Name())
@@ -421,7 +756,7 @@ func listFilesGet() string {
 	// }
 	//return fileList
 	i := 0
-	for k, _ := range FileContentMapA {
+	for k, _ := range files {
 		fileList[i] = k
 		i++
 	}
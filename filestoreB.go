@@ -1,22 +1,27 @@
-// Usage: go run filestoreB.go [file-store-B ip:port] [frontend ip:port] r
-// - [file-store-B ip:port] : the ip and TCP port on which this client is listening for file server connections
-// - [client ip:port] : the ip and TCP port on which client is listening for client connections.
+// Usage: go run filestoreB.go [config file] [node name]
+//
+// - [config file] : the topology of the cluster, see cluster.json. RPCC_* environment variables override its settings.
+// - [node name] : the filestore B node of the config file to run, it listens on its listen address for file server connections
+//   and reports to the filestoreB listeners of the front ends.
 //
 package main 
 
 import (
+	"./config"
+	"./gossip"
 	"./rpcc"
+	"crypto/rand"
 	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
+	"path/filepath"
 	"time"
-	//"strconv"
-	//"io/ioutil"
+	"io/ioutil"
 	"encoding/gob"
-	"github.com/arcaneiceman/GoVector/govec"
 	"strings"
+	"sync"
 )
 
 //======================================= SERVICE =======================================
@@ -28,15 +33,20 @@ type ValArgs struct {
 	Text_content string
 	Secret_info  string
 	ErrorCode    int
+	Content_ref  rpcc.PayloadRef // Text_content buffered on the first or target hop
 }
 
 type ValMetadata struct {
 	FilestoreMapA map[int]NodeInfo
 	FilestoreMapB map[int]NodeInfo
+
+	Shard_A string // logical services of the groups owning the file
+	Shard_B string
 }
 
 type ValReply struct {
 	Val string // value; depends on the call
+	Log []byte // causal log of the caller, see rpcc.PrepareSend
 }
 
 // Type 0 is metadata server, 1 is auth server, 2 is file storage A, 3 is file storage B
@@ -46,6 +56,9 @@ type NodeInfoCache struct {
 	Addr    string
 	Service string
 	Maps    []map[string]string
+	Group   int // the group of files this node holds
+
+	Open_breakers []string // addresses this node's hops currently fail fast to
 }
 
 type NodeInfo struct {
@@ -55,13 +68,15 @@ type NodeInfo struct {
 	Service string
 }
 
-type CacheContent struct {
-	Maps []map[string]string
+// a node asking for its id, the one it had if any (-1 otherwise); the reply carries the id it got
+type NodeRegistration struct {
+	Uuid string // kept by the node across restarts
+	Type int
+	Id   int
 }
 
-type Msg struct {
-	Content       string
-	RealTimestamp string
+type CacheContent struct {
+	Maps []map[string]string
 }
 
 //======================================= VARIABLES =======================================
@@ -82,15 +97,38 @@ const FileBasePath = "./StorageFilesB/"
 
 var FileContentMapB map[string]string
 
-var Logger *govec.GoLog
+// Guards FileContentMapB, the handlers, reports and printMaps run concurrently
+var fileContentMutex sync.Mutex
+
+var NodeAddress string
+
+// The group of files this node holds, set by its group in the config when filestores are split in groups
+var Group int
+
+// This node's membership in the gossip of the backend nodes
+var Members *gossip.Memberlist
+
+// the id the front end gave this node for the uuid it keeps on disk, -1 until registered
+var NodeId int = -1
+var NodeUuid string
+
+// the topology and settings of the cluster, from the config file
+var Config *config.Config
+
+// how long a hop of a chain waits for the next, in ms, and how often this node reports
+var HopTimeout int = 10000
+var ReportInterval = 1000 * time.Millisecond
+
+// reply to the reports of a node the front end gave no id, it registers again
+const UnregisteredNode string = "Unregistered node"
+
+// reply to the reports of a drained node, it leaves
+const DecommissionedNode string = "Decommissioned node"
 
 //======================================= SERVICE METHODS =======================================
 func (fsb *FilestoreServiceB) FBStore(chain rpcc.RPCChain, reply *bool) error {
 	fmt.Println("STORE RPCC:")
 
-	cmd := "STORE"
-	HandleLog(cmd, chain)
-
 	dbEntity := chain.FindEntity(MetadataService)
 
 	if dbEntity != nil {
@@ -98,18 +136,35 @@ func (fsb *FilestoreServiceB) FBStore(chain rpcc.RPCChain, reply *bool) error {
 
 		if err == nil {
 			args := chain.FirstEntity().Args.(ValArgs)
+
+			// Dereference the content buffered by the client before acknowledging,
+			// the acknowledgement goes back without it
+			content := args.Text_content
+			if args.Content_ref.IsSet() {
+				data, err := rpcc.Fetch(args.Content_ref)
+				if err != nil {
+					fmt.Println("Unable to fetch stored content:", err)
+					dbConn.Close()
+					*reply = false
+					return nil
+				}
+				rpcc.Release(args.Content_ref)
+				content = string(data)
+				args.Content_ref = rpcc.PayloadRef{}
+			}
+			args.Text_content = ""
+
 			args.ErrorCode = SUCCESSFUL_COMPLETED
 			chain.FirstEntity().Args = args
 
-			logBuf := GenerateReturnLog(cmd, chain, 1)
-			chain.AddLogToChain(logBuf)
 			chain.ChangeDirection()
 
-			err := chain.CallIndex(1, 10000)
+			err := chain.CallIndex(1, HopTimeout)
 
 			if err == nil {
 				arg := ValReply{
 					Val: args.File_Name,
+					Log: rpcc.PrepareSend(fmt.Sprintf("validate file=%s [chain %s]", args.File_Name, chain.Id)),
 				}
 
 				var kvVal ValReply
@@ -119,7 +174,10 @@ func (fsb *FilestoreServiceB) FBStore(chain rpcc.RPCChain, reply *bool) error {
 				checkError(err)
 				dbConn.Close()
 
-				FileContentMapB[args.File_Name] = args.Text_content
+				fileContentMutex.Lock()
+				FileContentMapB[args.File_Name] = content
+				fileContentMutex.Unlock()
+				rpcc.LogLocalEvent(fmt.Sprintf("commit file=%s [chain %s]", args.File_Name, chain.Id))
 			}
 		}
 	}
@@ -131,26 +189,31 @@ func (fsb *FilestoreServiceB) FBStore(chain rpcc.RPCChain, reply *bool) error {
 func (fsb *FilestoreServiceB) FBRetrieve(chain rpcc.RPCChain, reply *bool) error {
 	fmt.Println("RETRIEVE RPCC:")
 
-	cmd := "RETRIEVE"
-	HandleLog(cmd, chain)
-
 	args := chain.FirstEntity().Args.(ValArgs)
 
 	// Populate the return value with the content
-	if _, ok := FileContentMapB[args.File_Name]; ok {
-		args.Text_content = FileContentMapB[args.File_Name]
+	fileContentMutex.Lock()
+	content, ok := FileContentMapB[args.File_Name]
+	fileContentMutex.Unlock()
+	if ok {
+		args.Text_content = content
+		rpcc.LogLocalEvent(fmt.Sprintf("serve RETRIEVE file=%s [chain %s]", args.File_Name, chain.Id))
 	} else {
 		args.Text_content = ""
 	}
 
+	// Leave the content here for the client to fetch instead of carrying it back
+	if args.Text_content != "" {
+		args.Content_ref = rpcc.Buffer(NodeAddress, []byte(args.Text_content))
+		args.Text_content = ""
+	}
+
 	args.ErrorCode = SUCCESSFUL_COMPLETED
 
 	// Update the args and call frontend
 	chain.FirstEntity().Args = args
-	logBuf := GenerateReturnLog(cmd, chain, 1)
-	chain.AddLogToChain(logBuf)
 	chain.ChangeDirection()
-	chain.CallIndex(1, 10000)
+	chain.CallIndex(1, HopTimeout)
 
 	fmt.Println(chain)
 	*reply = true
@@ -161,9 +224,6 @@ func (fsb *FilestoreServiceB) FBList(chain rpcc.RPCChain, reply *bool) error {
 
 	fmt.Println("LIST RPCC:")
 
-	cmd := "LIST"
-	HandleLog(cmd, chain)
-
 	lfg := listFilesGet() //new
 
 	args := chain.FirstEntity().Args.(ValArgs)
@@ -179,11 +239,9 @@ func (fsb *FilestoreServiceB) FBList(chain rpcc.RPCChain, reply *bool) error {
 	//logBuf := GenerateLog(cmd, chain)
 	//chain.AddLogToChain(logBuf)
 
-	logBuf := GenerateReturnLog(cmd, chain, 1)
-	chain.AddLogToChain(logBuf)
 	chain.ChangeDirection()
 
-	chain.CallIndex(1, 10000)
+	chain.CallIndex(1, HopTimeout)
 
 	fmt.Println(chain)
 
@@ -191,10 +249,47 @@ func (fsb *FilestoreServiceB) FBList(chain rpcc.RPCChain, reply *bool) error {
 	return nil
 }
 
+// Files the frontend moved here from a group that no longer owns them
+func (fsb *FilestoreServiceB) ImportFiles(arg *CacheContent, reply *ValReply) error {
+	fileContentMutex.Lock()
+	for name, content := range arg.Maps[0] {
+		FileContentMapB[name] = content
+	}
+	fileContentMutex.Unlock()
+	reply.Val = "Files imported"
+	return nil
+}
+
+// Files the frontend moved to the group owning them
+func (fsb *FilestoreServiceB) DropFiles(arg *CacheContent, reply *ValReply) error {
+	fileContentMutex.Lock()
+	for name := range arg.Maps[0] {
+		delete(FileContentMapB, name)
+	}
+	fileContentMutex.Unlock()
+	reply.Val = "Files dropped"
+	return nil
+}
+
 func (fsa *FilestoreServiceB) UpdateConsistency(arg *CacheContent, reply *ValReply) error {
 	reply.Val = "Replica updated"
 	if len(arg.Maps) == 1 {
+		fileContentMutex.Lock()
 		FileContentMapB = arg.Maps[0]
+		fileContentMutex.Unlock()
+	}
+	return nil
+}
+
+// take over the files of a drained node, its entries win
+func (fsa *FilestoreServiceB) MergeConsistency(arg *CacheContent, reply *ValReply) error {
+	reply.Val = "Replica merged"
+	if len(arg.Maps) == 1 {
+		fileContentMutex.Lock()
+		for k, v := range arg.Maps[0] {
+			FileContentMapB[k] = v
+		}
+		fileContentMutex.Unlock()
 	}
 	return nil
 }
@@ -203,78 +298,88 @@ func (fsa *FilestoreServiceB) UpdateConsistency(arg *CacheContent, reply *ValRep
 
 func main() {
 
-	Logger = govec.Initialize("fsB", "fsB")
-
 	// parse args
-	usage := fmt.Sprintf("Usage: %s ip:port\n", os.Args[0])
-	if len(os.Args) != 4 {
+	usage := fmt.Sprintf("Usage: %s [config file] [node name]\n", os.Args[0])
+	if len(os.Args) != 3 {
 		fmt.Printf(usage)
 		os.Exit(1)
 	}
 
+	var err error
+	Config, err = config.Load(os.Args[1])
+	checkError(err)
+	node, err := Config.Node(os.Args[2], config.FilestoreB)
+	checkError(err)
+
+	checkError(rpcc.InitTracer("fsB", Config.Tracer))
+	checkError(rpcc.EnableRecording("fsB", Config.Storage.Records))
+	checkError(rpcc.InitBreakers(Config.Breaker))
+	checkError(rpcc.InitTimeouts(Config.AdaptiveTimeouts))
+	HopTimeout = int(Config.Timeouts.Hop.Duration / time.Millisecond)
+	ReportInterval = Config.Timeouts.Report.Duration
+
 	gob.Register(ValArgs{})
 	gob.Register(ValMetadata{})
 	gob.Register(NodeInfo{})
 
-	filestoreAddr := os.Args[1]
-	frontendAddr := os.Args[2]
-	replicationFactor := os.Args[3]
-	fmt.Println("filestoreAddrB:", filestoreAddr, " frontendAddr:", frontendAddr, " replicationFactor:", replicationFactor)
+	filestoreAddr := node.Listen
+	NodeAddress = filestoreAddr
+	frontendAddr := Config.ReportAddrs(config.FilestoreB)
+	Group = node.Group
+	fmt.Println("filestoreAddrB:", filestoreAddr, " frontendAddr:", frontendAddr, " group:", Group)
 
 	FileContentMapB = make(map[string]string)
 
+	rpcc.RegisterResolver(rpcc.NewRemoteResolver(frontendAddr, "FrontEndMapService.Resolve"))
+
+	// register with the front end for this node's id first, the gossip carries it;
+	// the front ends may not be up or have elected a leader yet
+	NodeUuid = nodeUuid(filestoreAddr)
+	for {
+		serviceFE, err := dialFrontEnd(frontendAddr)
+		if err == nil {
+			err = registerToFrontEnd(serviceFE)
+			serviceFE.Close()
+			if err == nil {
+				break
+			}
+		}
+		rpcc.Sleep(ReportInterval)
+	}
+
+	joinGossip(filestoreAddr)
 	go initListener(filestoreAddr)
 	go printMaps()
 
-	serviceFE, err := rpc.Dial("tcp", frontendAddr)
+	serviceFE, err := dialFrontEnd(frontendAddr)
 	checkError(err)
 	UpdateToFrontEnd(NodeType, NodeService, filestoreAddr, serviceFE)
+	serviceFE.Close()
 	//counter:=0
 	for {
 		//counter++
 		//fmt.Println(counter)
-		serviceFE, err = rpc.Dial("tcp", frontendAddr)
+		serviceFE, err = dialFrontEnd(frontendAddr)
 		if err == nil {
-			UpdateToFrontEnd(NodeType, NodeService, filestoreAddr, serviceFE)
+			switch UpdateToFrontEnd(NodeType, NodeService, filestoreAddr, serviceFE) {
+			case UnregisteredNode:
+				registerToFrontEnd(serviceFE)
+			case DecommissionedNode:
+				fmt.Println("Drained and deregistered by the front end, leaving")
+				Members.Leave()
+				os.Exit(0)
+			}
+			serviceFE.Close()
 		}
-		time.Sleep(1000 * time.Millisecond)
+		rpcc.Sleep(ReportInterval)
 	}
 }
 
 //======================================= HELPER FUNCTIONS =======================================
-func GenerateLog(callType string, chain rpcc.RPCChain) []byte {
-	nextChain := chain.CurrentPosition + 1
-	logMessage := Msg{"FSB " + callType + "log.", time.Now().String()}
-	fmt.Println(chain.EntityList[nextChain].Service_info)
-	logBuf := Logger.PrepareSend(callType+" request to "+chain.EntityList[nextChain].Service_info, logMessage)
-	return logBuf
-
-}
-
-func GenerateReturnLog(callType string, chain rpcc.RPCChain, returnChain int) []byte {
-	logMessage := Msg{"FSB Return" + callType + "log.", time.Now().String()}
-	fmt.Println(chain.EntityList[returnChain].Service_info)
-	logBuf := Logger.PrepareSend(callType+" return to "+chain.EntityList[returnChain].Service_info, logMessage)
-	return logBuf
-
-}
-
-func HandleLog(cmd string, chain rpcc.RPCChain) {
-	logMessage := new(Msg)
-	prevChain := chain.CurrentPosition - 1
-	Logger.UnpackReceive(cmd+" request received from "+chain.EntityList[prevChain].Service_info, chain.Log, &logMessage)
-	fmt.Println(logMessage.String())
-
-}
-
-func (m Msg) String() string {
-	return "content: " + m.Content + "\ntime: " + m.RealTimestamp
-}
-
 // If error is non-nil, print it out and halt.
 func checkError(err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error ", err.Error())
+		fmt.Fprintf(os.Stderr, "Error %s\n", err.Error())
 		os.Exit(1)
 	}
 }
@@ -283,39 +388,59 @@ func checkError(err error) {
 func initListener(address string) {
 	service := new(FilestoreServiceB)
 	rpc.Register(service)
+	rpcc.RegisterServices()
 	ln, e := net.Listen("tcp", address)
 	if e != nil {
 		log.Fatal("listen error:", e)
 	} else {
-		go rpc.Accept(ln)
+		go rpcc.Accept(ln)
 	}
 }
 
+// Joins the gossip of the backend nodes through the seeds of the config, alone if there are none
+func joinGossip(address string) {
+	var err error
+	Members, err = gossip.Start(gossip.Config{
+		Addr:    address,
+		Id:      NodeId,
+		Role:    NodeType,
+		Group:   Group,
+		Service: NodeService,
+		Seeds:   Config.Seeds,
+	})
+	checkError(err)
+}
+
 func printMaps() {
 	for {
 		fmt.Println()
+		fmt.Println("Gossip members:", Members.Members(), "replica set:", Members.Peers(NodeType))
 		fmt.Println("Printing stored files...")
 		fileCount := 1
-		for k, v := range FileContentMapB {
+		for k, v := range storedFiles() {
 			fmt.Println(fileCount, "FILENAME:", k)
 			fmt.Println("  CONTENT:", v)
 			fileCount++
 		}
-		time.Sleep(3000 * time.Millisecond)
+		rpcc.Sleep(3000 * time.Millisecond)
 	}
 }
 
 // send this node's information to front end
-func UpdateToFrontEnd(typeArg int, service string, address string, dialservice *rpc.Client) {
+func UpdateToFrontEnd(typeArg int, service string, address string, dialservice *rpc.Client) string {
 
 	list := make([]map[string]string, 1)
-	list[0] = FileContentMapB
+	list[0] = storedFiles()
 
 	node := NodeInfoCache{
+		Id:      NodeId,
 		Type:    typeArg,
 		Addr:    address,
 		Service: service,
 		Maps:    list,
+		Group:   Group,
+
+		Open_breakers: rpcc.OpenBreakers(),
 	}
 
 	var kvVal ValReply
@@ -325,6 +450,19 @@ func UpdateToFrontEnd(typeArg int, service string, address string, dialservice *
 	//fmt.Println("ReportServerActivity err:",err)
 	//fmt.Println("Updated activity status:", node, kvVal.Val)
 
+	return kvVal.Val
+}
+
+// A copy of the stored files, to read without holding the lock
+func storedFiles() map[string]string {
+	fileContentMutex.Lock()
+	defer fileContentMutex.Unlock()
+
+	files := make(map[string]string, len(FileContentMapB))
+	for k, v := range FileContentMapB {
+		files[k] = v
+	}
+	return files
 }
 
 //Dial to address
@@ -334,10 +472,55 @@ func dialAddr(addr string) (*rpc.Client, error) {
 	return service, err
 }
 
+//Dial the first front end of the comma separated list that answers, any of them takes the reports
+func dialFrontEnd(frontendAddrs string) (*rpc.Client, error) {
+	var err error
+	for _, addr := range strings.Split(frontendAddrs, ",") {
+		var service *rpc.Client
+		if service, err = dialAddr(strings.TrimSpace(addr)); err == nil {
+			return service, nil
+		}
+	}
+	return nil, err
+}
+
+//Register with the front end under this node's uuid, keeping the id it had if any
+func registerToFrontEnd(dialservice *rpc.Client) error {
+	args := NodeRegistration{Uuid: NodeUuid, Type: NodeType, Id: NodeId}
+	var reply NodeRegistration
+	if err := dialservice.Call("FrontEndServiceFilestoreB.Register", args, &reply); err != nil {
+		fmt.Println("Register err:", err)
+		return err
+	}
+
+	NodeId = reply.Id
+	fmt.Println("Registered", NodeUuid, "as node", NodeId)
+	return nil
+}
+
+//The uuid this node keeps across restarts in [service]-[address].uuid of the storage dir, made on its first start
+func nodeUuid(address string) string {
+	path := filepath.Join(Config.Storage.Dir, NodeService+"-"+strings.Replace(address, ":", "-", -1)+".uuid")
+	if content, err := ioutil.ReadFile(path); err == nil && len(strings.TrimSpace(string(content))) > 0 {
+		return strings.TrimSpace(string(content))
+	}
+
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	checkError(err)
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+
+	checkError(ioutil.WriteFile(path, []byte(uuid+"\n"), 0644))
+	return uuid
+}
+
 //func returns a list of all the files in that directory StorageFiles which has all the storage files
 //*assumption that the file is being run from the parent directory
 func listFilesGet() string {
-	fileList := make([]string, len(FileContentMapB))
+	files := storedFiles()
+	fileList := make([]string, len(files))
 	// files, _ := ioutil.ReadDir(FileBasePath)//"./StorageFiles")
 	// for _, f := range files {
 	// 	fileList = append(fileList, f.Name())
@@ -347,7 +530,7 @@ func listFilesGet() string {
 	// }
 	//return fileList
 	i := 0
-	for k, _ := range FileContentMapB {
+	for k, _ := range files {
 		fileList[i] = k
 		i++
 	}
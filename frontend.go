@@ -1,24 +1,32 @@
-// Usage: go run frontend.go [front-end ip:port]
+// Usage: go run frontend.go [config file] [front end name]
 //
-// - [front-end-client ip:port] : the ip and TCP port on which this front end is listening for client connections.
-// - [front-end-metadata ip:port] : the ip and TCP port on which this front end is listening for metadata connections.
-// - [front-end-auth ip:port] : the ip and TCP port on which this front end is listening for auth connections.
-// - [front-end-filestoreA ip:port] : the ip and TCP port on which this front end is listening for filestoreA connections.
-// - [front-end-filestoreB ip:port] : the ip and TCP port on which this front end is listening for filestoreB connections.
+// - [config file] : the topology of the cluster, see cluster.json. RPCC_* environment variables override its settings.
+// - [front end name] : the front end of the config file to run. Its listeners are:
+//   - client : the ip and TCP port on which this front end is listening for client connections.
+//   - metadata : the ip and TCP port on which this front end is listening for metadata connections.
+//   - auth : the ip and TCP port on which this front end is listening for auth connections.
+//   - filestoreA : the ip and TCP port on which this front end is listening for filestoreA connections.
+//   - filestoreB : the ip and TCP port on which this front end is listening for filestoreB connections.
+//   - extra : the ip and TCP port on which this front end is listening for the other front ends.
 //
 package main 
 
 import (
+	"./config"
+	"./election"
+	"./gossip"
+	"./registry"
 	"./rpcc"
+	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
-	"github.com/arcaneiceman/GoVector/govec"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
-	"strconv"
-	"strings"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -31,6 +39,8 @@ type FrontEndServiceFilestoreB int
 
 type FrontEndMapService int
 
+type FrontEndResolver int
+
 //======================================= STRUCTS =======================================
 
 type ValReply struct {
@@ -42,11 +52,15 @@ type ValArgs struct {
 	Text_content string
 	Secret_info  string
 	ErrorCode    int
+	Content_ref  rpcc.PayloadRef // Text_content buffered on the first or target hop
 }
 
 type ValMetadata struct {
 	FilestoreMapA map[int]NodeInfo
 	FilestoreMapB map[int]NodeInfo
+
+	Shard_A string // logical services of the groups owning the file
+	Shard_B string
 }
 
 // Type 0 is metadata server, 1 is auth server, 2 is file storage A, 3 is file storage B
@@ -56,6 +70,9 @@ type NodeInfoCache struct {
 	Addr    string
 	Service string
 	Maps    []map[string]string
+	Group   int // the filestore group the node holds the files of
+
+	Open_breakers []string // addresses this node's hops currently fail fast to
 }
 
 type NodeInfo struct {
@@ -65,13 +82,29 @@ type NodeInfo struct {
 	Service string
 }
 
-type CacheContent struct {
-	Maps []map[string]string
+// an operator draining the node with key, [role]-[group]-[id]
+type DrainArgs struct {
+	Key string
+}
+
+// a chain back from the cluster, with the nodes that served it and whether it wrote to them;
+// the leading front end settles it, whichever front end the chain came back through
+type ReturnedArgs struct {
+	ChainId  string
+	ServedBy []string
+	Took     []time.Duration // how long each of ServedBy held the chain, 0 if unknown
+	Wrote    bool
 }
 
-type Msg struct {
-	Content       string
-	RealTimestamp string
+// a node asking for its id, the one it had if any (-1 otherwise); the reply carries the id it got
+type NodeRegistration struct {
+	Uuid string // kept by the node across restarts
+	Type int
+	Id   int
+}
+
+type CacheContent struct {
+	Maps []map[string]string
 }
 
 //======================================= VARIABLES =======================================
@@ -87,21 +120,54 @@ const StoreEntryFunction string = "FStore"
 const RetrieveEntryFunction string = "FRetrieve"
 const ListEntryFunction string = "FList"
 
-const ReplicationFactor = 2
+const MetadataLogicalName string = "metadata"
+const AuthLogicalName string = "auth"
+const FilestoreALogicalName string = "filestoreA"
+const FilestoreBLogicalName string = "filestoreB"
 
-var AuthMap map[int]NodeInfo
-var MetadataMap map[int]NodeInfo
-var FilestoreMapA map[int]NodeInfo
-var FilestoreMapB map[int]NodeInfo
+// reply to the reports of a node the front end gave no id, it registers again
+const UnregisteredNode string = "Unregistered node"
 
-//var ChainInfoMap map[int]NodeInfo
+// reply to the reports of a drained node, it leaves
+const DecommissionedNode string = "Decommissioned node"
+
+// how long a drain waits for the chains the node serves, then for its final report
+var DrainTimeout = 10 * time.Second
+
+const DrainReportTimeout = 3 * time.Second
 
-var AuthWaitlistMap map[int]NodeInfo
-var MetadataWaitlistMap map[int]NodeInfo
-var FilestoreWaitlistMapA map[int]NodeInfo
-var FilestoreWaitlistMapB map[int]NodeInfo
+// How often the failure detector looks at the nodes, they report every second
+const ActivityCheckInterval = 200 * time.Millisecond
 
-var ActivityMap map[string]int64
+// active and waitlisted nodes of every role, their standing with the failure
+// detector and the addresses their circuit breakers are open to
+var Registry *registry.Registry
+
+// the front ends elect a leader, the only one to run the failure detector and take reports,
+// the others follow its registry and pass it the chains and reports they get
+var Elector *election.Elector
+
+// services the nodes of each role register and report to
+var ReportServices = map[registry.Role]string{
+	registry.Metadata:   "FrontEndServiceMetadata",
+	registry.Auth:       "FrontEndServiceAuth",
+	registry.FilestoreA: "FrontEndServiceFilestoreA",
+	registry.FilestoreB: "FrontEndServiceFilestoreB",
+}
+
+// spreads the read hops over the replicas of their role, other hops go to the primary
+var Balancer *registry.Balancer
+
+// consistent hashing of the file names over the groups of each filestore
+var Rings = map[registry.Role]*registry.Ring{
+	registry.FilestoreA: registry.NewRing(registry.DefaultVirtualNodes),
+	registry.FilestoreB: registry.NewRing(registry.DefaultVirtualNodes),
+}
+
+// entry functions that only read, any replica can serve them
+var ReadEntries = map[string]bool{"FARetrieve": true, "FBRetrieve": true, "FAList": true, "FBList": true}
+
+//var ChainInfoMap map[int]NodeInfo
 
 var nextChainID int
 var nextMetadataID int
@@ -111,26 +177,33 @@ var nextFilestoreIDB int
 
 var extraADDR string
 
-var Logger *govec.GoLog
+// the topology and settings of the cluster, from the config file
+var Config *config.Config
+
+// how long a hop of a chain waits for the next, in ms
+var HopTimeout int = 10000
+
+// final reports of the nodes being drained, by key
+var drainReports = make(map[string]chan NodeInfoCache)
+var drainMutex sync.Mutex
 
 //======================================= SERVICE METHODS =======================================
 
 func (fsc *FrontEndServiceClient) FStore(chain rpcc.RPCChain, reply *bool) error {
 
-	cmd := "STORE"
-	HandleLog(cmd, chain)
 	// fmt.Println("content:", rpcc.Args.Text_content)
 	// fmt.Println("secret:", rpcc.Args.Secret_info)
 	args := chain.FirstEntity().Args.(ValArgs)
-	if args.ErrorCode == INCOMPLETE_CHAIN {
-		if len(MetadataMap) != 0 && len(FilestoreMapA) != 0 && len(FilestoreMapB) != 0 {
+	if args.ErrorCode == INCOMPLETE_CHAIN && !Elector.IsLeader() {
+		*reply = proxyChain(chain, StoreEntryFunction)
+	} else if args.ErrorCode == INCOMPLETE_CHAIN {
+		if clusterAvailable() {
 			//reply before synchronous call
 			generateHops(&chain)
 			fmt.Println(chain)
 
-			logBuf := GenerateLog(cmd, chain)
-			chain.AddLogToChain(logBuf)
-			chain.CallNext(10000)
+			Balancer.Dispatched(chain.Id, rpcc.Now())
+			chain.CallNext(HopTimeout)
 
 			*reply = true
 		} else {
@@ -140,10 +213,8 @@ func (fsc *FrontEndServiceClient) FStore(chain rpcc.RPCChain, reply *bool) error
 	} else {
 		*reply = true
 
-		logBuf := GenerateReturnLog(cmd, chain, 0)
-		chain.AddLogToChain(logBuf)
-
-		chain.CallIndex(0, 10000)
+		chainReturned(chain, true)
+		chain.CallIndex(0, HopTimeout)
 	}
 
 	fmt.Println()
@@ -153,25 +224,27 @@ func (fsc *FrontEndServiceClient) FStore(chain rpcc.RPCChain, reply *bool) error
 
 func (fsc *FrontEndServiceClient) FRetrieve(chain rpcc.RPCChain, reply *bool) error {
 
-	cmd := "RETRIEVE"
-	HandleLog(cmd, chain)
-
 	args := chain.FirstEntity().Args.(ValArgs)
-	if args.ErrorCode == INCOMPLETE_CHAIN {
-		if len(MetadataMap) != 0 && len(FilestoreMapA) != 0 && len(FilestoreMapB) != 0 {
+	if args.ErrorCode == INCOMPLETE_CHAIN && !Elector.IsLeader() {
+		*reply = proxyChain(chain, RetrieveEntryFunction)
+	} else if args.ErrorCode == INCOMPLETE_CHAIN {
+		if clusterAvailable() {
+			shardA := owner(registry.FilestoreA, args.File_Name)
+			shardB := owner(registry.FilestoreB, args.File_Name)
 			valMeta := ValMetadata{
-				FilestoreMapA: FilestoreMapA,
-				FilestoreMapB: FilestoreMapB,
+				FilestoreMapA: nodeInfos(Registry.Active(shardA)),
+				FilestoreMapB: nodeInfos(Registry.Active(shardB)),
+				Shard_A:       shardA.String(),
+				Shard_B:       shardB.String(),
 			}
 
-			argMap := MetadataMap[getFirstMapKey(MetadataMap)]
-			chain.AddToChain(argMap.Addr, argMap.Service, "MDRetrieve", valMeta, -1)
+			argMap, _ := primary(registry.Metadata)
+			chain.AddLogicalToChain(MetadataLogicalName, argMap.Service, "MDRetrieve", valMeta, -1)
 
 			fmt.Println(chain)
 
-			logBuf := GenerateLog(cmd, chain)
-			chain.AddLogToChain(logBuf)
-			chain.CallNext(10000)
+			Balancer.Dispatched(chain.Id, rpcc.Now())
+			chain.CallNext(HopTimeout)
 
 			*reply = true
 		} else {
@@ -179,9 +252,8 @@ func (fsc *FrontEndServiceClient) FRetrieve(chain rpcc.RPCChain, reply *bool) er
 			*reply = false
 		}
 	} else {
-		logBuf := GenerateReturnLog(cmd, chain, 0)
-		chain.AddLogToChain(logBuf)
-		chain.CallIndex(0, 10000)
+		chainReturned(chain, false)
+		chain.CallIndex(0, HopTimeout)
 		*reply = true
 	}
 
@@ -192,27 +264,30 @@ func (fsc *FrontEndServiceClient) FRetrieve(chain rpcc.RPCChain, reply *bool) er
 
 func (fsc *FrontEndServiceClient) FList(chain rpcc.RPCChain, reply *bool) error {
 
-	cmd := "LIST"
-	HandleLog(cmd, chain)
-
 	args := chain.FirstEntity().Args.(ValArgs)
-	if args.ErrorCode == INCOMPLETE_CHAIN {
+	if args.ErrorCode == INCOMPLETE_CHAIN && !Elector.IsLeader() {
+		*reply = proxyChain(chain, ListEntryFunction)
+	} else if args.ErrorCode == INCOMPLETE_CHAIN {
 		fmt.Println("List request receieved")
 
-		if len(MetadataMap) != 0 && len(FilestoreMapA) != 0 && len(FilestoreMapB) != 0 {
-			//argMap := MetadataMap[getFirstMapKey(MetadataMap)]
-			argMapA := FilestoreMapA[getFirstMapKey(FilestoreMapA)]
-			argMapB := FilestoreMapB[getFirstMapKey(FilestoreMapB)]
+		if clusterAvailable() {
+			//argMap, _ := primary(registry.Metadata)
+			argMapA, _ := primary(registry.FilestoreA)
+			argMapB, _ := primary(registry.FilestoreB)
 
 			//chain.AddToChain(argMap.Addr, argMap.Service, "MDList", nil, -1)
-			chain.AddToChain(argMapA.Addr, argMapA.Service, "FAList", nil, -1)
-			chain.AddToChain(argMapB.Addr, argMapB.Service, "FBList", nil, -1)
+			// every group holds a part of the files
+			for _, shard := range Registry.Shards(registry.FilestoreA) {
+				chain.AddLogicalToChain(shard.String(), argMapA.Service, "FAList", nil, -1)
+			}
+			for _, shard := range Registry.Shards(registry.FilestoreB) {
+				chain.AddLogicalToChain(shard.String(), argMapB.Service, "FBList", nil, -1)
+			}
 
 			fmt.Println(chain)
 
-			logBuf := GenerateLog(cmd, chain)
-			chain.AddLogToChain(logBuf)
-			chain.CallNext(10000)
+			Balancer.Dispatched(chain.Id, rpcc.Now())
+			chain.CallNext(HopTimeout)
 
 			*reply = true
 		} else {
@@ -221,10 +296,8 @@ func (fsc *FrontEndServiceClient) FList(chain rpcc.RPCChain, reply *bool) error
 		}
 	} else {
 
-		logBuf := GenerateReturnLog(cmd, chain, 0)
-		chain.AddLogToChain(logBuf)
-
-		chain.CallIndex(0, 10000)
+		chainReturned(chain, false)
+		chain.CallIndex(0, HopTimeout)
 		*reply = true
 	}
 
@@ -233,34 +306,84 @@ func (fsc *FrontEndServiceClient) FList(chain rpcc.RPCChain, reply *bool) error
 	return nil
 }
 
-// when servers join assign a map to keep track of their activity
-func (fsmd *FrontEndServiceMetadata) ReportServerActivity(args *NodeInfoCache, reply *ValReply) error {
-	return processNodeConnections(*args, 1, MetadataMap, MetadataWaitlistMap, reply)
+// nodes register before reporting, with the uuid they keep, to get their id
+func (fsmd *FrontEndServiceMetadata) Register(args *NodeRegistration, reply *NodeRegistration) error {
+	return processRegistration(*args, registry.Metadata, reply)
 }
 
-// func (fsa *FrontEndServiceAuth) Handshake(arg *ValReply, reply *ValReply) error {
+func (fsa *FrontEndServiceAuth) Register(args *NodeRegistration, reply *NodeRegistration) error {
+	return processRegistration(*args, registry.Auth, reply)
+}
 
-// 	return handleHandshake(2, *arg, reply)
-// }
+func (fsfa *FrontEndServiceFilestoreA) Register(args *NodeRegistration, reply *NodeRegistration) error {
+	return processRegistration(*args, registry.FilestoreA, reply)
+}
+
+func (fsfb *FrontEndServiceFilestoreB) Register(args *NodeRegistration, reply *NodeRegistration) error {
+	return processRegistration(*args, registry.FilestoreB, reply)
+}
+
+// when servers join assign a map to keep track of their activity
+func (fsmd *FrontEndServiceMetadata) ReportServerActivity(args *NodeInfoCache, reply *ValReply) error {
+	return processNodeConnections(*args, registry.Metadata, reply)
+}
 
 func (fsa *FrontEndServiceAuth) ReportServerActivity(args *NodeInfoCache, reply *ValReply) error {
-	return processNodeConnections(*args, 2, AuthMap, AuthWaitlistMap, reply)
+	return processNodeConnections(*args, registry.Auth, reply)
 }
 
 func (fsfa *FrontEndServiceFilestoreA) ReportServerActivity(args *NodeInfoCache, reply *ValReply) error {
-	return processNodeConnections(*args, 3, FilestoreMapA, FilestoreWaitlistMapA, reply)
+	return processNodeConnections(*args, registry.FilestoreA, reply)
 }
 
 func (fsfb *FrontEndServiceFilestoreB) ReportServerActivity(args *NodeInfoCache, reply *ValReply) error {
-	return processNodeConnections(*args, 4, FilestoreMapB, FilestoreWaitlistMapB, reply)
+	return processNodeConnections(*args, registry.FilestoreB, reply)
 }
 
 func (fm *FrontEndMapService) Extra(rpcc *rpcc.RPCChain, reply *ValReply) error {
 	return nil
 }
 
-func (fm *FrontEndMapService) AuthRecovery(arg *CacheContent, reply *ValReply) error {
-	backupAuth(*arg)
+// resolve a logical service name to its live nodes for other services' hops
+func (fm *FrontEndMapService) Resolve(args *rpcc.ResolveArgs, reply *rpcc.ResolveReply) error {
+	// the leader knows the last writes and balances the reads, a follower's copy of its
+	// registry is up to a heartbeat behind; without a leader the copy is all there is
+	if !Elector.IsLeader() && forwardToLeader("FrontEndMapService.Resolve", args, reply) == nil {
+		return nil
+	}
+
+	addrs, err := new(FrontEndResolver).Resolve(args.Entity)
+	reply.Addrs = addrs
+	return err
+}
+
+// the balancer's outstanding chains and the replicas' freshness are kept by the leader,
+// a follower's copy would be overwritten by its next heartbeat
+func (fm *FrontEndMapService) Returned(args *ReturnedArgs, reply *bool) error {
+	if !Elector.IsLeader() {
+		return forwardToLeader("FrontEndMapService.Returned", args, reply)
+	}
+
+	now := rpcc.Now()
+	Balancer.Returned(args.ChainId, args.ServedBy, args.Took, now)
+	if args.Wrote {
+		Registry.Wrote(args.ServedBy, now)
+	}
+	*reply = true
+	return nil
+}
+
+// drain a node gracefully, see drainNode
+func (fm *FrontEndMapService) Drain(args *DrainArgs, reply *ValReply) error {
+	if !Elector.IsLeader() {
+		return forwardToLeader("FrontEndMapService.Drain", args, reply)
+	}
+
+	node, err := drainNode(args.Key)
+	if err != nil {
+		return err
+	}
+	reply.Val = "Drained " + node.Key() + " " + node.Addr
 	return nil
 }
 
@@ -268,44 +391,69 @@ func (fm *FrontEndMapService) AuthRecovery(arg *CacheContent, reply *ValReply) e
 
 func main() {
 
-	Logger = govec.Initialize("frontend", "frontend")
-
 	// parse args
-	usage := fmt.Sprintf("Usage: %s ip:port\n", os.Args[0])
-	if len(os.Args) != 8 {
+	usage := fmt.Sprintf("Usage: %s [config file] [front end name]\n", os.Args[0])
+	if len(os.Args) != 3 {
 		fmt.Printf(usage)
 		os.Exit(1)
 	}
 
+	var err error
+	Config, err = config.Load(os.Args[1])
+	checkError(err)
+	frontEnd, err := Config.FrontEnd(os.Args[2])
+	checkError(err)
+
+	checkError(rpcc.InitTracer("frontend", Config.Tracer))
+	checkError(rpcc.EnableRecording("frontend", Config.Storage.Records))
+	checkError(rpcc.InitBreakers(Config.Breaker))
+	checkError(rpcc.InitTimeouts(Config.AdaptiveTimeouts))
+	HopTimeout = int(Config.Timeouts.Hop.Duration / time.Millisecond)
+	DrainTimeout = Config.Timeouts.Drain.Duration
+
 	gob.Register(ValArgs{})
 	gob.Register(ValMetadata{})
 	gob.Register(NodeInfo{})
 
-	clientAddr := os.Args[1]
-	metadataAddr := os.Args[2]
-	authAddr := os.Args[3]
-	filestoreAAddr := os.Args[4]
-	filestoreBAddr := os.Args[5]
-	extraAddr := os.Args[6]
-	ReplicationFactor := os.Args[7]
+	clientAddr := frontEnd.Client
+	metadataAddr := frontEnd.Metadata
+	authAddr := frontEnd.Auth
+	filestoreAAddr := frontEnd.FilestoreA
+	filestoreBAddr := frontEnd.FilestoreB
+	extraAddr := frontEnd.Extra
 
-	fmt.Println("clientAddr:", clientAddr, " metadataAddr:", metadataAddr, " authAddr:", authAddr, " filestoreAAddr:", filestoreAAddr, " filestoreBAddr:", filestoreBAddr, "ReplicationFactor:", ReplicationFactor)
+	fmt.Println("clientAddr:", clientAddr, " metadataAddr:", metadataAddr, " authAddr:", authAddr, " filestoreAAddr:", filestoreAAddr, " filestoreBAddr:", filestoreBAddr, "Replication:", Config.Replication)
 
 	//initialize maps
 	//ChainInfoMap = make(map[int]NodeInfo)
-	MetadataMap = make(map[int]NodeInfo)
-	AuthMap = make(map[int]NodeInfo)
-	FilestoreMapA = make(map[int]NodeInfo)
-	FilestoreMapB = make(map[int]NodeInfo)
-	ActivityMap = make(map[string]int64)
-
-	MetadataWaitlistMap = make(map[int]NodeInfo)
-	FilestoreWaitlistMapA = make(map[int]NodeInfo)
-	FilestoreWaitlistMapB = make(map[int]NodeInfo)
+	detector, err := registry.ParseDetectorConfig(Config.Detector)
+	checkError(err)
+	Registry = registry.New(config.DefaultReplication, detector)
+	Registry.Replicas = make(map[registry.Role]int)
+	for _, role := range registry.Roles {
+		Registry.Replicas[role] = Config.ReplicationOf(role.String())
+	}
+	Registry.Subscribe(printMembership)
+	policy, err := registry.ParsePolicy(Config.Balancer)
+	checkError(err)
+	Balancer = registry.NewBalancer(policy)
+
+	// the front ends of the config file elect a leader over their extra addresses, alone it leads
+	Elector, err = election.Start(election.Config{
+		Self:      extraAddr,
+		Peers:     Config.Peers(),
+		Lease:     Config.Timeouts.Lease.Duration,
+		Heartbeat: Config.Timeouts.Heartbeat.Duration,
+	}, registryState, installRegistry)
+	checkError(err)
+	Elector.Subscribe(printLeadership)
+	bootstrapRegistry(Config.Seeds)
 
 	nextChainID = 0
 	extraADDR = extraAddr
 
+	rpcc.RegisterResolver(new(FrontEndResolver))
+
 	go initListener(clientAddr, 0)
 	go initListener(metadataAddr, 1)
 	go initListener(authAddr, 2)
@@ -314,59 +462,23 @@ func main() {
 	go initListener(extraAddr, 9)
 	go printMaps()
 
-	//counter:=0
-	for {
-		//counter++
-		//fmt.Println(counter)
-		// fmt.Println("ChainInfoMap:",ChainInfoMap)
-		checkActivityStatus()
-	}
-}
-
-//======================================= HELPER FUNCTIONS =======================================
-func GenerateLog(callType string, chain rpcc.RPCChain) []byte {
-	nextChain := chain.CurrentPosition + 1
-	logMessage := Msg{"FE " + callType + "log.", time.Now().String()}
-	fmt.Println(chain.EntityList[nextChain].Service_info)
-	logBuf := Logger.PrepareSend(callType+" request to "+chain.EntityList[nextChain].Service_info, logMessage)
-	return logBuf
-
-}
-
-func GenerateReturnLog(callType string, chain rpcc.RPCChain, returnChain int) []byte {
-	logMessage := Msg{"FE" + callType + "log.", time.Now().String()}
-	fmt.Println(chain.EntityList[returnChain].Service_info)
-	logBuf := Logger.PrepareSend(callType+" return to "+chain.EntityList[returnChain].Service_info, logMessage)
-	return logBuf
-
-}
-
-func HandleLog(cmd string, chain rpcc.RPCChain) {
-
-	if chain.IsReturnCall == false {
-		logMessage := new(Msg)
-		prevChain := chain.CurrentPosition - 1
-		Logger.UnpackReceive(cmd+" request received from "+chain.EntityList[prevChain].Service_info, chain.Log, &logMessage)
-		fmt.Println(logMessage.String())
+	// the cluster state as JSON over HTTP, see registry.AdminServer
+	if frontEnd.Admin != "" {
+		go serveAdmin(frontEnd.Admin, extraAddr)
 	}
 
-	if chain.IsReturnCall == true {
-		logMessage := new(Msg)
-		prevChain := chain.LastEntity()
-		Logger.UnpackReceive(cmd+" return from "+prevChain.Service_info, chain.Log, &logMessage)
-		fmt.Println(logMessage.String())
+	// fmt.Println("ChainInfoMap:",ChainInfoMap)
+	ticker := rpcc.NewTicker(ActivityCheckInterval)
+	for range ticker.C {
+		checkActivityStatus()
 	}
-
-}
-
-func (m Msg) String() string {
-	return "content: " + m.Content + "\ntime: " + m.RealTimestamp
 }
 
+//======================================= HELPER FUNCTIONS =======================================
 // If error is non-nil, print it out and halt.
 func checkError(err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error ", err.Error())
+		fmt.Fprintf(os.Stderr, "Error %s\n", err.Error())
 		os.Exit(1)
 	}
 }
@@ -394,39 +506,97 @@ func initListener(address string, typeref int) {
 	case 9:
 		service := new(FrontEndMapService)
 		rpc.Register(service)
+		rpcc.RegisterServices()
 	}
 
 	ln, e := net.Listen("tcp", address)
 	if e != nil {
 		log.Fatal("listen error:", e)
 	} else {
-		go rpc.Accept(ln)
+		go rpcc.Accept(ln)
 	}
 }
 
-//get available map element with the smallest id
-func getFirstMapKey(argMap map[int]NodeInfo) int {
-	i := 0
-	for i = 0; i < len(argMap); i++ {
-		if (argMap[i] != NodeInfo{}) {
-			break
-		}
+//the chains need a metadata server and both file stores to be dispatched
+func clusterAvailable() bool {
+	return len(Registry.Shards(registry.Metadata)) != 0 &&
+		len(Registry.Shards(registry.FilestoreA)) != 0 &&
+		len(Registry.Shards(registry.FilestoreB)) != 0
+}
+
+//the primary of a role's first group, for the service names
+func primary(role registry.Role) (registry.Node, bool) {
+	shards := Registry.Shards(role)
+	if len(shards) == 0 {
+		return registry.Node{}, false
 	}
+	return Registry.Primary(shards[0])
+}
 
-	return i
+//the group of role owning a file, the ring follows the groups with nodes
+func owner(role registry.Role, fileName string) registry.Shard {
+	ring := Rings[role]
+	if ring == nil {
+		return registry.Shard{Role: role}
+	}
+
+	shards := Registry.Shards(role)
+	groups := make([]int, 0, len(shards))
+	for _, shard := range shards {
+		groups = append(groups, shard.Group)
+	}
+	if ring.Set(groups) {
+		fmt.Println(role, "ring groups:", groups)
+	}
+
+	group, _ := ring.Owner(fileName)
+	return registry.Shard{Role: role, Group: group}
 }
 
-//Other servers use rpc methods to call this method to get their map key
-func getFirstAvailableEmptyKey(argMap map[int]NodeInfo) int {
-	i := 0
-	for {
-		if (argMap[i] == NodeInfo{}) {
-			break
+//the registry's nodes as the other services know them
+func nodeInfos(nodes map[int]registry.Node) map[int]NodeInfo {
+	infos := make(map[int]NodeInfo, len(nodes))
+	for id, node := range nodes {
+		infos[id] = NodeInfo{
+			Id:      node.Id,
+			Type:    int(node.Role),
+			Addr:    node.Addr,
+			Service: node.Service,
 		}
-		i++
+	}
+	return infos
+}
+
+//Pick the live nodes of a logical service when a hop is dispatched, reads in the order of the
+//balancing policy and writes lowest id first, nodes reported behind an open circuit breaker last
+func (fr *FrontEndResolver) Resolve(entity rpcc.ServerEntity) ([]string, error) {
+	shard, ok := registry.ParseShard(entity.Logical_service)
+	if !ok {
+		return nil, fmt.Errorf("unknown logical service %q", entity.Logical_service)
 	}
 
-	return i
+	current := rpcc.Now()
+	healthy, tripped := Registry.Healthy(shard, current)
+	if ReadEntries[entity.Entry] {
+		// replicas lagging behind the last write are only read when nothing else answers
+		fresh, lagging := Registry.Current(shard, healthy)
+		return Balancer.Pick(entity.Logical_service, fresh, append(tripped, lagging...), current), nil
+	}
+	return Balancer.Route(healthy, tripped, current), nil
+}
+
+//the nodes a returning chain's logical hops were served by, and how long each held the chain
+func servedBy(chain rpcc.RPCChain) ([]string, []time.Duration) {
+	addrs := make([]string, 0)
+	took := make([]time.Duration, 0)
+	for i, entity := range chain.EntityList {
+		if entity.Logical_service != "" && entity.Connection_info != "" {
+			d, _ := chain.HopDuration(i)
+			addrs = append(addrs, entity.Connection_info)
+			took = append(took, d)
+		}
+	}
+	return addrs, took
 }
 
 //generate the rpc chain components to dial to for STORE command
@@ -434,60 +604,109 @@ func generateHops(chain *rpcc.RPCChain) {
 
 	//chain.CurrrentPosition++
 
-	db := MetadataMap[getFirstMapKey(MetadataMap)]
-	au := AuthMap[getFirstMapKey(AuthMap)]
+	db, _ := primary(registry.Metadata)
+	au, _ := primary(registry.Auth)
 
 	// Database
-	chain.AddToChain(db.Addr, db.Service, "MDStore", nil, -1)
+	chain.AddLogicalToChain(MetadataLogicalName, db.Service, "MDStore", nil, -1)
 
 	args := chain.FirstEntity().Args.(ValArgs)
 
 	if args.Secret_info != "" {
 		// Auth
-		chain.AddToChain(au.Addr, au.Service, "AStore", nil, -1)
+		chain.AddLogicalToChain(AuthLogicalName, au.Service, "AStore", nil, -1)
 
-		// Fileserver A
-		fa := FilestoreMapA[getFirstMapKey(FilestoreMapA)]
-		chain.AddToChain(fa.Addr, fa.Service, "FAStore", nil, -1)
+		// Fileserver A, the group owning the file
+		fa, _ := primary(registry.FilestoreA)
+		chain.AddLogicalToChain(owner(registry.FilestoreA, args.File_Name).String(), fa.Service, "FAStore", nil, -1)
 	} else {
-		// Fileserver B
-		fb := FilestoreMapB[getFirstMapKey(FilestoreMapB)]
-		chain.AddToChain(fb.Addr, fb.Service, "FBStore", nil, -1)
+		// Fileserver B, the group owning the file
+		fb, _ := primary(registry.FilestoreB)
+		chain.AddLogicalToChain(owner(registry.FilestoreB, args.File_Name).String(), fb.Service, "FBStore", nil, -1)
 	}
 }
 
 func printMaps() {
 	for {
-		fmt.Println("MetadataMap:", MetadataMap)
-		fmt.Println("AuthMap:", AuthMap)
-		fmt.Println("FilestoreMapA:", FilestoreMapA)
-		fmt.Println("FilestoreMapB:", FilestoreMapB)
-		fmt.Println("MetadataWaitlistMap:", MetadataWaitlistMap)
-		fmt.Println("FilestoreWaitlistMapA:", FilestoreWaitlistMapA)
-		fmt.Println("FilestoreWaitlistMapB:", FilestoreWaitlistMapB)
-		fmt.Println("ActivityMap:", ActivityMap)
+		leader, _ := Elector.Leader()
+		fmt.Println("front end:", Elector.Role(), "term", Elector.Term(), "leader", leader)
+		for _, role := range registry.Roles {
+			for _, shard := range Registry.Shards(role) {
+				fmt.Println(shard, "active:", Registry.Active(shard), "waitlist:", Registry.Waitlist(shard))
+			}
+		}
+
+		current := rpcc.Now()
+		statuses := Registry.Statuses(current)
+		keys := make([]string, 0, len(statuses))
+		for key := range statuses {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			status := statuses[key]
+			fmt.Printf("%s: %s, phi %.2f, last report %.1fs ago\n", key, status.Health, status.Phi, current.Sub(status.Last).Seconds())
+		}
+
+		loads := Balancer.Loads(current)
+		addrs := make([]string, 0, len(loads))
+		for addr := range loads {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			load := loads[addr]
+			fmt.Printf("%s (%s): %d requests, %d outstanding, latency %s\n", addr, Balancer.Policy.Name(), load.Picks, load.Outstanding, load.Latency.Round(time.Microsecond))
+		}
 		fmt.Println()
-		time.Sleep(3000 * time.Millisecond)
+		rpcc.Sleep(3000 * time.Millisecond)
+	}
+}
+
+//print the nodes joining and leaving
+func printMembership(event registry.Event) {
+	switch event.Kind {
+	case registry.Leave:
+		fmt.Println(event.Node.Role, event.Node.Key(), event.Node.Addr, "unavailable!!!")
+	case registry.Suspect:
+		fmt.Println(event.Node.Role, event.Node.Key(), event.Node.Addr, "suspected, late reporting")
+	case registry.Recover:
+		fmt.Println(event.Node.Role, event.Node.Key(), event.Node.Addr, "recovered")
+	case registry.Promote:
+		fmt.Println(event.Node.Role, event.Node.Key(), event.Node.Addr, "promoted from the waitlist")
+	case registry.Demote:
+		fmt.Println(event.Node.Role, event.Node.Key(), event.Node.Addr, "moved to the waitlist")
+	case registry.Drain:
+		fmt.Println(event.Node.Role, event.Node.Key(), event.Node.Addr, "draining, no more hops routed to it")
+	case registry.Deregister:
+		fmt.Println(event.Node.Role, event.Node.Key(), event.Node.Addr, "drained and deregistered")
+	case registry.Join:
+		state := "waitlisted"
+		if event.Active {
+			state = "active"
+		}
+		fmt.Println(event.Node.Role, event.Node.Key(), event.Node.Addr, "joined,", state)
 	}
 }
 
 // send to replicas
-func updateReplicas(argMap map[int]NodeInfo, argReplicaMap []map[string]string) error {
+func updateReplicas(argMap map[int]registry.Node, first int, argReplicaMap []map[string]string, reported time.Time) error {
 	var kvVal ValReply
 	cache := CacheContent{
 		Maps: argReplicaMap,
 	}
 
-	first := getFirstMapKey(argMap)
-
 	for k, v := range argMap {
-		if k != first {
+		if k != first && !Registry.Draining(v.Key()) {
 			dialservice, err := dialAddr(v.Addr)
 			if err == nil {
 				serviceMethod := v.Service + "." + "UpdateConsistency"
-				dialservice.Call(serviceMethod, cache, &kvVal)
+				if dialservice.Call(serviceMethod, cache, &kvVal) == nil {
+					Registry.Synced(v, reported)
+				}
 				//checkError(err)
 				//fmt.Println(service ,"Replica reply:", kvVal.Val)
+				dialservice.Close()
 			}
 		}
 	}
@@ -495,60 +714,64 @@ func updateReplicas(argMap map[int]NodeInfo, argReplicaMap []map[string]string)
 	return nil
 }
 
-func backupAuth(cache CacheContent) error {
-	if len(cache.Maps[0]) != 0 {
-		for _, v := range FilestoreMapA {
-			dialservice, err := dialAddr(v.Addr)
-			if err == nil {
-				var kvVal ValReply
-				serviceMethod := v.Service + "." + "AuthRecovery"
-				dialservice.Call(serviceMethod, cache, &kvVal)
-				//checkError(err)
-			}
-		}
+func processRegistration(args NodeRegistration, role registry.Role, reply *NodeRegistration) error {
+	if !Elector.IsLeader() {
+		return forwardToLeader(ReportServices[role]+".Register", args, reply)
+	}
+	if args.Type != int(role) {
+		return fmt.Errorf("node type %d registering as %s", args.Type, role)
 	}
 
+	id, err := Registry.Register(args.Uuid, role, args.Id)
+	if err != nil {
+		return err
+	}
+	*reply = args
+	reply.Id = id
+	fmt.Println(role, "node", args.Uuid, "registered with id", id)
 	return nil
 }
 
-func processNodeConnections(args NodeInfoCache, argType int, argMap map[int]NodeInfo, waitlistMap map[int]NodeInfo, reply *ValReply) error {
-	if args.Type == argType {
+func processNodeConnections(args NodeInfoCache, role registry.Role, reply *ValReply) error {
+	if !Elector.IsLeader() {
+		return forwardToLeader(ReportServices[role]+".ReportServerActivity", args, reply)
+	}
 
-		t := strconv.Itoa(argType)
-		id := strconv.Itoa(args.Id)
-		key := t + "-" + id
+	if args.Type == int(role) && Registry.Retired(role, args.Id) {
+		reply.Val = DecommissionedNode
+		return nil
+	}
+	if args.Type == int(role) && !Registry.Registered(role, args.Id) {
+		reply.Val = UnregisteredNode
+		return nil
+	}
 
-		val := time.Now().Unix()
-		//val= strconv.ParseInt(val, 10, 64)
+	if args.Type == int(role) {
 
-		nodeInfo := NodeInfo{
+		node := registry.Node{
 			Id:      args.Id,
-			Type:    args.Type,
+			Role:    role,
+			Group:   args.Group,
 			Addr:    args.Addr,
 			Service: args.Service,
 		}
 
-		if _, ok := argMap[args.Id]; ok {
-			argMap[args.Id] = nodeInfo
-		} else {
-			if len(argMap) < ReplicationFactor && len(waitlistMap) == 0 {
-				argMap[args.Id] = nodeInfo
-			} else {
-				waitlistMap[args.Id] = nodeInfo
-			}
-		}
+		reported := rpcc.Now()
+		Registry.Report(node, args.Open_breakers, reported)
+		awaitedReport(node, args)
 
-		ActivityMap[key] = val
-
-		if args.Id == getFirstMapKey(argMap) {
-			if len(argMap) > 1 {
-				updateReplicas(argMap, args.Maps)
+		if primary, ok := Registry.Primary(node.Shard()); ok && primary.Id == args.Id {
+			if replicas := Registry.Active(node.Shard()); len(replicas) > 1 {
+				updateReplicas(replicas, primary.Id, args.Maps, reported)
 			}
 			//fmt.Println("Replicating first replica content...")
+
+			if _, sharded := Rings[role]; sharded && len(args.Maps) == 1 {
+				rebalance(node, args.Maps[0])
+			}
 		}
 
 		//fmt.Println("New node added:  type", args.Type, " info",args)
-		//fmt.Println("Updated map::", argMap)
 		reply.Val = "Node info recorded"
 
 		return nil
@@ -558,48 +781,258 @@ func processNodeConnections(args NodeInfoCache, argType int, argMap map[int]Node
 	return nil
 }
 
-//Activity detection based on time, 3 sec = inactive, nodes send infor every second
-func checkActivityStatus() {
-	for k, v := range ActivityMap {
-		//fmt.Println("Active Nodes:" + k)
-		current := time.Now().Unix()
-		dif := current - v
-		if dif > 3 {
-			fmt.Println(k, "unavailable!!!")
-			//If a KV node died, remove its related info and copy to another node
-			delete(ActivityMap, k)
-			s := strings.Split(k, "-")
-			nodeType := s[0]
-			nodeId, _ := strconv.Atoi(s[1])
-			updateFromWaitlist(nodeType, nodeId)
+//Take the node with key out of the cluster without losing chains or data: stop routing hops to it,
+//wait for the chains it serves to come back, merge the data of its final report into the node taking
+//over its shard and deregister it. Its next report tells it to leave.
+func drainNode(key string) (registry.Node, error) {
+	successor, handover, err := Registry.Successor(key)
+	if err != nil {
+		return registry.Node{}, err
+	}
+	node, err := Registry.Drain(key)
+	if err != nil {
+		return registry.Node{}, err
+	}
+
+	deadline := rpcc.Now().Add(DrainTimeout)
+	for Balancer.Loads(rpcc.Now())[node.Addr].Outstanding > 0 {
+		if rpcc.Now().After(deadline) {
+			fmt.Println("Gave up waiting for the chains of", node.Key(), "after", DrainTimeout)
+			break
+		}
+		rpcc.Sleep(100 * time.Millisecond)
+	}
+
+	if handover {
+		final, ok := awaitReport(node, DrainReportTimeout)
+		if !ok {
+			return node, fmt.Errorf("no report from %s %s to hand its data over, still draining", node.Key(), node.Addr)
+		}
+		var kvVal ValReply
+		if err := callNode(successor, "MergeConsistency", CacheContent{Maps: final.Maps}, &kvVal); err != nil {
+			return node, fmt.Errorf("unable to hand the data of %s over to %s, still draining: %v", node.Key(), successor.Key(), err)
+		}
+		fmt.Println("Handed the data of", node.Key(), "over to", successor.Key(), successor.Addr)
+	}
+
+	return Registry.Deregister(key)
+}
+
+//Wait for the next report of node
+func awaitReport(node registry.Node, timeout time.Duration) (NodeInfoCache, bool) {
+	reports := make(chan NodeInfoCache, 1)
+	drainMutex.Lock()
+	drainReports[node.Key()] = reports
+	drainMutex.Unlock()
+
+	defer func() {
+		drainMutex.Lock()
+		delete(drainReports, node.Key())
+		drainMutex.Unlock()
+	}()
+
+	select {
+	case report := <-reports:
+		return report, true
+	case <-rpcc.After(timeout):
+		return NodeInfoCache{}, false
+	}
+}
+
+//Pass a report to the drain waiting for it
+func awaitedReport(node registry.Node, args NodeInfoCache) {
+	drainMutex.Lock()
+	defer drainMutex.Unlock()
+
+	if reports, ok := drainReports[node.Key()]; ok {
+		select {
+		case reports <- args:
+		default:
 		}
 	}
 }
 
-//Use node from waitlist to fill dead replica
-func updateFromWaitlist(nodeType string, nodeId int) {
-	switch nodeType {
-	case "1":
-		if len(MetadataWaitlistMap) != 0 {
-			index := getFirstMapKey(MetadataWaitlistMap)
-			MetadataMap[index] = MetadataWaitlistMap[index]
-			delete(MetadataWaitlistMap, index)
+//every active node of role, whatever its group
+func allActive(role registry.Role) []registry.Node {
+	nodes := make([]registry.Node, 0)
+	for _, shard := range Registry.Shards(role) {
+		for _, node := range Registry.Active(shard) {
+			nodes = append(nodes, node)
 		}
-		delete(MetadataMap, nodeId)
-	case "3":
-		if len(FilestoreWaitlistMapA) != 0 {
-			index := getFirstMapKey(FilestoreWaitlistMapA)
-			FilestoreMapA[index] = FilestoreWaitlistMapA[index]
-			delete(FilestoreWaitlistMapA, index)
+	}
+	return nodes
+}
+
+//Hand the files a group's primary holds but no longer owns to their owning group's primary, then
+//drop them from it. Runs on the primary's reports, so files move after groups join or leave.
+func rebalance(node registry.Node, files map[string]string) {
+	moves := make(map[registry.Shard]map[string]string)
+	for name, content := range files {
+		if shard := owner(node.Role, name); shard != node.Shard() {
+			if moves[shard] == nil {
+				moves[shard] = make(map[string]string)
+			}
+			moves[shard][name] = content
 		}
-		delete(FilestoreMapA, nodeId)
-	case "4":
-		if len(FilestoreWaitlistMapB) != 0 {
-			index := getFirstMapKey(FilestoreWaitlistMapB)
-			FilestoreMapB[index] = FilestoreWaitlistMapB[index]
-			delete(FilestoreWaitlistMapB, index)
+	}
+
+	for shard, moved := range moves {
+		target, ok := Registry.Primary(shard)
+		if !ok {
+			continue
+		}
+
+		var kvVal ValReply
+		cache := CacheContent{Maps: []map[string]string{moved}}
+		if err := callNode(target, "ImportFiles", cache, &kvVal); err != nil {
+			fmt.Println("Unable to move files to", shard, target.Addr+":", err)
+			continue
+		}
+		if err := callNode(node, "DropFiles", cache, &kvVal); err != nil {
+			fmt.Println("Unable to drop moved files from", node.Shard(), node.Addr+":", err)
+			continue
+		}
+		fmt.Println("Moved", len(moved), "files from", node.Shard(), "to", shard)
+	}
+}
+
+//Call a method of a node's service
+func callNode(node registry.Node, method string, args interface{}, reply interface{}) error {
+	dialservice, err := dialAddr(node.Addr)
+	if err != nil {
+		return err
+	}
+	defer dialservice.Close()
+	return dialservice.Call(node.Service+"."+method, args, reply)
+}
+
+//Activity detection by a phi accrual failure detector over the nodes' reports, nodes send
+//infor every second. A dead node's place goes to the first node on its role's waitlist.
+func checkActivityStatus() {
+	if Elector.IsLeader() {
+		Registry.Check(rpcc.Now())
+	}
+}
+
+//Pass a node's registration or report to the leading front end
+func forwardToLeader(serviceMethod string, args interface{}, reply interface{}) error {
+	leader, ok := Elector.Leader()
+	if !ok {
+		return errors.New("no leading front end")
+	}
+
+	dialservice, err := dialAddr(leader)
+	if err != nil {
+		return fmt.Errorf("leading front end %s unreachable: %v", leader, err)
+	}
+	defer dialservice.Close()
+	return dialservice.Call(serviceMethod, args, reply)
+}
+
+//Pass a client's chain to the leading front end, which dispatches it. The chain still comes
+//back through this front end on its way to the client, which settles it with the leader.
+func proxyChain(chain rpcc.RPCChain, entryFunction string) bool {
+	leader, ok := Elector.Leader()
+	if !ok {
+		fmt.Println("No leading front end, chain", chain.Id, "dropped")
+		return false
+	}
+
+	dialservice, err := dialAddr(leader)
+	if err != nil {
+		fmt.Println("Leading front end", leader, "unreachable:", err)
+		return false
+	}
+	defer dialservice.Close()
+
+	var reply bool
+	err = dialservice.Call("FrontEndServiceClient."+entryFunction, chain, &reply)
+	if err != nil {
+		fmt.Println("Leading front end", leader, "failed the chain:", err)
+		return false
+	}
+	return reply
+}
+
+//Settle a chain back from the cluster on the leading front end, see FrontEndMapService.Returned.
+//A store only counts as written when it got through, not when auth refused it or a hop failed
+func chainReturned(chain rpcc.RPCChain, store bool) {
+	args := ReturnedArgs{ChainId: chain.Id}
+	if first, ok := chain.FirstEntity().Args.(ValArgs); ok {
+		args.Wrote = store && chain.Err == "" && first.ErrorCode == SUCCESSFUL_COMPLETED
+	}
+	args.ServedBy, args.Took = servedBy(chain)
+	var reply bool
+	if err := new(FrontEndMapService).Returned(&args, &reply); err != nil {
+		fmt.Println("Unable to settle chain", chain.Id, "with the leading front end:", err)
+	}
+}
+
+//The registry the leader sends its followers with every heartbeat
+func registryState() []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(Registry.Snapshot()); err != nil {
+		fmt.Println("Unable to encode the registry:", err)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func installRegistry(state []byte) {
+	var snapshot registry.Snapshot
+	if err := gob.NewDecoder(bytes.NewReader(state)).Decode(&snapshot); err != nil {
+		fmt.Println("Unable to decode the leader's registry:", err)
+		return
+	}
+	Registry.Restore(snapshot, rpcc.Now())
+}
+
+//print the front end taking the lead or following another
+func printLeadership(role election.Role, leader string, term uint64) {
+	switch role {
+	case election.Leader:
+		fmt.Println("Leading the front ends, term", term)
+	case election.Follower:
+		if leader != "" {
+			fmt.Println("Following", leader+", term", term)
+		} else {
+			fmt.Println("No leading front end, term", term)
+		}
+	}
+}
+
+func serveAdmin(address string, self string) {
+	admin := registry.AdminServer{
+		Registry: Registry,
+		Balancer: Balancer,
+		Self:     self,
+		Leader:   Elector.Leader,
+		Drain:    drainNode,
+		Now:      rpcc.Now,
+	}
+	fmt.Println("Admin API on http://" + address)
+	log.Fatal("admin API error:", admin.ListenAndServe(address))
+}
+
+//Fills the registry with the members of the backend's gossip, asked from the first seed that
+//answers, so the cluster is known before the nodes report. The nodes' reports take over from there.
+func bootstrapRegistry(seeds []string) {
+	for _, seed := range seeds {
+		members, err := gossip.Fetch(seed, time.Second)
+		if err != nil {
+			fmt.Println("Unable to bootstrap from", seed+":", err)
+			continue
+		}
+
+		for _, member := range members {
+			if member.State == gossip.Dead {
+				continue
+			}
+			node := registry.Node{Id: member.Id, Role: registry.Role(member.Role), Group: member.Group, Addr: member.Addr, Service: member.Service}
+			Registry.Report(node, nil, rpcc.Now())
 		}
-		delete(FilestoreMapB, nodeId)
+		fmt.Println("Bootstrapped from", seed+":", members)
+		return
 	}
 }
 
@@ -0,0 +1,502 @@
+package gossip
+
+import (
+	"../rpcc"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/rpc"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* === Headers === */
+
+type State int
+
+const (
+	Alive   State = iota
+	Suspect       // Missed a probe, declared dead unless it refutes in time
+	Dead
+)
+
+// A node of the gossip, known by its address
+type Member struct {
+	Addr        string
+	Id          int    // The id the node reports to the frontend with
+	Role        int    // The node type: 1 metadata, 2 auth, 3 file storage A, 4 file storage B
+	Group       int    // The filestore group it holds the files of, 0 for the other roles
+	Service     string // The RPC service the node serves chains with
+	Incarnation uint64 // Raised by the node itself to refute suspicion, starts at its boot time
+	State       State
+}
+
+type Config struct {
+	Addr    string
+	Id      int
+	Role    int
+	Group   int
+	Service string
+	Seeds   []string // Members to join through, this node's own address is skipped
+
+	Period         time.Duration // A random member is probed every period
+	PingTimeout    time.Duration
+	IndirectProbes int           // Members asked to probe one that didn't answer
+	SuspectTimeout time.Duration // Suspects that don't refute by then are dead
+	DeadTTL        time.Duration // Dead members are remembered this long, so stale gossip can't bring them back
+	SyncEvery      int           // Every so many periods, full state is exchanged with a random member
+}
+
+// Membership of this node in a SWIM style gossip: failures are detected by direct and
+// indirect probes, and changes spread piggybacked on the probes. Probes and suspicions
+// are timed on rpcc's clock. Safe for concurrent use.
+type Memberlist struct {
+	config Config
+
+	mutex    sync.Mutex
+	self     Member
+	members  map[string]Member    // By address, this node excluded
+	changed  map[string]time.Time // When each member last changed state
+	queue    []*broadcast
+	probes   []string // Members left to probe this round, shuffled
+	periods  int
+	stop     chan struct{}
+	handlers []Handler
+	random   *rand.Rand
+}
+
+// Called with every change to another member, once the memberlist is unlocked
+type Handler func(Member)
+
+type broadcast struct {
+	member    Member
+	transmits int
+}
+
+// Updates piggybacked on every message, the ones sent the fewest times first
+const MaxPiggyback = 8
+
+var DefaultConfig = Config{
+	Period:         time.Second,
+	PingTimeout:    300 * time.Millisecond,
+	IndirectProbes: 3,
+	SuspectTimeout: 5 * time.Second,
+	DeadTTL:        30 * time.Second,
+	SyncEvery:      10,
+}
+
+/* === Functions === */
+// Seeds separated by commas, like "127.0.0.1:2011,127.0.0.1:2012"
+func ParseSeeds(spec string) []string {
+	seeds := make([]string, 0)
+	for _, seed := range strings.Split(spec, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+	return seeds
+}
+
+// Starts this node's membership: serves the gossip RPCs on the default RPC server, joins
+// through the seeds and probes the members until Leave. Unset durations take their defaults.
+// Seeds that can't be reached are retried every period while no other member is known.
+func Start(config Config) (*Memberlist, error) {
+	m := newMemberlist(config)
+	if err := rpc.RegisterName("GossipService", &GossipService{m: m}); err != nil {
+		return nil, err
+	}
+
+	m.join()
+	go m.run()
+	return m, nil
+}
+
+// Tells the members this node is leaving and stops probing
+func (m *Memberlist) Leave() {
+	m.mutex.Lock()
+	self := m.self
+	self.Incarnation++
+	self.State = Dead
+	targets := m.addrs()
+	m.mutex.Unlock()
+
+	for _, addr := range targets {
+		var reply PingReply
+		rpcc.CallTimeout(addr, "GossipService.Ping", PingArgs{From: self, Updates: []Member{self}}, &reply, m.config.PingTimeout)
+	}
+	close(m.stop)
+}
+
+func (m *Memberlist) Self() Member {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.self
+}
+
+// The members not known to be dead, this node included, by address
+func (m *Memberlist) Members() []Member {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	members := []Member{m.self}
+	for _, member := range m.members {
+		if member.State != Dead {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Addr < members[j].Addr })
+	return members
+}
+
+// The members of a role not known to be dead, this node included if it has the role
+func (m *Memberlist) Peers(role int) []Member {
+	peers := make([]Member, 0)
+	for _, member := range m.Members() {
+		if member.Role == role {
+			peers = append(peers, member)
+		}
+	}
+	return peers
+}
+
+func (m *Memberlist) Subscribe(handler Handler) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.handlers = append(m.handlers, handler)
+}
+
+func (member Member) String() string {
+	return fmt.Sprintf("%s(%s)", member.Addr, member.State)
+}
+
+func (state State) String() string {
+	switch state {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+/* == Private Functions == */
+// The memberlist Start serves and runs, unset durations take their defaults
+func newMemberlist(config Config) *Memberlist {
+	withDefaults(&config)
+
+	return &Memberlist{
+		config: config,
+		self: Member{
+			Addr:        config.Addr,
+			Id:          config.Id,
+			Role:        config.Role,
+			Group:       config.Group,
+			Service:     config.Service,
+			Incarnation: uint64(rpcc.Now().UnixNano()),
+		},
+		members: make(map[string]Member),
+		changed: make(map[string]time.Time),
+		stop:    make(chan struct{}),
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func withDefaults(config *Config) {
+	if config.Period <= 0 {
+		config.Period = DefaultConfig.Period
+	}
+	if config.PingTimeout <= 0 {
+		config.PingTimeout = DefaultConfig.PingTimeout
+	}
+	if config.IndirectProbes <= 0 {
+		config.IndirectProbes = DefaultConfig.IndirectProbes
+	}
+	if config.SuspectTimeout <= 0 {
+		config.SuspectTimeout = DefaultConfig.SuspectTimeout
+	}
+	if config.DeadTTL <= 0 {
+		config.DeadTTL = DefaultConfig.DeadTTL
+	}
+	if config.SyncEvery <= 0 {
+		config.SyncEvery = DefaultConfig.SyncEvery
+	}
+}
+
+// Asks the seeds for the members until one answers
+func (m *Memberlist) join() bool {
+	for _, seed := range m.config.Seeds {
+		if seed == m.config.Addr {
+			continue
+		}
+
+		var reply StateReply
+		err := rpcc.CallTimeout(seed, "GossipService.Join", JoinArgs{Member: m.Self()}, &reply, m.config.PingTimeout)
+		if err != nil {
+			continue
+		}
+		m.merge(reply.Members)
+		return true
+	}
+	if len(m.config.Seeds) > 0 {
+		log.Println("gossip: no seed of", m.config.Seeds, "answered, retrying")
+	}
+	return false
+}
+
+func (m *Memberlist) run() {
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-rpcc.After(m.config.Period):
+		}
+
+		m.mutex.Lock()
+		alone := len(m.addrs()) == 0
+		m.periods++
+		sync := m.periods%m.config.SyncEvery == 0
+		m.mutex.Unlock()
+
+		if alone {
+			m.join()
+			continue
+		}
+		m.probe()
+		if sync {
+			m.sync()
+		}
+		m.expire()
+	}
+}
+
+// Pings the next member, then through others if it doesn't answer, suspecting it if nobody can reach it
+func (m *Memberlist) probe() {
+	target, ok := m.nextProbe()
+	if !ok {
+		return
+	}
+
+	var reply PingReply
+	err := rpcc.CallTimeout(target.Addr, "GossipService.Ping", m.pingArgs(), &reply, m.config.PingTimeout)
+	if err == nil {
+		m.merge(reply.Updates)
+		return
+	}
+
+	acked := make(chan bool, m.config.IndirectProbes)
+	helpers := m.randomMembers(m.config.IndirectProbes, target.Addr)
+	for _, helper := range helpers {
+		go func(helper string) {
+			var reply PingReply
+			args := PingReqArgs{Target: target.Addr, Ping: m.pingArgs()}
+			err := rpcc.CallTimeout(helper, "GossipService.PingReq", args, &reply, 2*m.config.PingTimeout)
+			if err == nil {
+				m.merge(reply.Updates)
+			}
+			acked <- err == nil
+		}(helper)
+	}
+	for range helpers {
+		if <-acked {
+			return
+		}
+	}
+
+	target.State = Suspect
+	m.apply(target)
+}
+
+// Exchanges full state with a random member, repairing gossip that was lost
+func (m *Memberlist) sync() {
+	helpers := m.randomMembers(1, "")
+	if len(helpers) == 0 {
+		return
+	}
+
+	var reply StateReply
+	if err := rpcc.CallTimeout(helpers[0], "GossipService.Sync", StateReply{Members: m.state()}, &reply, m.config.PingTimeout); err == nil {
+		m.merge(reply.Members)
+	}
+}
+
+// Suspects that didn't refute in time are dead, dead members are forgotten after DeadTTL
+func (m *Memberlist) expire() {
+	m.mutex.Lock()
+	now := rpcc.Now()
+	dead := make([]Member, 0)
+	for addr, member := range m.members {
+		switch {
+		case member.State == Suspect && now.Sub(m.changed[addr]) > m.config.SuspectTimeout:
+			member.State = Dead
+			dead = append(dead, member)
+		case member.State == Dead && now.Sub(m.changed[addr]) > m.config.DeadTTL:
+			delete(m.members, addr)
+			delete(m.changed, addr)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, member := range dead {
+		m.apply(member)
+	}
+}
+
+func (m *Memberlist) merge(updates []Member) {
+	for _, update := range updates {
+		m.apply(update)
+	}
+}
+
+// Takes in news of a member if it's newer than what this node knows: a higher incarnation,
+// or the same one in a worse state. News of this node's own suspicion is refuted.
+func (m *Memberlist) apply(update Member) {
+	m.mutex.Lock()
+
+	if update.Addr == m.self.Addr {
+		if update.State != Alive && update.Incarnation >= m.self.Incarnation {
+			m.self.Incarnation = update.Incarnation + 1
+			m.queueBroadcast(m.self)
+		}
+		m.mutex.Unlock()
+		return
+	}
+
+	current, known := m.members[update.Addr]
+	if known && !newer(update, current) {
+		m.mutex.Unlock()
+		return
+	}
+	if !known && update.State == Dead {
+		// Nothing to forget
+		m.mutex.Unlock()
+		return
+	}
+
+	m.members[update.Addr] = update
+	m.changed[update.Addr] = rpcc.Now()
+	m.queueBroadcast(update)
+	handlers := append([]Handler{}, m.handlers...)
+	m.mutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(update)
+	}
+}
+
+func newer(update Member, current Member) bool {
+	if update.Incarnation != current.Incarnation {
+		return update.Incarnation > current.Incarnation
+	}
+	return update.State > current.State
+}
+
+// Must be called with the mutex held
+func (m *Memberlist) queueBroadcast(member Member) {
+	for _, b := range m.queue {
+		if b.member.Addr == member.Addr {
+			b.member = member
+			b.transmits = 0
+			return
+		}
+	}
+	m.queue = append(m.queue, &broadcast{member: member})
+}
+
+// The updates to piggyback on a message, each is sent about 3 log(n) times
+func (m *Memberlist) piggyback() []Member {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	limit := 3 * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+	sort.SliceStable(m.queue, func(i, j int) bool { return m.queue[i].transmits < m.queue[j].transmits })
+
+	updates := make([]Member, 0, MaxPiggyback)
+	for _, b := range m.queue {
+		if len(updates) == MaxPiggyback {
+			break
+		}
+		updates = append(updates, b.member)
+		b.transmits++
+	}
+
+	kept := m.queue[:0]
+	for _, b := range m.queue {
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	m.queue = kept
+	return updates
+}
+
+func (m *Memberlist) pingArgs() PingArgs {
+	return PingArgs{From: m.Self(), Updates: m.piggyback()}
+}
+
+// Every member this node knows of, itself included, for a full state exchange
+func (m *Memberlist) state() []Member {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	members := []Member{m.self}
+	for _, member := range m.members {
+		members = append(members, member)
+	}
+	return members
+}
+
+// Round robin over the members in random order, reshuffled every round
+func (m *Memberlist) nextProbe() (Member, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for {
+		if len(m.probes) == 0 {
+			m.probes = m.addrs()
+			if len(m.probes) == 0 {
+				return Member{}, false
+			}
+			m.random.Shuffle(len(m.probes), func(i, j int) { m.probes[i], m.probes[j] = m.probes[j], m.probes[i] })
+		}
+
+		addr := m.probes[0]
+		m.probes = m.probes[1:]
+		if member, ok := m.members[addr]; ok && member.State != Dead {
+			return member, true
+		}
+	}
+}
+
+func (m *Memberlist) randomMembers(n int, exclude string) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	addrs := make([]string, 0)
+	for _, addr := range m.addrs() {
+		if addr != exclude {
+			addrs = append(addrs, addr)
+		}
+	}
+	m.random.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+	return addrs
+}
+
+// Must be called with the mutex held, the members not known to be dead
+func (m *Memberlist) addrs() []string {
+	addrs := make([]string, 0, len(m.members))
+	for addr, member := range m.members {
+		if member.State != Dead {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
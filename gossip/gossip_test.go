@@ -0,0 +1,125 @@
+package gossip
+
+import (
+	"../rpcc"
+	"testing"
+	"time"
+)
+
+// Memberlists of a, b and c hosted on the simulator, each knowing the others alive
+func newTestGossip(t *testing.T) (*rpcc.Simulator, *rpcc.FakeClock, map[string]*Memberlist) {
+	fake := rpcc.NewFakeClock(time.Unix(0, 0))
+	rpcc.SetClock(fake)
+	sim := rpcc.NewSimulator()
+	t.Cleanup(func() {
+		sim.Close()
+		rpcc.SetClock(rpcc.RealClock{})
+	})
+
+	members := make(map[string]*Memberlist)
+	for _, addr := range []string{"a", "b", "c"} {
+		members[addr] = newMemberlist(Config{Addr: addr, Role: 3})
+		if err := sim.Host(addr, "GossipService", &GossipService{m: members[addr]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range members {
+		for _, other := range members {
+			if other != m {
+				m.apply(other.Self())
+			}
+		}
+	}
+	return sim, fake, members
+}
+
+// Probes every member a knows once, in its shuffled order
+func probeRound(m *Memberlist) {
+	for range m.Members()[1:] {
+		m.probe()
+	}
+}
+
+func TestGossipSuspicion(t *testing.T) {
+	tests := []struct {
+		name    string
+		drop    bool  // a's direct ping to c is lost, b's reaches it
+		crash   bool  // c is down for a's first round of probes
+		restart bool  // c is back up for a second round
+		probed  State // c as a sees it after the probes
+		expired State // and once the suspicion timeout is past
+	}{
+		{name: "answers", probed: Alive, expired: Alive},
+		{name: "indirect ack", drop: true, probed: Alive, expired: Alive},
+		{name: "crashed", crash: true, probed: Suspect, expired: Dead},
+		// c hears of its suspicion on the next ping and outbids it
+		{name: "refuted", crash: true, restart: true, probed: Alive, expired: Alive},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim, fake, members := newTestGossip(t)
+			a := members["a"]
+			booted := members["c"].Self().Incarnation
+			changes := make(chan Member, 16)
+			a.Subscribe(func(member Member) {
+				if member.Addr == "c" {
+					changes <- member
+				}
+			})
+
+			if test.drop {
+				sim.Inject("c", "GossipService.Ping", rpcc.Fault{Drop: true, Times: 1})
+			}
+			if test.crash {
+				sim.Crash("c")
+			}
+			probeRound(a)
+			if test.restart {
+				sim.Restart("c")
+				probeRound(a)
+			}
+			if c := a.members["c"]; c.State != test.probed {
+				t.Errorf("c %s after the probes, expected %s", c.State, test.probed)
+			}
+			if test.drop && !pingReqVia(sim, "b") {
+				t.Error("a didn't ask b to probe c")
+			}
+
+			fake.Advance(a.config.SuspectTimeout + time.Millisecond)
+			a.expire()
+			c := a.members["c"]
+			if c.State != test.expired {
+				t.Errorf("c %s after the suspicion timeout, expected %s", c.State, test.expired)
+			}
+			if test.restart && c.Incarnation <= booted {
+				t.Errorf("c refuted at incarnation %d, booted at %d", c.Incarnation, booted)
+			}
+
+			// Every change was handed to the subscribers
+			if test.probed != Alive || test.restart {
+				select {
+				case <-changes:
+				default:
+					t.Error("no change of c handed to the subscribers")
+				}
+			}
+
+			// The dead are forgotten after DeadTTL, the others kept
+			fake.Advance(a.config.DeadTTL + time.Millisecond)
+			a.expire()
+			if _, known := a.members["c"]; known != (test.expired != Dead) {
+				t.Errorf("c known %v after the dead TTL", known)
+			}
+		})
+	}
+}
+
+func pingReqVia(sim *rpcc.Simulator, helper string) bool {
+	for _, hop := range sim.Hops() {
+		if hop.Address == helper && hop.ServiceMethod == "GossipService.PingReq" && hop.Err == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package gossip
+
+import (
+	"../rpcc"
+	"time"
+)
+
+/* === Headers === */
+
+// The gossip RPCs, served on the default RPC server next to the node's own services
+type GossipService struct {
+	m *Memberlist
+}
+
+type PingArgs struct {
+	From    Member
+	Updates []Member
+}
+
+type PingReply struct {
+	Updates []Member
+}
+
+// Asks a member to ping Target on the prober's behalf
+type PingReqArgs struct {
+	Target string
+	Ping   PingArgs
+}
+
+type JoinArgs struct {
+	Member Member
+}
+
+// A full copy of a member's state, dead members included so they stay dead
+type StateReply struct {
+	Members []Member
+}
+
+type MembersArgs struct{}
+
+/* === Functions === */
+// Asks a member of the gossip for the members it knows alive or suspected, for
+// processes outside the gossip like the front end
+func Fetch(addr string, timeout time.Duration) ([]Member, error) {
+	var reply StateReply
+	if err := rpcc.CallTimeout(addr, "GossipService.Members", MembersArgs{}, &reply, timeout); err != nil {
+		return nil, err
+	}
+	return reply.Members, nil
+}
+
+func (s *GossipService) Ping(args PingArgs, reply *PingReply) error {
+	s.m.apply(args.From)
+	s.m.merge(args.Updates)
+	reply.Updates = s.m.piggyback()
+	return nil
+}
+
+func (s *GossipService) PingReq(args PingReqArgs, reply *PingReply) error {
+	s.m.merge(args.Ping.Updates)
+
+	var ack PingReply
+	if err := rpcc.CallTimeout(args.Target, "GossipService.Ping", args.Ping, &ack, s.m.config.PingTimeout); err != nil {
+		return err
+	}
+	s.m.merge(ack.Updates)
+	reply.Updates = s.m.piggyback()
+	return nil
+}
+
+// The joining member gets the full state, the others hear of it through gossip
+func (s *GossipService) Join(args JoinArgs, reply *StateReply) error {
+	s.m.apply(args.Member)
+	reply.Members = s.m.state()
+	return nil
+}
+
+func (s *GossipService) Sync(args StateReply, reply *StateReply) error {
+	reply.Members = s.m.state()
+	s.m.merge(args.Members)
+	return nil
+}
+
+func (s *GossipService) Members(args MembersArgs, reply *StateReply) error {
+	reply.Members = s.m.Members()
+	return nil
+}
@@ -0,0 +1,614 @@
+// Usage: go run linearizability.go [client ip:port] [front-end ip:port] [clients] [operations per client] [history file]
+//        go run linearizability.go check [history file]
+//
+// - [client ip:port] : the ip and TCP port on which the simulated clients listen for file server connections.
+// - [front-end ip:port] : the ip and TCP port on which front end is listening for client connections.
+// - [clients] : number of clients running STORE/RETRIEVE/LIST concurrently.
+// - [operations per client] : operations each client runs, one after the other.
+// - [history file] : optional, where the recorded history is written. With check, a history
+//   to check again without a cluster.
+//
+// Every operation is recorded from its invocation to the client's callback, then the history
+// is checked against a sequential key-value store. If it isn't linearizable, the smallest
+// failing sub-history is printed and the exit status is 1. Kill and restart replicas while
+// it runs to look for stale or lost content after failover.
+//
+package main
+
+import (
+	"./rpcc"
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//======================================= SERVICE =======================================
+type ClientService int
+
+//======================================= STRUCTS =======================================
+type ValArgs struct {
+	File_Name    string
+	Secret_info  string
+	Text_content string
+	ErrorCode    int
+	Content_ref  rpcc.PayloadRef // Text_content buffered on the first or target hop
+}
+
+type ValMetadata struct {
+	FilestoreMapA map[int]NodeInfo
+	FilestoreMapB map[int]NodeInfo
+
+	Shard_A string // logical services of the groups owning the file
+	Shard_B string
+}
+
+type NodeInfo struct {
+	Id      int
+	Type    int
+	Addr    string
+	Service string
+}
+
+// An operation of the history, times are nanoseconds since the workload started
+type Operation struct {
+	Client  int
+	Kind    string   // STORE, RETRIEVE or LIST
+	Key     string   // file name, "" for LIST
+	Value   string   // content stored or retrieved
+	Keys    []string // files listed, sorted
+	Call    int64
+	Return  int64 // math.MaxInt64 while no callback came back
+	Pending bool  // a STORE that may or may not have taken effect
+}
+
+// The callback a chain is waiting for
+type callback struct {
+	args ValArgs
+	at   int64
+	ok   bool
+	err  string
+}
+
+//======================================= VARIABLES =======================================
+const NodeService string = "ClientService"
+const StoreEntryFunction string = "CStore"
+const RetrieveEntryFunction string = "CRetrieve"
+const ListEntryFunction string = "CList"
+
+const (
+	INCOMPLETE_CHAIN     = iota
+	SUCCESSFUL_COMPLETED = iota
+	INVALID_AUTH_ERROR   = iota
+)
+
+const Secret string = "pass"
+
+var NodeAddress string
+
+var start time.Time
+
+// chain id -> callback, filled in by the service methods and the error handler
+var callbacks map[string]*callback
+var callbackMutex sync.Mutex
+
+//======================================= SERVICE METHODS =======================================
+
+func (cs *ClientService) CStore(chain *rpcc.RPCChain, reply *bool) error {
+	completeCall(chain.Id, chain.CurrentEntity().Args.(ValArgs))
+	*reply = true
+	return nil
+}
+
+func (cs *ClientService) CRetrieve(chain *rpcc.RPCChain, reply *bool) error {
+	args := chain.CurrentEntity().Args.(ValArgs)
+
+	// The content is left on the filestore, only fetch it now
+	if args.Content_ref.IsSet() {
+		data, err := rpcc.Fetch(args.Content_ref)
+		if err != nil {
+			failCall(chain.Id, "unable to fetch retrieved content: "+err.Error())
+			*reply = true
+			return nil
+		}
+		rpcc.Release(args.Content_ref)
+		args.Text_content = string(data)
+	}
+
+	completeCall(chain.Id, args)
+	*reply = true
+	return nil
+}
+
+func (cs *ClientService) CList(chain *rpcc.RPCChain, reply *bool) error {
+	completeCall(chain.Id, chain.CurrentEntity().Args.(ValArgs))
+	*reply = true
+	return nil
+}
+
+//======================================= MAIN =======================================
+
+func main() {
+
+	// parse args
+	usage := fmt.Sprintf("Usage: %s [client ip:port] [front-end ip:port] [clients] [operations per client] [history file]\n"+
+		"       %s check [history file]\n", os.Args[0], os.Args[0])
+
+	gob.Register(ValArgs{})
+	gob.Register(ValMetadata{})
+	gob.Register(NodeInfo{})
+
+	var history []Operation
+	if len(os.Args) == 3 && os.Args[1] == "check" {
+		var err error
+		history, err = loadHistory(os.Args[2])
+		checkError(err)
+	} else if len(os.Args) == 5 || len(os.Args) == 6 {
+		clients, err := strconv.Atoi(os.Args[3])
+		checkError(err)
+		operations, err := strconv.Atoi(os.Args[4])
+		checkError(err)
+
+		rpcc.InitTracer("linearizability", os.Getenv("RPCC_TRACER"))
+
+		NodeAddress = os.Args[1]
+		initListener(NodeAddress)
+
+		history = runWorkload(os.Args[2], clients, operations)
+		if len(os.Args) == 6 {
+			checkError(saveHistory(os.Args[5], history))
+		}
+	} else {
+		fmt.Print(usage)
+		os.Exit(1)
+	}
+
+	pending := 0
+	for _, op := range history {
+		if op.Pending {
+			pending++
+		}
+	}
+	fmt.Printf("%d operations, %d without a reply\n", len(history), pending)
+
+	counterexample := checkHistory(history)
+	if counterexample == nil {
+		fmt.Println("History is linearizable")
+		return
+	}
+
+	fmt.Println("History is NOT linearizable, minimal counterexample:")
+	printHistory(counterexample)
+	os.Exit(1)
+}
+
+//======================================= HELPER FUNCTIONS =======================================
+// If error is non-nil, print it out and halt.
+func checkError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// Register RPC services and listens for incoming dialing
+func initListener(address string) {
+	callbacks = make(map[string]*callback)
+
+	rpc.Register(new(ClientService))
+	rpcc.RegisterServices()
+	ln, e := net.Listen("tcp", address)
+	if e != nil {
+		log.Fatal("listen error:", e)
+	}
+	go rpcc.Accept(ln)
+
+	// A chain that can't be delivered fails its operation instead of halting the run
+	rpcc.RegisterErrorHandler(func(chain *rpcc.RPCChain, error string) {
+		failCall(chain.Id, error)
+	})
+}
+
+//======================================= WORKLOAD =======================================
+// Runs the clients concurrently, each over a few files shared by all of them
+func runWorkload(frontendAddr string, clients int, operations int) []Operation {
+	// Fresh file names, so earlier runs against the cluster don't count
+	run := strconv.FormatInt(time.Now().UnixNano()%1000000, 36)
+	keys := make([]string, 3)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("lin-%s-%d.txt", run, i)
+	}
+
+	start = rpcc.Now()
+
+	var wg sync.WaitGroup
+	histories := make([][]Operation, clients)
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(time.Now().UnixNano() + int64(c)))
+			for n := 0; n < operations; n++ {
+				op, ok := runOperation(frontendAddr, c, n, keys, random)
+				if ok {
+					histories[c] = append(histories[c], op)
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	history := make([]Operation, 0)
+	for _, ops := range histories {
+		history = append(history, ops...)
+	}
+	return history
+}
+
+// Runs a random operation, false if it failed without having any effect
+func runOperation(frontendAddr string, client int, n int, keys []string, random *rand.Rand) (Operation, bool) {
+	op := Operation{Client: client, Kind: "RETRIEVE", Key: keys[random.Intn(len(keys))]}
+	switch r := random.Intn(10); {
+	case r < 5:
+		op.Kind = "STORE"
+		op.Value = fmt.Sprintf("c%d-%d", client, n)
+	case r == 9:
+		op.Kind = "LIST"
+		op.Key = ""
+	}
+
+	// Odd files are secret, stored on filestore A through auth
+	args := ValArgs{File_Name: op.Key, ErrorCode: INCOMPLETE_CHAIN}
+	if op.Kind != "LIST" && strings.HasSuffix(op.Key, "1.txt") {
+		args.Secret_info = Secret
+	}
+
+	entryFunc, callType := RetrieveEntryFunction, "FRetrieve"
+	switch op.Kind {
+	case "STORE":
+		entryFunc, callType = StoreEntryFunction, "FStore"
+		args.Content_ref = rpcc.Buffer(NodeAddress, []byte(op.Value))
+	case "LIST":
+		entryFunc, callType = ListEntryFunction, "FList"
+	}
+
+	chain := rpcc.CreateChain()
+	chain.AddToChain(NodeAddress, NodeService, entryFunc, args, -1)
+	chain.AddToChain(frontendAddr, "FrontEndServiceClient", callType, nil, -1)
+
+	cb := &callback{}
+	callbackMutex.Lock()
+	callbacks[chain.Id] = cb
+	callbackMutex.Unlock()
+
+	op.Call = int64(rpcc.Now().Sub(start))
+	chain.CallNext(10000)
+
+	callbackMutex.Lock()
+	delete(callbacks, chain.Id)
+	result := *cb
+	callbackMutex.Unlock()
+
+	if !result.ok {
+		if op.Kind != "STORE" {
+			// Nothing was observed
+			return op, false
+		}
+		// The content may still have been committed, any time from now on
+		op.Return = math.MaxInt64
+		op.Pending = true
+		fmt.Printf("client %d: STORE %s without a reply: %s\n", client, op.Key, result.err)
+		return op, true
+	}
+
+	op.Return = result.at
+	switch op.Kind {
+	case "STORE":
+		if result.args.ErrorCode != SUCCESSFUL_COMPLETED {
+			return op, false
+		}
+	case "RETRIEVE":
+		op.Value = result.args.Text_content
+	case "LIST":
+		op.Keys = listedKeys(result.args.File_Name, keys)
+	}
+	return op, true
+}
+
+// Only the files of this run are kept from a listing
+func listedKeys(list string, keys []string) []string {
+	listed := make([]string, 0)
+	for _, name := range strings.Split(list, ",") {
+		for _, key := range keys {
+			if strings.TrimSpace(name) == key {
+				listed = append(listed, key)
+				break
+			}
+		}
+	}
+	sort.Strings(listed)
+	return listed
+}
+
+func completeCall(chainId string, args ValArgs) {
+	callbackMutex.Lock()
+	defer callbackMutex.Unlock()
+
+	if cb, ok := callbacks[chainId]; ok && !cb.ok {
+		cb.args = args
+		cb.at = int64(rpcc.Now().Sub(start))
+		cb.ok = true
+	}
+}
+
+func failCall(chainId string, error string) {
+	callbackMutex.Lock()
+	defer callbackMutex.Unlock()
+
+	if cb, ok := callbacks[chainId]; ok && !cb.ok && cb.err == "" {
+		cb.err = error
+	}
+}
+
+//======================================= CHECKER =======================================
+// Returns nil if the history is linearizable, or a minimal sub-history that isn't
+func checkHistory(history []Operation) []Operation {
+	// Operations on different files are independent, unless a LIST looks at all of them
+	partitions := map[string][]Operation{"": history}
+	hasList := false
+	for _, op := range history {
+		hasList = hasList || op.Kind == "LIST"
+	}
+	if !hasList {
+		partitions = make(map[string][]Operation)
+		for _, op := range history {
+			partitions[op.Key] = append(partitions[op.Key], op)
+		}
+	}
+
+	keys := make([]string, 0, len(partitions))
+	for key := range partitions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !linearizable(partitions[key]) {
+			return shrink(partitions[key])
+		}
+	}
+	return nil
+}
+
+// Drops operations one at a time while the history still fails, until none can go.
+// The STORE behind every content read is kept, a read of nothing is a trivial failure.
+func shrink(history []Operation) []Operation {
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < len(history); i++ {
+			candidate := append(append([]Operation{}, history[:i]...), history[i+1:]...)
+			if explained(candidate) && !linearizable(candidate) {
+				history = candidate
+				changed = true
+				i--
+			}
+		}
+	}
+	return history
+}
+
+// Whether every content retrieved and file listed was stored by an operation of the history
+func explained(history []Operation) bool {
+	stored := make(map[string]bool)
+	for _, op := range history {
+		if op.Kind == "STORE" {
+			stored[op.Key] = true
+			stored[op.Key+"\x00"+op.Value] = true
+		}
+	}
+
+	for _, op := range history {
+		if op.Kind == "RETRIEVE" && op.Value != "" && !stored[op.Key+"\x00"+op.Value] {
+			return false
+		}
+		for _, key := range op.Keys {
+			if !stored[key] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Wing & Gong's search with Lowe's memoization of (linearized operations, state), as in Porcupine
+func linearizable(history []Operation) bool {
+	ops := append([]Operation{}, history...)
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+
+	done := make([]bool, len(ops))
+	seen := make(map[string]bool)
+
+	var search func(n int, state map[string]string) bool
+	search = func(n int, state map[string]string) bool {
+		if n == len(ops) {
+			return true
+		}
+
+		memo := doneKey(done) + "|" + stateKey(state)
+		if seen[memo] {
+			return false
+		}
+		seen[memo] = true
+
+		// Only operations invoked before every remaining one returned can go next
+		minReturn := int64(math.MaxInt64)
+		for i, op := range ops {
+			if !done[i] && op.Return < minReturn {
+				minReturn = op.Return
+			}
+		}
+
+		for i, op := range ops {
+			if done[i] || op.Call > minReturn {
+				continue
+			}
+
+			done[i] = true
+			if next, ok := step(state, op); ok && search(n+1, next) {
+				return true
+			}
+			if op.Pending && search(n+1, state) {
+				return true
+			}
+			done[i] = false
+		}
+		return false
+	}
+
+	return search(0, make(map[string]string))
+}
+
+// The sequential model: a map of file name to content, absent files read as ""
+func step(state map[string]string, op Operation) (map[string]string, bool) {
+	switch op.Kind {
+	case "STORE":
+		next := make(map[string]string, len(state)+1)
+		for k, v := range state {
+			next[k] = v
+		}
+		next[op.Key] = op.Value
+		return next, true
+	case "RETRIEVE":
+		return state, state[op.Key] == op.Value
+	case "LIST":
+		keys := make([]string, 0, len(state))
+		for k := range state {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return state, strings.Join(keys, ",") == strings.Join(op.Keys, ",")
+	}
+	return state, false
+}
+
+func doneKey(done []bool) string {
+	key := make([]byte, len(done))
+	for i, d := range done {
+		key[i] = '0'
+		if d {
+			key[i] = '1'
+		}
+	}
+	return string(key)
+}
+
+func stateKey(state map[string]string) string {
+	keys := make([]string, 0, len(state))
+	for k := range state {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	entries := make([]string, len(keys))
+	for i, k := range keys {
+		entries[i] = strconv.Quote(k) + "=" + strconv.Quote(state[k])
+	}
+	return strings.Join(entries, ";")
+}
+
+//======================================= HISTORIES =======================================
+func printHistory(history []Operation) {
+	ops := append([]Operation{}, history...)
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+
+	for _, op := range ops {
+		end := "   no reply"
+		if !op.Pending {
+			end = fmt.Sprintf("%9.3fms", float64(op.Return)/1e6)
+		}
+
+		fmt.Printf("  client %-3d [%9.3fms .. %s]  ", op.Client, float64(op.Call)/1e6, end)
+		switch op.Kind {
+		case "STORE":
+			fmt.Printf("STORE %s %q\n", op.Key, op.Value)
+		case "RETRIEVE":
+			fmt.Printf("RETRIEVE %s -> %q\n", op.Key, op.Value)
+		case "LIST":
+			fmt.Printf("LIST -> [%s]\n", strings.Join(op.Keys, ", "))
+		}
+	}
+}
+
+// One operation per line, grouped by client:
+// [client] [kind] [file] [content or listed files] [call] [return or -]
+func saveHistory(path string, history []Operation) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ops := append([]Operation{}, history...)
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Client < ops[j].Client })
+
+	for _, op := range ops {
+		value := strconv.Quote(op.Value)
+		if op.Kind == "LIST" {
+			value = strconv.Quote(strings.Join(op.Keys, ","))
+		}
+		end := "-"
+		if !op.Pending {
+			end = strconv.FormatInt(op.Return, 10)
+		}
+		fmt.Fprintf(f, "%d %s %s %s %d %s\n", op.Client, op.Kind, strconv.Quote(op.Key), value, op.Call, end)
+	}
+	return nil
+}
+
+func loadHistory(path string) ([]Operation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	history := make([]Operation, 0)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		var op Operation
+		var key, value, end string
+		_, err := fmt.Sscanf(scanner.Text(), "%d %s %q %q %d %s", &op.Client, &op.Kind, &key, &value, &op.Call, &end)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err.Error())
+		}
+
+		op.Key = key
+		if op.Kind == "LIST" {
+			op.Keys = make([]string, 0)
+			if value != "" {
+				op.Keys = strings.Split(value, ",")
+			}
+		} else {
+			op.Value = value
+		}
+
+		if end == "-" {
+			op.Return = math.MaxInt64
+			op.Pending = true
+		} else if op.Return, err = strconv.ParseInt(end, 10, 64); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err.Error())
+		}
+		history = append(history, op)
+	}
+	return history, scanner.Err()
+}
@@ -1,22 +1,26 @@
-// Usage: go run metadata.go [metadata ip:port] [frontend ip:port] [auth ip:port] r
+// Usage: go run metadata.go [config file] [node name]
 //
-// - [metadata ip:port] : the ip and TCP port on which this metadata server is listening for front end connections.
-// - [auth ip:port] : the ip and TCP port on which auth is listening for metadata server connections.
-// - [file-store-B ip:port] : the ip and TCP port on which file storage server B is listening for metadata server connections.
-// - r : replication factor
+// - [config file] : the topology of the cluster, see cluster.json. RPCC_* environment variables override its settings.
+// - [node name] : the metadata node of the config file to run, it listens on its listen address for front end connections
+//   and reports to the metadata listeners of the front ends.
 //
 package main  
 
 import (
+	"./config"
+	"./gossip"
 	"./rpcc"
+	"crypto/rand"
 	"encoding/gob"
 	"fmt"
-	"github.com/arcaneiceman/GoVector/govec"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -29,15 +33,20 @@ type ValArgs struct {
 	Text_content string
 	Secret_info  string
 	ErrorCode    int
+	Content_ref  rpcc.PayloadRef // Text_content buffered on the first or target hop
 }
 
 type ValMetadata struct {
 	FilestoreMapA map[int]NodeInfo
 	FilestoreMapB map[int]NodeInfo
+
+	Shard_A string // logical services of the groups owning the file
+	Shard_B string
 }
 
 type ValReply struct {
 	Val string // value; depends on the call
+	Log []byte // causal log of the caller, see rpcc.PrepareSend
 }
 
 // Type 0 is metadata server, 1 is auth server, 2 is file storage A, 3 is file storage B
@@ -47,6 +56,8 @@ type NodeInfoCache struct {
 	Addr    string
 	Service string
 	Maps    []map[string]string
+
+	Open_breakers []string // addresses this node's hops currently fail fast to
 }
 
 type NodeInfo struct {
@@ -56,13 +67,15 @@ type NodeInfo struct {
 	Service string
 }
 
-type CacheContent struct {
-	Maps []map[string]string
+// a node asking for its id, the one it had if any (-1 otherwise); the reply carries the id it got
+type NodeRegistration struct {
+	Uuid string // kept by the node across restarts
+	Type int
+	Id   int
 }
 
-type Msg struct {
-	Content       string
-	RealTimestamp string
+type CacheContent struct {
+	Maps []map[string]string
 }
 
 //======================================= VARIABLES =======================================
@@ -87,30 +100,50 @@ const FileStoreBStoreEntryFunction string = "FBStore"
 const FileStoreBRetrieveEntryFunction string = "FBRetrieve"
 const FileStoreBListEntryFunction string = "FBList"
 
+const FileStoreALogicalName string = "filestoreA"
+const FileStoreBLogicalName string = "filestoreB"
+
 var FilestoreMapA map[string]string
 var FilestoreMapB map[string]string
 var ValidationMap map[string]string
 
-var Logger *govec.GoLog
+// Guards the maps, the handlers, reports and printMaps run concurrently
+var mapsMutex sync.Mutex
+
+// This node's membership in the gossip of the backend nodes
+var Members *gossip.Memberlist
+
+// the id the front end gave this node for the uuid it keeps on disk, -1 until registered
+var NodeId int = -1
+var NodeUuid string
+
+// the topology and settings of the cluster, from the config file
+var Config *config.Config
+
+// how long a hop of a chain waits for the next, in ms, and how often this node reports
+var HopTimeout int = 10000
+var ReportInterval = 1000 * time.Millisecond
+
+// reply to the reports of a node the front end gave no id, it registers again
+const UnregisteredNode string = "Unregistered node"
+
+// reply to the reports of a drained node, it leaves
+const DecommissionedNode string = "Decommissioned node"
 
 //======================================= SERVICE METHODS =======================================
 func (ms *MetadataService) MDStore(chain *rpcc.RPCChain, reply *bool) error {
 
 	args := chain.FirstEntity().Args.(ValArgs)
 
-	cmd := "STORE"
-	HandleLog(cmd, chain)
-
+	mapsMutex.Lock()
 	if args.Secret_info != "" {
 		ValidationMap[args.File_Name] = "A"
 	} else {
 		ValidationMap[args.File_Name] = "B"
 	}
+	mapsMutex.Unlock()
 
-	logBuf := GenerateLog(cmd, chain)
-	chain.AddLogToChain(logBuf)
-
-	chain.CallNext(10000)
+	chain.CallNext(HopTimeout)
 
 	fmt.Println("STORE RPCC:")
 	fmt.Println(chain)
@@ -122,32 +155,39 @@ func (ms *MetadataService) MDStore(chain *rpcc.RPCChain, reply *bool) error {
 
 func (ms *MetadataService) MDRetrieve(chain *rpcc.RPCChain, reply *bool) error {
 
-	cmd := "RETRIEVE"
-	HandleLog(cmd, chain)
-
 	args := chain.FirstEntity().Args.(ValArgs)
-	metaArgs := chain.CurrentEntity().Args.(ValMetadata)
 
 	// TODO: check to see if the file needs a secret before forwarding
-	var node NodeInfo
+	var logicalName string
+	var service string
 	var function string
 	//if 'Yes' is provided as the extra optional paramter when client issuing retrieve request
 	//triggers file retrieval from FSA, as 'Yes' indicates client wants secure file access
 	//(alternate strings will also trigger this, as long as secret field is not empty which is default)
 	if args.Secret_info != "" {
 		fmt.Println("RETRIEVE RPCC A:")
-		node = metaArgs.FilestoreMapA[getFirstMapKey(metaArgs.FilestoreMapA)]
-		function = "FARetrieve"
+		logicalName = FileStoreALogicalName
+		service = FileStoreAService
+		function = FileStoreARetrieveEntryFunction
 	} else {
 		fmt.Println("RETRIEVE RPCC B:")
-		node = metaArgs.FilestoreMapB[getFirstMapKey(metaArgs.FilestoreMapB)]
-		function = "FBRetrieve"
+		logicalName = FileStoreBLogicalName
+		service = FileStoreBService
+		function = FileStoreBRetrieveEntryFunction
+	}
+
+	// the frontend names the group owning the file when filestores are split in groups
+	meta, _ := chain.CurrentEntity().Args.(ValMetadata)
+	if args.Secret_info != "" && meta.Shard_A != "" {
+		logicalName = meta.Shard_A
+	} else if args.Secret_info == "" && meta.Shard_B != "" {
+		logicalName = meta.Shard_B
 	}
 
-	chain.AddToChain(node.Addr, node.Service, function, nil, -1)
-	logBuf := GenerateLog(cmd, chain)
-	chain.AddLogToChain(logBuf)
-	chain.CallNext(10000)
+	// the replica is picked from the frontend's maps when the hop is dispatched,
+	// a slow one is hedged with the next replica when RPCC_HEDGE_DELAY is set
+	chain.AddLogicalToChain(logicalName, service, function, nil, -1)
+	chain.HedgeNext(HopTimeout)
 	fmt.Println(chain)
 	fmt.Println()
 
@@ -158,12 +198,6 @@ func (ms *MetadataService) MDRetrieve(chain *rpcc.RPCChain, reply *bool) error {
 /*
 func (ms *MetadataService) MDList(chain *rpcc.RPCChain, reply *bool) error {
 
-	cmd := "LIST"
-	HandleLog(cmd, chain)
-
-	logBuf := GenerateLog(cmd, chain)
-    chain.AddLogToChain(logBuf)
-
     chain.CallNext(10000)
 
     *reply = true
@@ -172,8 +206,11 @@ func (ms *MetadataService) MDList(chain *rpcc.RPCChain, reply *bool) error {
 */
 
 func (ms *MetadataService) StoreValidation(key *ValReply, reply *ValReply) error {
+	mapsMutex.Lock()
+	defer mapsMutex.Unlock()
 
 	if v, ok := ValidationMap[key.Val]; ok {
+		rpcc.UnpackReceive("validated file="+key.Val+" on metadata", key.Log)
 		if v == "A" {
 			FilestoreMapA[key.Val] = v
 			delete(ValidationMap, key.Val)
@@ -193,8 +230,26 @@ func (ms *MetadataService) UpdateConsistency(arg *CacheContent, reply *ValReply)
 	reply.Val = "Replica updated"
 	//fmt.Println(arg)
 	if len(arg.Maps) == 2 {
+		mapsMutex.Lock()
 		FilestoreMapA = arg.Maps[0]
 		FilestoreMapB = arg.Maps[1]
+		mapsMutex.Unlock()
+	}
+	return nil
+}
+
+// take over the maps of a drained node, its entries win
+func (ms *MetadataService) MergeConsistency(arg *CacheContent, reply *ValReply) error {
+	reply.Val = "Replica merged"
+	if len(arg.Maps) == 2 {
+		mapsMutex.Lock()
+		for k, v := range arg.Maps[0] {
+			FilestoreMapA[k] = v
+		}
+		for k, v := range arg.Maps[1] {
+			FilestoreMapB[k] = v
+		}
+		mapsMutex.Unlock()
 	}
 	return nil
 }
@@ -203,34 +258,64 @@ func (ms *MetadataService) UpdateConsistency(arg *CacheContent, reply *ValReply)
 
 func main() {
 
-	Logger = govec.Initialize("metadata", "metadata")
-
 	// parse args
-	usage := fmt.Sprintf("Usage: %s ip:port\n", os.Args[0])
-	if len(os.Args) != 4 {
+	usage := fmt.Sprintf("Usage: %s [config file] [node name]\n", os.Args[0])
+	if len(os.Args) != 3 {
 		fmt.Printf(usage)
 		os.Exit(1)
 	}
 
+	var err error
+	Config, err = config.Load(os.Args[1])
+	checkError(err)
+	node, err := Config.Node(os.Args[2], config.Metadata)
+	checkError(err)
+
+	checkError(rpcc.InitTracer("metadata", Config.Tracer))
+	checkError(rpcc.EnableRecording("metadata", Config.Storage.Records))
+	checkError(rpcc.InitBreakers(Config.Breaker))
+	checkError(rpcc.InitTimeouts(Config.AdaptiveTimeouts))
+	checkError(rpcc.InitHedging(Config.HedgeDelay))
+	HopTimeout = int(Config.Timeouts.Hop.Duration / time.Millisecond)
+	ReportInterval = Config.Timeouts.Report.Duration
+
 	gob.Register(ValArgs{})
 	gob.Register(ValMetadata{})
 	gob.Register(NodeInfo{})
 
-	metadataAddr := os.Args[1]
-	frontendAddr := os.Args[2]
-	replicationFactor, _ := strconv.Atoi(os.Args[3])
-	fmt.Println("metadataAddr:", metadataAddr, " frontendAddr:", frontendAddr, " replicationFactor:", replicationFactor)
+	metadataAddr := node.Listen
+	frontendAddr := Config.ReportAddrs(config.Metadata)
+	fmt.Println("metadataAddr:", metadataAddr, " frontendAddr:", frontendAddr)
 
 	FilestoreMapA = make(map[string]string)
 	FilestoreMapB = make(map[string]string)
 	ValidationMap = make(map[string]string)
 
+	rpcc.RegisterResolver(rpcc.NewRemoteResolver(frontendAddr, "FrontEndMapService.Resolve"))
+
+	// register with the front end for this node's id first, the gossip carries it;
+	// the front ends may not be up or have elected a leader yet
+	NodeUuid = nodeUuid(metadataAddr)
+	for {
+		serviceFE, err := dialFrontEnd(frontendAddr)
+		if err == nil {
+			err = registerToFrontEnd(serviceFE)
+			serviceFE.Close()
+			if err == nil {
+				break
+			}
+		}
+		rpcc.Sleep(ReportInterval)
+	}
+
+	joinGossip(metadataAddr)
 	go initListener(metadataAddr)
 	go printMaps()
 
-	serviceFE, err := rpc.Dial("tcp", frontendAddr)
+	serviceFE, err := dialFrontEnd(frontendAddr)
 	checkError(err)
 	UpdateToFrontEnd(NodeType, NodeService, metadataAddr, serviceFE)
+	serviceFE.Close()
 	//counter:=0
 	for {
 		//counter++
@@ -238,40 +323,27 @@ func main() {
 		//UpdateToFrontEnd(myID, NodeType, NodeService, metadataAddr, serviceFE)
 		//time.Sleep(1000*time.Millisecond)
 
-		//serviceFE, err = rpc.Dial("tcp", frontendAddr)
-		//if err == nil {
-		UpdateToFrontEnd(NodeType, NodeService, metadataAddr, serviceFE)
-		//}
-		time.Sleep(1000 * time.Millisecond)
+		serviceFE, err = dialFrontEnd(frontendAddr)
+		if err == nil {
+			switch UpdateToFrontEnd(NodeType, NodeService, metadataAddr, serviceFE) {
+			case UnregisteredNode:
+				registerToFrontEnd(serviceFE)
+			case DecommissionedNode:
+				fmt.Println("Drained and deregistered by the front end, leaving")
+				Members.Leave()
+				os.Exit(0)
+			}
+			serviceFE.Close()
+		}
+		rpcc.Sleep(ReportInterval)
 	}
 }
 
 //======================================= HELPER FUNCTIONS =======================================
-func GenerateLog(callType string, chain *rpcc.RPCChain) []byte {
-	nextChain := chain.CurrentPosition + 1
-	logMessage := Msg{"Client " + callType + "log.", time.Now().String()}
-	fmt.Println(chain.EntityList[nextChain].Service_info)
-	logBuf := Logger.PrepareSend(callType+" request to "+chain.EntityList[nextChain].Service_info, logMessage)
-	return logBuf
-
-}
-
-func HandleLog(cmd string, chain *rpcc.RPCChain) {
-	logMessage := new(Msg)
-	prevChain := chain.CurrentPosition - 1
-	Logger.UnpackReceive(cmd+" request received from "+chain.EntityList[prevChain].Service_info, chain.Log, &logMessage)
-	fmt.Println(logMessage.String())
-
-}
-
-func (m Msg) String() string {
-	return "content: " + m.Content + "\ntime: " + m.RealTimestamp
-}
-
 // If error is non-nil, print it out and halt.
 func checkError(err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error ", err.Error())
+		fmt.Fprintf(os.Stderr, "Error %s\n", err.Error())
 		os.Exit(1)
 	}
 }
@@ -280,36 +352,68 @@ func checkError(err error) {
 func initListener(address string) {
 	service := new(MetadataService)
 	rpc.Register(service)
+	rpcc.RegisterServices()
 	ln, e := net.Listen("tcp", address)
 	if e != nil {
 		log.Fatal("listen error:", e)
 	} else {
-		go rpc.Accept(ln)
+		go rpcc.Accept(ln)
 	}
 }
 
+// Joins the gossip of the backend nodes through the seeds of the config, alone if there are none
+func joinGossip(address string) {
+	var err error
+	Members, err = gossip.Start(gossip.Config{
+		Addr:    address,
+		Id:      NodeId,
+		Role:    NodeType,
+		Service: NodeService,
+		Seeds:   Config.Seeds,
+	})
+	checkError(err)
+}
+
 func printMaps() {
 	for {
-		fmt.Println("FilestoreMapA:", FilestoreMapA)
-		fmt.Println("FilestoreMapB:", FilestoreMapB)
-		fmt.Println("ValidationMap:", ValidationMap)
+		mapsMutex.Lock()
+		mapA, mapB, validation := copyMap(FilestoreMapA), copyMap(FilestoreMapB), copyMap(ValidationMap)
+		mapsMutex.Unlock()
+
+		fmt.Println("FilestoreMapA:", mapA)
+		fmt.Println("FilestoreMapB:", mapB)
+		fmt.Println("ValidationMap:", validation)
+		fmt.Println("Gossip members:", Members.Members(), "replica set:", Members.Peers(NodeType))
 		fmt.Println()
-		time.Sleep(3000 * time.Millisecond)
+		rpcc.Sleep(3000 * time.Millisecond)
+	}
+}
+
+// Must be called with mapsMutex held, the copy can be read without it
+func copyMap(m map[string]string) map[string]string {
+	copied := make(map[string]string, len(m))
+	for k, v := range m {
+		copied[k] = v
 	}
+	return copied
 }
 
 // send this node's information to front end
-func UpdateToFrontEnd(typeArg int, service string, address string, dialservice *rpc.Client) {
+func UpdateToFrontEnd(typeArg int, service string, address string, dialservice *rpc.Client) string {
 	list := make([]map[string]string, 2)
-	list[0] = FilestoreMapA
-	list[1] = FilestoreMapB
+	mapsMutex.Lock()
+	list[0] = copyMap(FilestoreMapA)
+	list[1] = copyMap(FilestoreMapB)
+	mapsMutex.Unlock()
 
 	node := NodeInfoCache{
-		Id:      0,
+		Id:      NodeId,
 		Type:    typeArg,
 		Addr:    address,
 		Service: service,
 		Maps:    list,
+
+		Open_breakers: rpcc.OpenBreakers(),
 	}
 
 	var kvVal ValReply
@@ -319,6 +423,8 @@ func UpdateToFrontEnd(typeArg int, service string, address string, dialservice *
 	//fmt.Println("ReportServerActivity err:",err)
 	//checkError(err)
 	//fmt.Println("Updated activity status:", node, kvVal.Val)
+
+	return kvVal.Val
 }
 
 //get available map element with the smallest id
@@ -340,3 +446,47 @@ func dialAddr(addr string) (*rpc.Client, error) {
 
 	return service, err
 }
+
+//Dial the first front end of the comma separated list that answers, any of them takes the reports
+func dialFrontEnd(frontendAddrs string) (*rpc.Client, error) {
+	var err error
+	for _, addr := range strings.Split(frontendAddrs, ",") {
+		var service *rpc.Client
+		if service, err = dialAddr(strings.TrimSpace(addr)); err == nil {
+			return service, nil
+		}
+	}
+	return nil, err
+}
+
+//Register with the front end under this node's uuid, keeping the id it had if any
+func registerToFrontEnd(dialservice *rpc.Client) error {
+	args := NodeRegistration{Uuid: NodeUuid, Type: NodeType, Id: NodeId}
+	var reply NodeRegistration
+	if err := dialservice.Call("FrontEndServiceMetadata.Register", args, &reply); err != nil {
+		fmt.Println("Register err:", err)
+		return err
+	}
+
+	NodeId = reply.Id
+	fmt.Println("Registered", NodeUuid, "as node", NodeId)
+	return nil
+}
+
+//The uuid this node keeps across restarts in [service]-[address].uuid of the storage dir, made on its first start
+func nodeUuid(address string) string {
+	path := filepath.Join(Config.Storage.Dir, NodeService+"-"+strings.Replace(address, ":", "-", -1)+".uuid")
+	if content, err := ioutil.ReadFile(path); err == nil && len(strings.TrimSpace(string(content))) > 0 {
+		return strings.TrimSpace(string(content))
+	}
+
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	checkError(err)
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+
+	checkError(ioutil.WriteFile(path, []byte(uuid+"\n"), 0644))
+	return uuid
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"../rpcc"
+	"encoding/gob"
+)
+
+/* === Headers === */
+
+// The args and replies of the services, for the tools that talk to every kind of node at
+// once. The nodes each declare their own in package main, these hold the fields of all of
+// them and gob matches the fields by name.
+
+type ValArgs struct {
+	File_Name    string
+	Text_content string
+	Secret_info  string
+	ErrorCode    int
+	Content_ref  rpcc.PayloadRef // Text_content buffered on the first or target hop
+}
+
+type ValMetadata struct {
+	FilestoreMapA map[int]NodeInfo
+	FilestoreMapB map[int]NodeInfo
+
+	Shard_A string // logical services of the groups owning the file
+	Shard_B string
+}
+
+type ValReply struct {
+	Val string // value; depends on the call
+	Log []byte // causal log of the caller, see rpcc.PrepareSend
+}
+
+type NodeInfo struct {
+	Id      int
+	Type    int
+	Addr    string
+	Service string
+}
+
+type NodeRegistration struct {
+	Uuid string // kept by the node across restarts
+	Type int
+	Id   int
+}
+
+type NodeInfoCache struct {
+	Id      int
+	Type    int
+	Addr    string
+	Service string
+	Entry   string
+	Maps    []map[string]string
+	Group   int // the filestore group the node holds the files of
+
+	Open_breakers []string // addresses this node's hops currently fail fast to
+}
+
+type CacheContent struct {
+	Maps []map[string]string
+}
+
+/* === Functions === */
+// Registers the chain Args with gob under the names the nodes use, so chains decode
+// the same whichever side encoded them
+func Register() {
+	gob.RegisterName("main.ValArgs", ValArgs{})
+	gob.RegisterName("main.ValMetadata", ValMetadata{})
+	gob.RegisterName("main.NodeInfo", NodeInfo{})
+}
@@ -0,0 +1,267 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* === Headers === */
+
+// Serves a registry over HTTP as JSON:
+//
+//	GET  /cluster                   every shard with its nodes, and the chains in flight
+//	GET  /nodes[?role=[role]]       the nodes, of one role if given
+//	GET  /chains                    the chains in flight
+//	POST /nodes/[key]/drain         drain a node, see Drain
+//	POST /nodes/[key]/promote       make a waitlisted node active
+//	POST /nodes/[key]/evict         remove a node as if it died
+//
+// Only the leading front end takes changes, the others answer 409 with the leader.
+type AdminServer struct {
+	Registry *Registry
+	Balancer *Balancer
+	Self     string                         // This front end, as Leader reports it
+	Leader   func() (string, bool)          // The leading front end, nil if this one always leads
+	Drain    func(key string) (Node, error) // Takes a node out gracefully, Registry.Drain if nil
+	Now      func() time.Time               // time.Now if nil
+}
+
+type NodeState struct {
+	Key         string  `json:"key"`
+	Role        string  `json:"role"`
+	Shard       string  `json:"shard"`
+	Group       int     `json:"group"`
+	Id          int     `json:"id"`
+	Addr        string  `json:"addr"`
+	Service     string  `json:"service"`
+	Active      bool    `json:"active"`
+	Primary     bool    `json:"primary"`
+	Draining    bool    `json:"draining"`
+	Health      string  `json:"health"`
+	Phi         float64 `json:"phi"`
+	LastReport  float64 `json:"last_report_seconds"` // Since the node's last heartbeat
+	Picks       int64   `json:"picks"`
+	Outstanding int     `json:"outstanding"`
+	LatencyMs   float64 `json:"latency_ms"`
+}
+
+type ShardState struct {
+	Shard    string      `json:"shard"`
+	Primary  string      `json:"primary"` // Key, "" without active nodes
+	Active   []NodeState `json:"active"`
+	Waitlist []NodeState `json:"waitlist"`
+}
+
+type ChainState struct {
+	Id  string  `json:"id"`
+	Age float64 `json:"age_seconds"`
+}
+
+type ClusterState struct {
+	Leader string       `json:"leader"`
+	Shards []ShardState `json:"shards"`
+	Chains []ChainState `json:"chains"`
+}
+
+type errorReply struct {
+	Error  string `json:"error"`
+	Leader string `json:"leader,omitempty"`
+}
+
+var ErrNotLeader = errors.New("registry: not the leading front end")
+
+/* === Functions === */
+func (s *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cluster", s.get(func(r *http.Request) (interface{}, error) { return s.Cluster(), nil }))
+	mux.HandleFunc("/chains", s.get(func(r *http.Request) (interface{}, error) { return s.Chains(), nil }))
+	mux.HandleFunc("/nodes", s.get(func(r *http.Request) (interface{}, error) { return s.Nodes(r.URL.Query().Get("role")) }))
+	mux.HandleFunc("/nodes/", s.change)
+	return mux
+}
+
+// Serves the API on addr until the listener fails
+func (s *AdminServer) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+func (s *AdminServer) Cluster() ClusterState {
+	leader, _ := s.leader()
+	state := ClusterState{Leader: leader, Shards: make([]ShardState, 0), Chains: s.Chains()}
+	nodes := s.nodes()
+	for _, role := range Roles {
+		for _, shard := range s.Registry.Shards(role) {
+			shardState := ShardState{Shard: shard.String(), Active: make([]NodeState, 0), Waitlist: make([]NodeState, 0)}
+			if primary, ok := s.Registry.Primary(shard); ok {
+				shardState.Primary = primary.Key()
+			}
+			for _, node := range nodes {
+				switch {
+				case node.Shard != shard.String():
+				case node.Active:
+					shardState.Active = append(shardState.Active, node)
+				default:
+					shardState.Waitlist = append(shardState.Waitlist, node)
+				}
+			}
+			state.Shards = append(state.Shards, shardState)
+		}
+	}
+	return state
+}
+
+// The nodes of role, of every role if it's ""
+func (s *AdminServer) Nodes(role string) ([]NodeState, error) {
+	if role == "" {
+		return s.nodes(), nil
+	}
+	if _, ok := ParseRole(role); !ok {
+		return nil, errors.New("registry: unknown role " + role)
+	}
+
+	nodes := make([]NodeState, 0)
+	for _, node := range s.nodes() {
+		if node.Role == role {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+// Oldest first
+func (s *AdminServer) Chains() []ChainState {
+	now := s.now()
+	chains := make([]ChainState, 0)
+	for id, started := range s.Balancer.InFlight(now) {
+		chains = append(chains, ChainState{Id: id, Age: now.Sub(started).Seconds()})
+	}
+	sort.Slice(chains, func(i, j int) bool { return chains[i].Age > chains[j].Age })
+	return chains
+}
+
+/* == Private Functions == */
+func (s *AdminServer) get(state func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			reply(w, http.StatusMethodNotAllowed, errorReply{Error: "registry: " + r.URL.Path + " only takes GET"})
+			return
+		}
+		body, err := state(r)
+		if err != nil {
+			reply(w, http.StatusBadRequest, errorReply{Error: err.Error()})
+			return
+		}
+		reply(w, http.StatusOK, body)
+	}
+}
+
+// POST /nodes/[key]/[drain|promote|evict]
+func (s *AdminServer) change(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/nodes/"), "/")
+	if len(parts) != 2 {
+		reply(w, http.StatusNotFound, errorReply{Error: "registry: no such endpoint " + r.URL.Path})
+		return
+	}
+	if r.Method != http.MethodPost {
+		reply(w, http.StatusMethodNotAllowed, errorReply{Error: "registry: " + r.URL.Path + " only takes POST"})
+		return
+	}
+	if leader, ok := s.leader(); !ok || leader != s.Self {
+		reply(w, http.StatusConflict, errorReply{Error: ErrNotLeader.Error(), Leader: leader})
+		return
+	}
+
+	var change func(string) (Node, error)
+	switch parts[1] {
+	case "drain":
+		change = s.Registry.Drain
+		if s.Drain != nil {
+			change = s.Drain
+		}
+	case "promote":
+		change = s.Registry.Promote
+	case "evict":
+		change = s.Registry.Evict
+	default:
+		reply(w, http.StatusNotFound, errorReply{Error: "registry: unknown action " + parts[1]})
+		return
+	}
+
+	node, err := change(parts[0])
+	switch {
+	case err == ErrUnknownNode:
+		reply(w, http.StatusNotFound, errorReply{Error: err.Error()})
+	case err != nil:
+		reply(w, http.StatusConflict, errorReply{Error: err.Error()})
+	default:
+		reply(w, http.StatusOK, s.state(node, s.now()))
+	}
+}
+
+// Every node, by shard then id
+func (s *AdminServer) nodes() []NodeState {
+	now := s.now()
+	nodes := make([]NodeState, 0)
+	for _, role := range Roles {
+		for _, shard := range s.Registry.Shards(role) {
+			for _, node := range append(nodesOf(s.Registry.Active(shard)), nodesOf(s.Registry.Waitlist(shard))...) {
+				nodes = append(nodes, s.state(node, now))
+			}
+		}
+	}
+	return nodes
+}
+
+func (s *AdminServer) state(node Node, now time.Time) NodeState {
+	state := NodeState{
+		Key:      node.Key(),
+		Role:     node.Role.String(),
+		Shard:    node.Shard().String(),
+		Group:    node.Group,
+		Id:       node.Id,
+		Addr:     node.Addr,
+		Service:  node.Service,
+		Draining: s.Registry.Draining(node.Key()),
+	}
+	_, state.Active = s.Registry.Active(node.Shard())[node.Id]
+	if primary, ok := s.Registry.Primary(node.Shard()); ok {
+		state.Primary = primary.Key() == node.Key()
+	}
+	if status, ok := s.Registry.Statuses(now)[node.Key()]; ok {
+		state.Health = status.Health.String()
+		state.Phi = status.Phi
+		state.LastReport = now.Sub(status.Last).Seconds()
+	}
+	if load, ok := s.Balancer.Loads(now)[node.Addr]; ok {
+		state.Picks = load.Picks
+		state.Outstanding = load.Outstanding
+		state.LatencyMs = float64(load.Latency) / float64(time.Millisecond)
+	}
+	return state
+}
+
+func (s *AdminServer) leader() (string, bool) {
+	if s.Leader == nil {
+		return s.Self, true
+	}
+	return s.Leader()
+}
+
+func (s *AdminServer) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+func reply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(body)
+}
@@ -0,0 +1,278 @@
+package registry
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* === Headers === */
+
+// The load the frontend has sent a node's way
+type Load struct {
+	Picks       int64         // Hops the node was picked or routed first for
+	Outstanding int           // Picked, and the chain hasn't come back yet
+	Latency     time.Duration // Moving average of how long it held the chains it served, 0 until one came back
+}
+
+// Orders the healthy nodes of a shard for a hop, most preferred first, keeping every address
+// so the hop can fall back. Called under the balancer's lock.
+type Policy interface {
+	Name() string
+	Order(shard string, addrs []string, loads map[string]Load) []string
+}
+
+// Spreads hops over the nodes of a role with a policy, counting what each node was given.
+// Outstanding picks and chains count until they come back or TTL passes. Safe for concurrent use.
+type Balancer struct {
+	Policy Policy
+	TTL    time.Duration
+
+	mutex   sync.Mutex
+	nodes   map[string]*nodeLoad // By address
+	started map[string]time.Time // Chain id -> dispatch
+}
+
+type nodeLoad struct {
+	picks   int64
+	pending []time.Time // When the node was picked, oldest first
+	latency time.Duration
+}
+
+// Lowest id first, like chains were routed before balancing
+type primaryPolicy struct{}
+
+// Takes turns over the nodes of each shard
+type roundRobinPolicy struct {
+	next map[string]int // By shard
+}
+
+// Fewest outstanding chains first, fewest picks breaking ties
+type leastOutstandingPolicy struct{}
+
+// Picks at random with weights inverse to the nodes' latencies, nodes not timed yet
+// weigh like the fastest so they get timed
+type latencyPolicy struct {
+	random *rand.Rand
+}
+
+var Policies = []string{"primary", "round-robin", "least-outstanding", "latency"}
+
+// Weight of the newest latency in a node's moving average
+const LatencySmoothing = 0.3
+
+const DefaultBalancerTTL = 30 * time.Second
+
+/* === Functions === */
+func NewBalancer(policy Policy) *Balancer {
+	return &Balancer{
+		Policy:  policy,
+		TTL:     DefaultBalancerTTL,
+		nodes:   make(map[string]*nodeLoad),
+		started: make(map[string]time.Time),
+	}
+}
+
+// One of Policies, "" is round-robin
+func ParsePolicy(name string) (Policy, error) {
+	switch strings.TrimSpace(name) {
+	case "primary":
+		return primaryPolicy{}, nil
+	case "", "round-robin":
+		return &roundRobinPolicy{next: make(map[string]int)}, nil
+	case "least-outstanding":
+		return leastOutstandingPolicy{}, nil
+	case "latency":
+		return &latencyPolicy{random: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	}
+	return nil, fmt.Errorf("registry: unknown balancing policy %q, one of %s", name, strings.Join(Policies, ", "))
+}
+
+// Orders the healthy addresses of the shard with the policy and counts a pick of the first
+// one. Tripped addresses, suspected or behind an open breaker, stay last in their order.
+func (b *Balancer) Pick(shard string, healthy []string, tripped []string, now time.Time) []string {
+	return b.pick(shard, healthy, tripped, true, now)
+}
+
+// Like Pick, but the healthy addresses keep their order, for hops that must go to the primary
+func (b *Balancer) Route(healthy []string, tripped []string, now time.Time) []string {
+	return b.pick("", healthy, tripped, false, now)
+}
+
+// A chain with hops to pick for left the frontend
+func (b *Balancer) Dispatched(chainId string, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.started[chainId] = now
+}
+
+// A dispatched chain came back after its picked hops were served by addrs, each holding
+// the chain for as long as took says, 0 where that isn't known
+func (b *Balancer) Returned(chainId string, addrs []string, took []time.Duration, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.started, chainId)
+	for i, addr := range addrs {
+		node := b.node(addr)
+		if len(node.pending) > 0 {
+			node.pending = node.pending[1:]
+		}
+		if i >= len(took) || took[i] <= 0 {
+			continue
+		}
+
+		if node.latency == 0 {
+			node.latency = took[i]
+		} else {
+			node.latency += time.Duration(LatencySmoothing * float64(took[i]-node.latency))
+		}
+	}
+}
+
+// Every node's load by address, nodes never picked left out
+func (b *Balancer) Loads(now time.Time) map[string]Load {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.expire(now)
+	return b.loads()
+}
+
+// When each dispatched chain not back yet left the frontend, by chain id
+func (b *Balancer) InFlight(now time.Time) map[string]time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.expire(now)
+
+	chains := make(map[string]time.Time, len(b.started))
+	for id, started := range b.started {
+		chains[id] = started
+	}
+	return chains
+}
+
+func (p primaryPolicy) Name() string { return "primary" }
+
+func (p primaryPolicy) Order(shard string, addrs []string, loads map[string]Load) []string {
+	return addrs
+}
+
+func (p *roundRobinPolicy) Name() string { return "round-robin" }
+
+func (p *roundRobinPolicy) Order(shard string, addrs []string, loads map[string]Load) []string {
+	next := p.next[shard] % len(addrs)
+	p.next[shard] = next + 1
+	ordered := append([]string{}, addrs[next:]...)
+	return append(ordered, addrs[:next]...)
+}
+
+func (p leastOutstandingPolicy) Name() string { return "least-outstanding" }
+
+func (p leastOutstandingPolicy) Order(shard string, addrs []string, loads map[string]Load) []string {
+	sort.SliceStable(addrs, func(i, j int) bool {
+		a, b := loads[addrs[i]], loads[addrs[j]]
+		if a.Outstanding != b.Outstanding {
+			return a.Outstanding < b.Outstanding
+		}
+		return a.Picks < b.Picks
+	})
+	return addrs
+}
+
+func (p *latencyPolicy) Name() string { return "latency" }
+
+func (p *latencyPolicy) Order(shard string, addrs []string, loads map[string]Load) []string {
+	fastest := time.Duration(0)
+	for _, addr := range addrs {
+		if l := loads[addr].Latency; l > 0 && (fastest == 0 || l < fastest) {
+			fastest = l
+		}
+	}
+	if fastest == 0 {
+		return addrs
+	}
+
+	weights := make([]float64, len(addrs))
+	total := 0.0
+	for i, addr := range addrs {
+		latency := loads[addr].Latency
+		if latency == 0 {
+			latency = fastest
+		}
+		weights[i] = 1 / latency.Seconds()
+		total += weights[i]
+	}
+
+	first := len(addrs) - 1
+	r := p.random.Float64() * total
+	for i, weight := range weights {
+		if r < weight {
+			first = i
+			break
+		}
+		r -= weight
+	}
+
+	// The rest by latency, to fall back on the fastest
+	rest := append(append([]string{}, addrs[:first]...), addrs[first+1:]...)
+	sort.SliceStable(rest, func(i, j int) bool {
+		return loads[rest[i]].Latency < loads[rest[j]].Latency
+	})
+	return append([]string{addrs[first]}, rest...)
+}
+
+/* == Private Functions == */
+func (b *Balancer) pick(shard string, healthy []string, tripped []string, balanced bool, now time.Time) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.expire(now)
+
+	addrs := append([]string{}, healthy...)
+	if balanced && len(addrs) > 1 {
+		addrs = b.Policy.Order(shard, addrs, b.loads())
+	}
+	addrs = append(addrs, tripped...)
+
+	if len(addrs) > 0 {
+		node := b.node(addrs[0])
+		node.picks++
+		node.pending = append(node.pending, now)
+	}
+	return addrs
+}
+
+// Must be called with the mutex held
+func (b *Balancer) node(addr string) *nodeLoad {
+	node, ok := b.nodes[addr]
+	if !ok {
+		node = &nodeLoad{}
+		b.nodes[addr] = node
+	}
+	return node
+}
+
+// Must be called with the mutex held
+func (b *Balancer) loads() map[string]Load {
+	loads := make(map[string]Load, len(b.nodes))
+	for addr, node := range b.nodes {
+		loads[addr] = Load{Picks: node.picks, Outstanding: len(node.pending), Latency: node.latency}
+	}
+	return loads
+}
+
+// Forgets picks and chains that never came back, must be called with the mutex held
+func (b *Balancer) expire(now time.Time) {
+	for _, node := range b.nodes {
+		for len(node.pending) > 0 && now.Sub(node.pending[0]) > b.TTL {
+			node.pending = node.pending[1:]
+		}
+	}
+	for id, started := range b.started {
+		if now.Sub(started) > b.TTL {
+			delete(b.started, id)
+		}
+	}
+}
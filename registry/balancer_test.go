@@ -0,0 +1,191 @@
+package registry
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBalancerPolicies(t *testing.T) {
+	addrs := []string{"a", "b", "c"}
+	tests := []struct {
+		name   string
+		policy Policy
+		// Each pick is made with the ones before still outstanding
+		picks []string
+	}{
+		{name: "primary", policy: primaryPolicy{}, picks: []string{"a", "a", "a", "a"}},
+		{name: "round-robin", policy: &roundRobinPolicy{next: make(map[string]int)}, picks: []string{"a", "b", "c", "a"}},
+		{name: "least-outstanding", policy: leastOutstandingPolicy{}, picks: []string{"a", "b", "c", "a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewBalancer(test.policy)
+			now := time.Unix(0, 0)
+			for i, expected := range test.picks {
+				ordered := b.Pick("filestoreA/0", addrs, []string{"d"}, now)
+				if ordered[0] != expected {
+					t.Errorf("pick %d went to %s, expected %s", i, ordered[0], expected)
+				}
+				// Every address is kept to fall back on, the tripped one last
+				if len(ordered) != 4 || ordered[3] != "d" {
+					t.Errorf("pick %d ordered %v", i, ordered)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundRobinByShard(t *testing.T) {
+	b := NewBalancer(&roundRobinPolicy{next: make(map[string]int)})
+	now := time.Unix(0, 0)
+
+	// Each shard takes its own turns, whatever the order of its healthy addresses
+	picks := []struct {
+		shard string
+		addrs []string
+		first string
+	}{
+		{"filestoreA/0", []string{"a1", "a2"}, "a1"},
+		{"filestoreB/0", []string{"b1", "b2"}, "b1"},
+		{"filestoreA/0", []string{"a1", "a2"}, "a2"},
+		{"filestoreA/0", []string{"a1"}, "a1"}, // a2 left
+		{"filestoreA/0", []string{"a1", "a3"}, "a1"},
+		{"filestoreB/0", []string{"b1", "b2"}, "b2"},
+	}
+	for i, pick := range picks {
+		if first := b.Pick(pick.shard, pick.addrs, nil, now)[0]; first != pick.first {
+			t.Errorf("pick %d of %s went to %s, expected %s", i, pick.shard, first, pick.first)
+		}
+	}
+
+	if turns := len(b.Policy.(*roundRobinPolicy).next); turns != 2 {
+		t.Errorf("turns kept for %d keys, expected one per shard", turns)
+	}
+}
+
+func TestLatencyPolicy(t *testing.T) {
+	b := NewBalancer(&latencyPolicy{random: rand.New(rand.NewSource(1))})
+	now := time.Unix(0, 0)
+
+	// b held its chains nine times as long as a, c isn't timed yet and weighs like a
+	b.Pick("s", []string{"a"}, nil, now)
+	b.Pick("s", []string{"b"}, nil, now)
+	b.Returned("1", []string{"a", "b"}, []time.Duration{10 * time.Millisecond, 90 * time.Millisecond}, now)
+
+	firsts := make(map[string]int)
+	for i := 0; i < 1900; i++ {
+		ordered := b.Pick("s", []string{"a", "b", "c"}, nil, now)
+		firsts[ordered[0]]++
+		// The fallbacks are by latency
+		if rest := ordered[1:]; ordered[0] == "c" && !reflect.DeepEqual(rest, []string{"a", "b"}) {
+			t.Fatalf("fell back on %v", rest)
+		}
+	}
+	// Weights 100, 11.1 and 100
+	if firsts["a"] < 800 || firsts["c"] < 800 || firsts["b"] < 50 || firsts["b"] > 200 {
+		t.Errorf("picked first %v", firsts)
+	}
+}
+
+func TestBalancerReturned(t *testing.T) {
+	tests := []struct {
+		name    string
+		took    [][]time.Duration // Of a and b, one chain each
+		latency []time.Duration   // Of a and b once they're back
+	}{
+		{
+			name:    "first chain",
+			took:    [][]time.Duration{{10 * time.Millisecond, 20 * time.Millisecond}},
+			latency: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+		},
+		{
+			// Each node is timed on its own hop, not the chain's
+			name: "moving average",
+			took: [][]time.Duration{
+				{10 * time.Millisecond, 40 * time.Millisecond},
+				{20 * time.Millisecond, 40 * time.Millisecond},
+			},
+			latency: []time.Duration{13 * time.Millisecond, 40 * time.Millisecond},
+		},
+		{
+			name: "untimed hop",
+			took: [][]time.Duration{
+				{10 * time.Millisecond, 0},
+				{0, 30 * time.Millisecond},
+			},
+			latency: []time.Duration{10 * time.Millisecond, 30 * time.Millisecond},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewBalancer(primaryPolicy{})
+			now := time.Unix(0, 0)
+			for i, took := range test.took {
+				id := string(rune('0' + i))
+				b.Dispatched(id, now)
+				b.Pick("a", []string{"a"}, nil, now)
+				b.Pick("b", []string{"b"}, nil, now)
+				b.Returned(id, []string{"a", "b"}, took, now.Add(time.Second))
+			}
+
+			loads := b.Loads(now)
+			for i, addr := range []string{"a", "b"} {
+				load := loads[addr]
+				if load.Latency != test.latency[i] || load.Outstanding != 0 || load.Picks != int64(len(test.took)) {
+					t.Errorf("%s: %+v, expected latency %v and nothing outstanding", addr, load, test.latency[i])
+				}
+			}
+			if len(b.InFlight(now)) != 0 {
+				t.Errorf("chains %v still in flight", b.InFlight(now))
+			}
+		})
+	}
+}
+
+func TestBalancerTTL(t *testing.T) {
+	b := NewBalancer(leastOutstandingPolicy{})
+	start := time.Unix(0, 0)
+	b.Dispatched("lost", start)
+	b.Pick("s", []string{"a", "b"}, nil, start)
+	b.Dispatched("late", start.Add(b.TTL/2))
+	b.Pick("s", []string{"a", "b"}, nil, start.Add(b.TTL/2))
+
+	tests := []struct {
+		at          time.Duration
+		outstanding map[string]int
+		inFlight    int
+	}{
+		{at: b.TTL / 2, outstanding: map[string]int{"a": 1, "b": 1}, inFlight: 2},
+		{at: b.TTL, outstanding: map[string]int{"a": 1, "b": 1}, inFlight: 2},
+		// Picks and chains older than the TTL are forgotten, the others kept
+		{at: b.TTL + time.Millisecond, outstanding: map[string]int{"a": 0, "b": 1}, inFlight: 1},
+		{at: b.TTL*3/2 + time.Millisecond, outstanding: map[string]int{"a": 0, "b": 0}, inFlight: 0},
+	}
+	for _, test := range tests {
+		now := start.Add(test.at)
+		loads := b.Loads(now)
+		for addr, outstanding := range test.outstanding {
+			if loads[addr].Outstanding != outstanding {
+				t.Errorf("at %v %s has %d outstanding, expected %d", test.at, addr, loads[addr].Outstanding, outstanding)
+			}
+		}
+		if inFlight := len(b.InFlight(now)); inFlight != test.inFlight {
+			t.Errorf("at %v %d chains in flight, expected %d", test.at, inFlight, test.inFlight)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, name := range append([]string{"", " round-robin "}, Policies...) {
+		if _, err := ParsePolicy(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	if _, err := ParsePolicy("random"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
@@ -0,0 +1,241 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* === Headers === */
+
+// Thresholds of the phi accrual failure detector. Phi is how unlikely the silence since a
+// node's last report is given the intervals between its reports so far: a phi of 3 means a
+// 1 in 1000 chance the node is still there.
+type DetectorConfig struct {
+	Interval   time.Duration // How often nodes report, assumed until they have
+	Pause      time.Duration // Silence tolerated on top of the mean interval
+	MinStdDev  time.Duration // Keeps phi from jumping when reports come like clockwork
+	Window     int           // Intervals kept per node
+	SuspectPhi float64
+	DeadPhi    float64
+	Recoveries int // Reports in a row a suspected node needs to be trusted again
+}
+
+type Health int
+
+const (
+	Alive     Health = iota
+	Suspected        // Late, but its place is kept
+	Dead             // Removed from the registry
+)
+
+// A node's standing with the failure detector
+type Status struct {
+	Health Health
+	Phi    float64
+	Last   time.Time
+}
+
+// Phi accrual failure detector over the reports of each node, by key.
+// Not safe for concurrent use on its own, the registry calls it under its lock.
+type Detector struct {
+	Config DetectorConfig
+	nodes  map[string]*heartbeats
+}
+
+type heartbeats struct {
+	intervals  []time.Duration
+	next       int
+	last       time.Time
+	health     Health
+	recoveries int
+}
+
+// With reports every second like clockwork, a silent node is suspected about 2.3s after its
+// last report and found dead about 2.6s after. Irregular reports widen both.
+var DefaultDetectorConfig = DetectorConfig{
+	Interval:   time.Second,
+	Pause:      time.Second,
+	MinStdDev:  100 * time.Millisecond,
+	Window:     100,
+	SuspectPhi: 3,
+	DeadPhi:    8,
+	Recoveries: 3,
+}
+
+/* === Functions === */
+func NewDetector(config DetectorConfig) *Detector {
+	return &Detector{Config: config, nodes: make(map[string]*heartbeats)}
+}
+
+// Reads a spec like "suspect=3,dead=8,pause=1s,recover=3,interval=1s,stddev=100ms,window=100",
+// unset values keep their defaults
+func ParseDetectorConfig(spec string) (DetectorConfig, error) {
+	config := DefaultDetectorConfig
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return config, fmt.Errorf("registry: bad detector setting %q", field)
+		}
+
+		var err error
+		switch kv[0] {
+		case "suspect":
+			config.SuspectPhi, err = strconv.ParseFloat(kv[1], 64)
+		case "dead":
+			config.DeadPhi, err = strconv.ParseFloat(kv[1], 64)
+		case "pause":
+			config.Pause, err = time.ParseDuration(kv[1])
+		case "recover":
+			config.Recoveries, err = strconv.Atoi(kv[1])
+		case "interval":
+			config.Interval, err = time.ParseDuration(kv[1])
+		case "stddev":
+			config.MinStdDev, err = time.ParseDuration(kv[1])
+		case "window":
+			config.Window, err = strconv.Atoi(kv[1])
+		default:
+			err = errors.New("unknown setting")
+		}
+		if err != nil {
+			return config, fmt.Errorf("registry: bad detector setting %q: %s", field, err.Error())
+		}
+	}
+
+	if config.DeadPhi < config.SuspectPhi || config.Window < 1 {
+		return config, fmt.Errorf("registry: bad detector settings %q", spec)
+	}
+	return config, nil
+}
+
+// Records a report from the node, true if it's trusted again after being suspected
+func (d *Detector) Heartbeat(key string, now time.Time) bool {
+	h, ok := d.nodes[key]
+	if !ok {
+		d.nodes[key] = &heartbeats{last: now, intervals: make([]time.Duration, 0, d.Config.Window)}
+		return false
+	}
+
+	if len(h.intervals) < d.Config.Window {
+		h.intervals = append(h.intervals, now.Sub(h.last))
+	} else {
+		h.intervals[h.next] = now.Sub(h.last)
+		h.next = (h.next + 1) % d.Config.Window
+	}
+	h.last = now
+
+	if h.health != Suspected {
+		return false
+	}
+	h.recoveries++
+	if h.recoveries < d.Config.Recoveries {
+		return false
+	}
+	h.health = Alive
+	h.recoveries = 0
+	return true
+}
+
+// Moves the node to the health its phi calls for, true if it changed. A suspected
+// node only goes back to alive through enough reports in a row.
+func (d *Detector) Check(key string, now time.Time) (Health, bool) {
+	h, ok := d.nodes[key]
+	if !ok {
+		return Dead, false
+	}
+
+	phi := d.phi(h, now)
+	switch {
+	case phi >= d.Config.DeadPhi:
+		changed := h.health != Dead
+		h.health = Dead
+		return Dead, changed
+	case phi >= d.Config.SuspectPhi:
+		// Late again, the recovery starts over
+		h.recoveries = 0
+		if h.health == Alive {
+			h.health = Suspected
+			return Suspected, true
+		}
+	}
+	return h.health, false
+}
+
+func (d *Detector) Status(key string, now time.Time) (Status, bool) {
+	h, ok := d.nodes[key]
+	if !ok {
+		return Status{}, false
+	}
+	return Status{Health: h.health, Phi: d.phi(h, now), Last: h.last}, true
+}
+
+func (d *Detector) Forget(key string) {
+	delete(d.nodes, key)
+}
+
+// Forgets every node but the kept ones
+func (d *Detector) Retain(kept map[string]bool) {
+	for key := range d.nodes {
+		if !kept[key] {
+			delete(d.nodes, key)
+		}
+	}
+}
+
+func (health Health) String() string {
+	switch health {
+	case Alive:
+		return "alive"
+	case Suspected:
+		return "suspected"
+	case Dead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+/* == Private Functions == */
+// -log10 of the chance the next report is still coming, with the intervals taken as normally
+// distributed and the logistic approximation of its CDF
+func (d *Detector) phi(h *heartbeats, now time.Time) float64 {
+	mean, stddev := d.intervalStats(h)
+	mean += d.Config.Pause.Seconds()
+
+	elapsed := now.Sub(h.last).Seconds()
+	y := (elapsed - mean) / stddev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	// Rounding can take it just below 0
+	return math.Max(-math.Log10(1-1/(1+e)), 0)
+}
+
+// Mean and standard deviation of the node's intervals in seconds
+func (d *Detector) intervalStats(h *heartbeats) (float64, float64) {
+	if len(h.intervals) == 0 {
+		return d.Config.Interval.Seconds(), math.Max(d.Config.Interval.Seconds()/4, d.Config.MinStdDev.Seconds())
+	}
+
+	mean := 0.0
+	for _, interval := range h.intervals {
+		mean += interval.Seconds()
+	}
+	mean /= float64(len(h.intervals))
+
+	variance := 0.0
+	for _, interval := range h.intervals {
+		variance += (interval.Seconds() - mean) * (interval.Seconds() - mean)
+	}
+	variance /= float64(len(h.intervals))
+
+	return mean, math.Max(math.Sqrt(variance), d.Config.MinStdDev.Seconds())
+}
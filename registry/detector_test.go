@@ -0,0 +1,152 @@
+package registry
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// A detector with the default thresholds, after the given number of reports a second apart
+func reportEverySecond(reports int) (*Detector, time.Time) {
+	d := NewDetector(DefaultDetectorConfig)
+	last := time.Unix(0, 0)
+	for i := 0; i < reports; i++ {
+		last = time.Unix(int64(i), 0)
+		d.Heartbeat("node", last)
+	}
+	return d, last
+}
+
+func TestDetectorPhi(t *testing.T) {
+	tests := []struct {
+		name    string
+		reports int
+		silence time.Duration
+		phi     float64
+	}{
+		// Like clockwork, the mean interval plus the pause is 2s and the deviation 100ms
+		{name: "on time", reports: 10, silence: time.Second, phi: 0},
+		{name: "at the mean", reports: 10, silence: 2 * time.Second, phi: 0.30},
+		{name: "three deviations late", reports: 10, silence: 2300 * time.Millisecond, phi: 2.91},
+		{name: "six deviations late", reports: 10, silence: 2600 * time.Millisecond, phi: 10.78},
+		// Without intervals the deviation is a quarter of the assumed interval
+		{name: "first report", reports: 1, silence: 2750 * time.Millisecond, phi: 2.91},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, last := reportEverySecond(test.reports)
+			status, ok := d.Status("node", last.Add(test.silence))
+			if !ok {
+				t.Fatal("node unknown to the detector")
+			}
+			if math.Abs(status.Phi-test.phi) > 0.01 {
+				t.Errorf("phi %.3f, expected %.2f", status.Phi, test.phi)
+			}
+		})
+	}
+}
+
+func TestDetectorCheck(t *testing.T) {
+	type check struct {
+		silence time.Duration
+		health  Health
+		changed bool
+	}
+	tests := []struct {
+		name   string
+		checks []check
+	}{
+		{
+			name:   "alive",
+			checks: []check{{time.Second, Alive, false}, {2 * time.Second, Alive, false}},
+		},
+		{
+			name: "suspected then dead",
+			checks: []check{
+				{2400 * time.Millisecond, Suspected, true},
+				{2450 * time.Millisecond, Suspected, false},
+				{3 * time.Second, Dead, true},
+				{4 * time.Second, Dead, false},
+			},
+		},
+		{
+			name:   "dead straight away",
+			checks: []check{{5 * time.Second, Dead, true}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, last := reportEverySecond(10)
+			for _, c := range test.checks {
+				health, changed := d.Check("node", last.Add(c.silence))
+				if health != c.health || changed != c.changed {
+					t.Errorf("after %v: %s (changed %v), expected %s (changed %v)", c.silence, health, changed, c.health, c.changed)
+				}
+			}
+		})
+	}
+
+	d := NewDetector(DefaultDetectorConfig)
+	if health, changed := d.Check("unknown", time.Unix(0, 0)); health != Dead || changed {
+		t.Errorf("unknown node %s (changed %v), expected dead", health, changed)
+	}
+}
+
+func TestDetectorRecovery(t *testing.T) {
+	d, last := reportEverySecond(10)
+	if health, _ := d.Check("node", last.Add(2400*time.Millisecond)); health != Suspected {
+		t.Fatalf("%s, expected suspected", health)
+	}
+
+	// Trusted again on the Recoveries-th report in a row, not before
+	for i := 1; i <= DefaultDetectorConfig.Recoveries; i++ {
+		last = last.Add(time.Second)
+		recovered := d.Heartbeat("node", last)
+		if recovered != (i == DefaultDetectorConfig.Recoveries) {
+			t.Errorf("report %d recovered %v", i, recovered)
+		}
+	}
+	if health, _ := d.Check("node", last); health != Alive {
+		t.Errorf("%s after recovering, expected alive", health)
+	}
+}
+
+func TestParseDetectorConfig(t *testing.T) {
+	tests := []struct {
+		spec   string
+		config DetectorConfig
+		err    bool
+	}{
+		{spec: "", config: DefaultDetectorConfig},
+		{
+			spec: "suspect=2, dead=5,pause=500ms,recover=1,interval=2s,stddev=50ms,window=10",
+			config: DetectorConfig{
+				Interval:   2 * time.Second,
+				Pause:      500 * time.Millisecond,
+				MinStdDev:  50 * time.Millisecond,
+				Window:     10,
+				SuspectPhi: 2,
+				DeadPhi:    5,
+				Recoveries: 1,
+			},
+		},
+		{spec: "suspect", err: true},
+		{spec: "suspect=high", err: true},
+		{spec: "late=1", err: true},
+		{spec: "suspect=9", err: true}, // Above dead
+		{spec: "window=0", err: true},
+	}
+
+	for _, test := range tests {
+		config, err := ParseDetectorConfig(test.spec)
+		if (err != nil) != test.err {
+			t.Errorf("%q: error %v", test.spec, err)
+			continue
+		}
+		if !test.err && config != test.config {
+			t.Errorf("%q: %+v, expected %+v", test.spec, config, test.config)
+		}
+	}
+}
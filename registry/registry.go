@@ -0,0 +1,783 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* === Headers === */
+
+// What a node serves, the values are the node types nodes report themselves with
+type Role int
+
+const (
+	Metadata   Role = 1
+	Auth       Role = 2
+	FilestoreA Role = 3
+	FilestoreB Role = 4
+)
+
+// The nodes of a role holding one part of its data, a role is one shard of group 0 until
+// its nodes are split into groups
+type Shard struct {
+	Role  Role
+	Group int
+}
+
+// A node of the cluster as it reported itself
+type Node struct {
+	Id      int
+	Role    Role
+	Group   int
+	Addr    string
+	Service string
+}
+
+type EventKind int
+
+const (
+	Join       EventKind = iota // A node reported for the first time, active or waitlisted
+	Promote                     // A waitlisted node took the place of an active node that left
+	Leave                       // A node was found dead, it's removed
+	Suspect                     // A node is late reporting, it keeps its place
+	Recover                     // A suspected node reported on time enough to be trusted again
+	Drain                       // A node was taken out of the routing, it keeps its place
+	Demote                      // An active node was moved to the waitlist to make room for a promoted one
+	Deregister                  // A drained node was removed, it's told to stop reporting
+)
+
+// The id a node was given for the uuid it keeps across restarts
+type Registration struct {
+	Uuid    string
+	Role    Role
+	Id      int
+	Retired bool // Deregistered after a drain, until it registers again
+}
+
+// The nodes of a registry, for another registry to take over
+type Snapshot struct {
+	Active        []Node
+	Waitlist      []Node
+	Draining      []string // Keys
+	Registrations []Registration
+}
+
+type Event struct {
+	Kind   EventKind
+	Node   Node
+	Active bool // Whether the node is active after the event
+}
+
+// Called with every change, on the goroutine that made it, once the registry is unlocked
+type Handler func(Event)
+
+// The nodes of the cluster by shard. Up to Replication nodes of a shard are active (Replicas
+// sets it by role), later ones are waitlisted until an active one leaves. Safe for concurrent use.
+type Registry struct {
+	Replication int
+	Replicas    map[Role]int  // Replication of the roles that have their own
+	BreakerTTL  time.Duration // How long a report of an open breaker counts
+
+	mutex    sync.Mutex
+	active   map[Shard]map[int]Node
+	waitlist map[Shard]map[int]Node
+	detector *Detector               // By node key
+	breakers map[string]time.Time    // Address -> last report of a node's breaker to it open
+	draining map[string]bool         // Keys of the nodes no hop is routed to
+	ids      map[string]Registration // By uuid
+	written  map[Shard]time.Time     // Last write chain served by the shard's primary
+	synced   map[string]time.Time    // Node key -> report of the primary whose data the replica last got
+	handlers []Handler
+}
+
+var Roles = []Role{Metadata, Auth, FilestoreA, FilestoreB}
+
+const DefaultBreakerTTL = 3 * time.Second
+
+var ErrUnknownNode = errors.New("registry: unknown node")
+var ErrNotWaitlisted = errors.New("registry: node isn't waitlisted")
+var ErrLastNode = errors.New("registry: no other active node of the shard to route to")
+var ErrNoUuid = errors.New("registry: nodes register with a uuid")
+
+/* === Functions === */
+func New(replication int, config DetectorConfig) *Registry {
+	return &Registry{
+		Replication: replication,
+		BreakerTTL:  DefaultBreakerTTL,
+		active:      make(map[Shard]map[int]Node),
+		waitlist:    make(map[Shard]map[int]Node),
+		detector:    NewDetector(config),
+		breakers:    make(map[string]time.Time),
+		draining:    make(map[string]bool),
+		ids:         make(map[string]Registration),
+		written:     make(map[Shard]time.Time),
+		synced:      make(map[string]time.Time),
+	}
+}
+
+// The role named like the logical service its nodes serve
+func ParseRole(name string) (Role, bool) {
+	for _, role := range Roles {
+		if role.String() == name {
+			return role, true
+		}
+	}
+	return 0, false
+}
+
+// The shard named like the logical service of its group, "[role]" for group 0 and "[role]/[group]"
+func ParseShard(name string) (Shard, bool) {
+	roleName, groupName := name, ""
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		roleName, groupName = name[:i], name[i+1:]
+	}
+
+	role, ok := ParseRole(roleName)
+	if !ok {
+		return Shard{}, false
+	}
+	if groupName == "" {
+		return Shard{Role: role}, true
+	}
+
+	group, err := strconv.Atoi(groupName)
+	if err != nil || group < 0 {
+		return Shard{}, false
+	}
+	return Shard{Role: role, Group: group}, true
+}
+
+func (role Role) String() string {
+	switch role {
+	case Metadata:
+		return "metadata"
+	case Auth:
+		return "auth"
+	case FilestoreA:
+		return "filestoreA"
+	case FilestoreB:
+		return "filestoreB"
+	}
+	return "role" + strconv.Itoa(int(role))
+}
+
+func (shard Shard) String() string {
+	if shard.Group == 0 {
+		return shard.Role.String()
+	}
+	return shard.Role.String() + "/" + strconv.Itoa(shard.Group)
+}
+
+func (kind EventKind) String() string {
+	switch kind {
+	case Join:
+		return "join"
+	case Promote:
+		return "promote"
+	case Leave:
+		return "leave"
+	case Suspect:
+		return "suspect"
+	case Recover:
+		return "recover"
+	case Drain:
+		return "drain"
+	case Demote:
+		return "demote"
+	case Deregister:
+		return "deregister"
+	}
+	return "unknown"
+}
+
+// "[role]-[group]-[id]", unique among the nodes of the cluster
+func (node Node) Key() string {
+	return strconv.Itoa(int(node.Role)) + "-" + strconv.Itoa(node.Group) + "-" + strconv.Itoa(node.Id)
+}
+
+func (node Node) Shard() Shard {
+	return Shard{Role: node.Role, Group: node.Group}
+}
+
+func (r *Registry) Subscribe(handler Handler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.handlers = append(r.handlers, handler)
+}
+
+// Gives the node with uuid an id among the nodes of role, the same one whenever it registers
+// again. A node new to the registry keeps previous if no other node of role has it, and gets
+// the lowest free id otherwise. Ids aren't given back, a node that left keeps its id.
+func (r *Registry) Register(uuid string, role Role, previous int) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if uuid == "" {
+		return 0, ErrNoUuid
+	}
+	if registration, ok := r.ids[uuid]; ok {
+		if registration.Role != role {
+			return 0, fmt.Errorf("registry: node %s registered as %s", uuid, registration.Role)
+		}
+		registration.Retired = false
+		r.ids[uuid] = registration
+		return registration.Id, nil
+	}
+
+	taken := make(map[int]bool)
+	for _, registration := range r.ids {
+		if registration.Role == role {
+			taken[registration.Id] = true
+		}
+	}
+	id := previous
+	if id < 0 || taken[id] {
+		for id = 0; taken[id]; id++ {
+		}
+	}
+	r.ids[uuid] = Registration{Uuid: uuid, Role: role, Id: id}
+	return id, nil
+}
+
+// Whether id was given to a node of role
+func (r *Registry) Registered(role Role, id int) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, registration := range r.ids {
+		if registration.Role == role && registration.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the node of role with id was deregistered and hasn't registered since
+func (r *Registry) Retired(role Role, id int) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, registration := range r.ids {
+		if registration.Role == role && registration.Id == id {
+			return registration.Retired
+		}
+	}
+	return false
+}
+
+// Records a node's report along with the addresses its breakers are open to,
+// a node reporting for the first time joins. Returns whether the node is active.
+func (r *Registry) Report(node Node, openBreakers []string, now time.Time) bool {
+	r.mutex.Lock()
+
+	events := make([]Event, 0)
+	active, waitlist := r.nodesIn(node.Shard())
+	_, isActive := active[node.Id]
+	_, isWaiting := waitlist[node.Id]
+	switch {
+	case isActive:
+		active[node.Id] = node
+	case isWaiting:
+		waitlist[node.Id] = node
+	case len(active) < r.replicationOf(node.Role) && len(waitlist) == 0:
+		active[node.Id] = node
+		isActive = true
+		events = append(events, Event{Kind: Join, Node: node, Active: true})
+	default:
+		waitlist[node.Id] = node
+		events = append(events, Event{Kind: Join, Node: node})
+	}
+
+	if r.detector.Heartbeat(node.Key(), now) {
+		events = append(events, Event{Kind: Recover, Node: node, Active: isActive})
+	}
+	for _, addr := range openBreakers {
+		r.breakers[addr] = now
+	}
+
+	r.mutex.Unlock()
+	r.publish(events)
+	return isActive
+}
+
+// Runs the failure detector over every node. Dead nodes are removed, the waitlisted
+// node of the shard with the lowest id takes the place of an active one.
+func (r *Registry) Check(now time.Time) {
+	r.mutex.Lock()
+
+	events := make([]Event, 0)
+	for _, shard := range r.shards() {
+		active, waitlist := r.active[shard], r.waitlist[shard]
+		for _, node := range append(nodesOf(active), nodesOf(waitlist)...) {
+			_, isActive := active[node.Id]
+			health, changed := r.detector.Check(node.Key(), now)
+			if health == Suspected && changed {
+				events = append(events, Event{Kind: Suspect, Node: node, Active: isActive})
+			}
+			if health == Dead {
+				events = append(events, r.remove(node)...)
+			}
+		}
+	}
+
+	r.mutex.Unlock()
+	r.publish(events)
+}
+
+// Stops routing hops to the node with key, it keeps reporting and its place until it leaves.
+// An active node is only drained while another active node of its shard takes the hops.
+func (r *Registry) Drain(key string) (Node, error) {
+	r.mutex.Lock()
+
+	node, isActive, ok := r.find(key)
+	if !ok {
+		r.mutex.Unlock()
+		return Node{}, ErrUnknownNode
+	}
+	if isActive && !r.draining[key] && r.routable(node.Shard()) < 2 {
+		r.mutex.Unlock()
+		return Node{}, ErrLastNode
+	}
+	events := make([]Event, 0)
+	if !r.draining[key] {
+		r.draining[key] = true
+		events = append(events, Event{Kind: Drain, Node: node, Active: isActive})
+	}
+
+	r.mutex.Unlock()
+	r.publish(events)
+	return node, nil
+}
+
+// Makes the waitlisted node with key active. When its shard is full, the active node
+// with the highest id makes room and is waitlisted.
+func (r *Registry) Promote(key string) (Node, error) {
+	r.mutex.Lock()
+
+	node, isActive, ok := r.find(key)
+	if !ok || isActive {
+		r.mutex.Unlock()
+		if !ok {
+			return Node{}, ErrUnknownNode
+		}
+		return Node{}, ErrNotWaitlisted
+	}
+
+	events := make([]Event, 0)
+	active, waitlist := r.nodesIn(node.Shard())
+	if nodes := nodesOf(active); len(nodes) >= r.replicationOf(node.Role) && len(nodes) > 0 {
+		last := nodes[len(nodes)-1]
+		delete(active, last.Id)
+		waitlist[last.Id] = last
+		events = append(events, Event{Kind: Demote, Node: last})
+	}
+	delete(waitlist, node.Id)
+	active[node.Id] = node
+	events = append(events, Event{Kind: Promote, Node: node, Active: true})
+
+	r.mutex.Unlock()
+	r.publish(events)
+	return node, nil
+}
+
+// Removes the node with key as if it was found dead. It joins again if it keeps reporting.
+func (r *Registry) Evict(key string) (Node, error) {
+	r.mutex.Lock()
+
+	node, _, ok := r.find(key)
+	if !ok {
+		r.mutex.Unlock()
+		return Node{}, ErrUnknownNode
+	}
+	events := r.remove(node)
+
+	r.mutex.Unlock()
+	r.publish(events)
+	return node, nil
+}
+
+// The node taking over the data of the active node with key when it's drained: the active node
+// of its shard with the lowest id, or else the first waitlisted one, made active next to it.
+// False for a waitlisted node, it has no data to hand over.
+func (r *Registry) Successor(key string) (Node, bool, error) {
+	r.mutex.Lock()
+
+	node, isActive, ok := r.find(key)
+	if !ok || !isActive {
+		r.mutex.Unlock()
+		if !ok {
+			return Node{}, false, ErrUnknownNode
+		}
+		return Node{}, false, nil
+	}
+
+	active, waitlist := r.nodesIn(node.Shard())
+	for _, other := range nodesOf(active) {
+		if other.Id != node.Id && !r.draining[other.Key()] {
+			r.mutex.Unlock()
+			return other, true, nil
+		}
+	}
+	next := nodesOf(waitlist)
+	if len(next) == 0 {
+		r.mutex.Unlock()
+		return Node{}, false, ErrLastNode
+	}
+	delete(waitlist, next[0].Id)
+	active[next[0].Id] = next[0]
+
+	r.mutex.Unlock()
+	r.publish([]Event{{Kind: Promote, Node: next[0], Active: true}})
+	return next[0], true, nil
+}
+
+// Removes the node with key for good, it's retired until it registers again
+func (r *Registry) Deregister(key string) (Node, error) {
+	r.mutex.Lock()
+
+	node, _, ok := r.find(key)
+	if !ok {
+		r.mutex.Unlock()
+		return Node{}, ErrUnknownNode
+	}
+	events := r.remove(node)
+	events[0].Kind = Deregister
+	for uuid, registration := range r.ids {
+		if registration.Role == node.Role && registration.Id == node.Id {
+			registration.Retired = true
+			r.ids[uuid] = registration
+		}
+	}
+
+	r.mutex.Unlock()
+	r.publish(events)
+	return node, nil
+}
+
+func (r *Registry) Draining(key string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.draining[key]
+}
+
+// The shards of role with nodes, by group
+func (r *Registry) Shards(role Role) []Shard {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	shards := make([]Shard, 0)
+	for _, shard := range r.shards() {
+		if shard.Role == role {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+// The active nodes of shard by id, a copy
+func (r *Registry) Active(shard Shard) map[int]Node {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return copyNodes(r.active[shard])
+}
+
+// The waitlisted nodes of shard by id, a copy
+func (r *Registry) Waitlist(shard Shard) map[int]Node {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return copyNodes(r.waitlist[shard])
+}
+
+// The active node of shard with the lowest id that isn't draining
+func (r *Registry) Primary(shard Shard) (Node, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.primary(shard)
+}
+
+// Addresses of the active nodes of shard, lowest id first, draining nodes left out. Suspected nodes,
+// and nodes some node reported an open breaker to within BreakerTTL, go last in case every one is.
+func (r *Registry) Live(shard Shard, now time.Time) []string {
+	addrs, tripped := r.Healthy(shard, now)
+	return append(addrs, tripped...)
+}
+
+// The addresses Live orders, split into the healthy ones and the tripped ones
+func (r *Registry) Healthy(shard Shard, now time.Time) ([]string, []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	addrs := make([]string, 0)
+	tripped := make([]string, 0)
+	for _, node := range nodesOf(r.active[shard]) {
+		status, ok := r.detector.Status(node.Key(), now)
+		if !ok || status.Health == Dead || r.draining[node.Key()] {
+			continue
+		}
+		if reported, ok := r.breakers[node.Addr]; status.Health == Suspected || ok && now.Sub(reported) <= r.BreakerTTL {
+			tripped = append(tripped, node.Addr)
+		} else {
+			addrs = append(addrs, node.Addr)
+		}
+	}
+	return addrs, tripped
+}
+
+// A write chain came back after the nodes at addrs served it, the replicas of their shards
+// lag behind until they get the data of a later report of the primary
+func (r *Registry) Wrote(addrs []string, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	served := make(map[string]bool)
+	for _, addr := range addrs {
+		served[addr] = true
+	}
+	for _, shard := range r.shards() {
+		for _, node := range r.active[shard] {
+			if served[node.Addr] {
+				r.written[shard] = now
+			}
+		}
+	}
+}
+
+// The replica node got the data its primary reported at reported
+func (r *Registry) Synced(node Node, reported time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.synced[node.Key()] = reported
+}
+
+// Splits addrs of shard into the ones holding its last write, the primary and the replicas
+// synced since, and the ones lagging behind
+func (r *Registry) Current(shard Shard, addrs []string) ([]string, []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	primary, _ := r.primary(shard)
+	written, ok := r.written[shard]
+	current := make([]string, 0, len(addrs))
+	lagging := make([]string, 0)
+	for _, addr := range addrs {
+		fresh := !ok
+		for _, node := range r.active[shard] {
+			if node.Addr == addr && (node.Key() == primary.Key() || r.synced[node.Key()].After(written)) {
+				fresh = true
+			}
+		}
+		if fresh {
+			current = append(current, addr)
+		} else {
+			lagging = append(lagging, addr)
+		}
+	}
+	return current, lagging
+}
+
+func (r *Registry) Snapshot() Snapshot {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	snapshot := Snapshot{Active: make([]Node, 0), Waitlist: make([]Node, 0), Draining: make([]string, 0), Registrations: make([]Registration, 0)}
+	for _, shard := range r.shards() {
+		snapshot.Active = append(snapshot.Active, nodesOf(r.active[shard])...)
+		snapshot.Waitlist = append(snapshot.Waitlist, nodesOf(r.waitlist[shard])...)
+	}
+	for key := range r.draining {
+		snapshot.Draining = append(snapshot.Draining, key)
+	}
+	sort.Strings(snapshot.Draining)
+	for _, registration := range r.ids {
+		snapshot.Registrations = append(snapshot.Registrations, registration)
+	}
+	return snapshot
+}
+
+// Replaces the nodes with a snapshot's, without events. The snapshot counts as a report of
+// each of its nodes, nodes left out are forgotten.
+func (r *Registry) Restore(snapshot Snapshot, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.active = make(map[Shard]map[int]Node)
+	r.waitlist = make(map[Shard]map[int]Node)
+	kept := make(map[string]bool)
+	for _, node := range snapshot.Active {
+		active, _ := r.nodesIn(node.Shard())
+		active[node.Id] = node
+		kept[node.Key()] = true
+		r.detector.Heartbeat(node.Key(), now)
+	}
+	for _, node := range snapshot.Waitlist {
+		_, waitlist := r.nodesIn(node.Shard())
+		waitlist[node.Id] = node
+		kept[node.Key()] = true
+		r.detector.Heartbeat(node.Key(), now)
+	}
+	r.detector.Retain(kept)
+
+	r.draining = make(map[string]bool)
+	for _, key := range snapshot.Draining {
+		r.draining[key] = kept[key]
+	}
+	r.written = make(map[Shard]time.Time)
+	r.synced = make(map[string]time.Time)
+	r.ids = make(map[string]Registration)
+	for _, registration := range snapshot.Registrations {
+		r.ids[registration.Uuid] = registration
+	}
+}
+
+// Each node's standing with the failure detector, by key
+func (r *Registry) Statuses(now time.Time) map[string]Status {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	statuses := make(map[string]Status)
+	for _, shard := range r.shards() {
+		for _, node := range append(nodesOf(r.active[shard]), nodesOf(r.waitlist[shard])...) {
+			if status, ok := r.detector.Status(node.Key(), now); ok {
+				statuses[node.Key()] = status
+			}
+		}
+	}
+	return statuses
+}
+
+/* == Private Functions == */
+func (r *Registry) replicationOf(role Role) int {
+	if replication, ok := r.Replicas[role]; ok {
+		return replication
+	}
+	return r.Replication
+}
+
+func (r *Registry) publish(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	r.mutex.Lock()
+	handlers := append([]Handler{}, r.handlers...)
+	r.mutex.Unlock()
+
+	for _, event := range events {
+		for _, handler := range handlers {
+			handler(event)
+		}
+	}
+}
+
+// Takes node out of its shard, the waitlisted node with the lowest id taking its place
+// if it was active. Must be called with the mutex held.
+func (r *Registry) remove(node Node) []Event {
+	shard := node.Shard()
+	active, waitlist := r.active[shard], r.waitlist[shard]
+	r.detector.Forget(node.Key())
+	delete(r.draining, node.Key())
+	delete(r.synced, node.Key())
+
+	events := []Event{{Kind: Leave, Node: node}}
+	if _, isActive := active[node.Id]; !isActive {
+		delete(waitlist, node.Id)
+	} else {
+		delete(active, node.Id)
+		if next := nodesOf(waitlist); len(next) > 0 {
+			delete(waitlist, next[0].Id)
+			active[next[0].Id] = next[0]
+			events = append(events, Event{Kind: Promote, Node: next[0], Active: true})
+		}
+	}
+
+	if len(active) == 0 && len(waitlist) == 0 {
+		delete(r.active, shard)
+		delete(r.waitlist, shard)
+	}
+	return events
+}
+
+// The active node of shard with the lowest id that isn't draining. Must be called with the mutex held.
+func (r *Registry) primary(shard Shard) (Node, bool) {
+	for _, node := range nodesOf(r.active[shard]) {
+		if !r.draining[node.Key()] {
+			return node, true
+		}
+	}
+	return Node{}, false
+}
+
+// Active nodes of shard that aren't draining. Must be called with the mutex held.
+func (r *Registry) routable(shard Shard) int {
+	count := 0
+	for _, node := range r.active[shard] {
+		if !r.draining[node.Key()] {
+			count++
+		}
+	}
+	return count
+}
+
+// The node with key, whether it's active and whether there is one. Must be called with the mutex held.
+func (r *Registry) find(key string) (Node, bool, bool) {
+	for _, shard := range r.shards() {
+		for _, node := range r.active[shard] {
+			if node.Key() == key {
+				return node, true, true
+			}
+		}
+		for _, node := range r.waitlist[shard] {
+			if node.Key() == key {
+				return node, false, true
+			}
+		}
+	}
+	return Node{}, false, false
+}
+
+// Every shard with nodes, by role then group. Must be called with the mutex held.
+func (r *Registry) shards() []Shard {
+	shards := make([]Shard, 0, len(r.active))
+	for shard := range r.active {
+		shards = append(shards, shard)
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		if shards[i].Role != shards[j].Role {
+			return shards[i].Role < shards[j].Role
+		}
+		return shards[i].Group < shards[j].Group
+	})
+	return shards
+}
+
+// The active and waitlisted nodes of shard, made on its first node. Must be called with the mutex held.
+func (r *Registry) nodesIn(shard Shard) (map[int]Node, map[int]Node) {
+	if _, ok := r.active[shard]; !ok {
+		r.active[shard] = make(map[int]Node)
+		r.waitlist[shard] = make(map[int]Node)
+	}
+	return r.active[shard], r.waitlist[shard]
+}
+
+// Sorted by id
+func nodesOf(nodes map[int]Node) []Node {
+	sorted := make([]Node, 0, len(nodes))
+	for _, node := range nodes {
+		sorted = append(sorted, node)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Id < sorted[j].Id })
+	return sorted
+}
+
+func copyNodes(nodes map[int]Node) map[int]Node {
+	copied := make(map[int]Node, len(nodes))
+	for id, node := range nodes {
+		copied[id] = node
+	}
+	return copied
+}
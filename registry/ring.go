@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+/* === Headers === */
+
+// Consistent hashing of keys over the groups of a role. Every group is hashed to
+// VirtualNodes points of the ring, a key belongs to the group of the first point
+// after its hash, so a group joining or leaving only moves the keys of its points.
+// Safe for concurrent use.
+type Ring struct {
+	VirtualNodes int
+
+	mutex  sync.Mutex
+	groups []int
+	points []point // By hash
+}
+
+type point struct {
+	hash  uint32
+	group int
+}
+
+const DefaultVirtualNodes = 128
+
+/* === Functions === */
+func NewRing(virtualNodes int) *Ring {
+	if virtualNodes < 1 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &Ring{VirtualNodes: virtualNodes}
+}
+
+// Makes the groups on the ring exactly groups, true if they changed
+func (r *Ring) Set(groups []int) bool {
+	sorted := append([]int{}, groups...)
+	sort.Ints(sorted)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if equalGroups(sorted, r.groups) {
+		return false
+	}
+
+	r.groups = sorted
+	r.points = make([]point, 0, len(sorted)*r.VirtualNodes)
+	for _, group := range sorted {
+		for i := 0; i < r.VirtualNodes; i++ {
+			r.points = append(r.points, point{hash: hash(strconv.Itoa(group) + "#" + strconv.Itoa(i)), group: group})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].group < r.points[j].group
+	})
+	return true
+}
+
+// The group owning key, false if the ring is empty
+func (r *Ring) Owner(key string) (int, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.points) == 0 {
+		return 0, false
+	}
+
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].group, true
+}
+
+func (r *Ring) Groups() []int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]int{}, r.groups...)
+}
+
+/* == Private Functions == */
+// FNV-1a, then murmur3's finalizer so keys differing in a digit spread over the ring
+func hash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+func equalGroups(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
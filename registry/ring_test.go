@@ -0,0 +1,98 @@
+package registry
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRingOwner(t *testing.T) {
+	r := NewRing(0)
+	if _, ok := r.Owner("a.txt"); ok {
+		t.Error("an empty ring owns a key")
+	}
+
+	if !r.Set([]int{2, 0, 1}) {
+		t.Error("setting the first groups didn't change the ring")
+	}
+	if r.Set([]int{0, 1, 2}) {
+		t.Error("setting the same groups in another order changed the ring")
+	}
+
+	// Keys spread over every group, the same key always to the same one
+	owned := make(map[int]int)
+	for i := 0; i < 3000; i++ {
+		key := "file-" + strconv.Itoa(i) + ".txt"
+		group, ok := r.Owner(key)
+		if !ok {
+			t.Fatalf("no owner of %s", key)
+		}
+		if again, _ := r.Owner(key); again != group {
+			t.Fatalf("%s owned by %d then %d", key, group, again)
+		}
+		owned[group]++
+	}
+	for _, group := range []int{0, 1, 2} {
+		if owned[group] < 700 || owned[group] > 1300 {
+			t.Errorf("group %d owns %d of 3000 keys", group, owned[group])
+		}
+	}
+}
+
+func TestRingSet(t *testing.T) {
+	tests := []struct {
+		name  string
+		from  []int
+		to    []int
+		moved float64 // Share of the keys expected to move, give or take a third
+	}{
+		{name: "group joins", from: []int{0, 1, 2}, to: []int{0, 1, 2, 3}, moved: 0.25},
+		{name: "group leaves", from: []int{0, 1, 2, 3}, to: []int{0, 1, 3}, moved: 0.25},
+		{name: "two groups join", from: []int{0, 1}, to: []int{0, 1, 2, 3}, moved: 0.5},
+		{name: "unchanged", from: []int{0, 1}, to: []int{1, 0}, moved: 0},
+	}
+
+	const keys = 4000
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewRing(0)
+			r.Set(test.from)
+			before := make([]int, keys)
+			for i := range before {
+				before[i], _ = r.Owner("file-" + strconv.Itoa(i))
+			}
+
+			r.Set(test.to)
+			joined := groupSet(test.to, test.from)
+			left := groupSet(test.from, test.to)
+			moved := 0
+			for i, was := range before {
+				now, _ := r.Owner("file-" + strconv.Itoa(i))
+				if now == was {
+					continue
+				}
+				// Keys only move off the groups that left or onto the ones that joined
+				if !left[was] && !joined[now] {
+					t.Fatalf("file-%d moved from %d to %d", i, was, now)
+				}
+				moved++
+			}
+
+			share := float64(moved) / keys
+			if share < test.moved*2/3 || share > test.moved*4/3 {
+				t.Errorf("%.2f of the keys moved, expected about %.2f", share, test.moved)
+			}
+		})
+	}
+}
+
+// The groups of a that aren't in b
+func groupSet(a []int, b []int) map[int]bool {
+	set := make(map[int]bool)
+	for _, group := range a {
+		set[group] = true
+	}
+	for _, group := range b {
+		delete(set, group)
+	}
+	return set
+}
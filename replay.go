@@ -0,0 +1,202 @@
+// Usage: go run replay.go [record file] [service ip:port] [stub ip:port]
+//
+// - [record file] : a chain recorded by a node started with RPCC_RECORD_DIR set.
+// - [service ip:port] : the ip and TCP port of the single service under test, started locally.
+// - [stub ip:port] : the ip and TCP port on which the stubbed neighbors listen. Start the
+//   service under test with RPCC_REPORT_TO set to this address.
+//
+package main
+
+import (
+	"./protocol"
+	"./rpcc"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+)
+
+//======================================= SERVICE =======================================
+// Stands in for every neighbor of the service under test
+type StubService int
+
+//======================================= VARIABLES =======================================
+// Services the nodes talk to outside of chains
+var StubServiceNames = []string{
+	"FrontEndServiceClient",
+	"FrontEndServiceMetadata",
+	"FrontEndServiceAuth",
+	"FrontEndServiceFilestoreA",
+	"FrontEndServiceFilestoreB",
+	"FrontEndMapService",
+	"MetadataService",
+	"AuthService",
+	"FilestoreServiceA",
+	"FilestoreServiceB",
+	"ClientService",
+}
+
+var stubAddr string
+
+// ids handed out to the nodes registering with the stub, by uuid
+var stubIds = make(map[string]int)
+var stubIdsMutex sync.Mutex
+
+//======================================= SERVICE METHODS =======================================
+func (ss *StubService) FStore(chain *rpcc.RPCChain, reply *bool) error     { return stubHop(chain, reply) }
+func (ss *StubService) FRetrieve(chain *rpcc.RPCChain, reply *bool) error  { return stubHop(chain, reply) }
+func (ss *StubService) FList(chain *rpcc.RPCChain, reply *bool) error      { return stubHop(chain, reply) }
+func (ss *StubService) MDStore(chain *rpcc.RPCChain, reply *bool) error    { return stubHop(chain, reply) }
+func (ss *StubService) MDRetrieve(chain *rpcc.RPCChain, reply *bool) error { return stubHop(chain, reply) }
+func (ss *StubService) AStore(chain *rpcc.RPCChain, reply *bool) error     { return stubHop(chain, reply) }
+func (ss *StubService) FAStore(chain *rpcc.RPCChain, reply *bool) error    { return stubHop(chain, reply) }
+func (ss *StubService) FARetrieve(chain *rpcc.RPCChain, reply *bool) error { return stubHop(chain, reply) }
+func (ss *StubService) FAList(chain *rpcc.RPCChain, reply *bool) error     { return stubHop(chain, reply) }
+func (ss *StubService) FBStore(chain *rpcc.RPCChain, reply *bool) error    { return stubHop(chain, reply) }
+func (ss *StubService) FBRetrieve(chain *rpcc.RPCChain, reply *bool) error { return stubHop(chain, reply) }
+func (ss *StubService) FBList(chain *rpcc.RPCChain, reply *bool) error     { return stubHop(chain, reply) }
+func (ss *StubService) CStore(chain *rpcc.RPCChain, reply *bool) error     { return stubHop(chain, reply) }
+func (ss *StubService) CRetrieve(chain *rpcc.RPCChain, reply *bool) error  { return stubHop(chain, reply) }
+func (ss *StubService) CList(chain *rpcc.RPCChain, reply *bool) error      { return stubHop(chain, reply) }
+
+func (ss *StubService) StoreValidation(key *protocol.ValReply, reply *protocol.ValReply) error {
+	fmt.Println("STUB StoreValidation:", key.Val)
+	reply.Val = "Validated by stub"
+	return nil
+}
+
+func (ss *StubService) UpdateConsistency(arg *protocol.CacheContent, reply *protocol.ValReply) error {
+	reply.Val = "Replica updated by stub"
+	return nil
+}
+
+func (ss *StubService) ReportServerActivity(args *protocol.NodeInfoCache, reply *protocol.ValReply) error {
+	reply.Val = "Node info recorded by stub"
+	return nil
+}
+
+// the service under test registers before it listens, it keeps the id it asks for
+func (ss *StubService) Register(args *protocol.NodeRegistration, reply *protocol.NodeRegistration) error {
+	stubIdsMutex.Lock()
+	defer stubIdsMutex.Unlock()
+
+	id, ok := stubIds[args.Uuid]
+	if !ok {
+		id = args.Id
+		if id < 0 {
+			id = len(stubIds)
+		}
+		stubIds[args.Uuid] = id
+	}
+	*reply = protocol.NodeRegistration{Uuid: args.Uuid, Type: args.Type, Id: id}
+	fmt.Println("STUB Register:", args.Uuid, "as node", id)
+	return nil
+}
+
+// every logical service is served by the stub
+func (ss *StubService) Resolve(args *rpcc.ResolveArgs, reply *rpcc.ResolveReply) error {
+	reply.Addrs = []string{stubAddr}
+	return nil
+}
+
+//======================================= MAIN =======================================
+
+func main() {
+
+	// parse args
+	usage := fmt.Sprintf("Usage: %s [record file] [service ip:port] [stub ip:port]\n", os.Args[0])
+	if len(os.Args) != 4 {
+		fmt.Print(usage)
+		os.Exit(1)
+	}
+
+	protocol.Register()
+
+	recordFile := os.Args[1]
+	serviceAddr := os.Args[2]
+	stubAddr = os.Args[3]
+
+	record, err := rpcc.LoadRecord(recordFile)
+	checkError(err)
+
+	chain := record.Chain
+	target := chain.CurrentEntity()
+	fmt.Println("Replaying chain", chain.Id, "recorded on", record.Node, "at", record.Received)
+	fmt.Println("Position:", chain.CurrentPosition, "IsReturnCall:", chain.IsReturnCall, "Entry:", target.Service_info+"."+target.Entry)
+	if record.Sent {
+		fmt.Println("Recorded by the sender, the hop never reached", target.Connection_info)
+	}
+
+	initStubListener(stubAddr, target.Service_info)
+
+	// Point the hop under test at the local service and every neighbor at the stub
+	for i := range chain.EntityList {
+		if i == chain.CurrentPosition {
+			chain.EntityList[i].Connection_info = serviceAddr
+		} else {
+			chain.EntityList[i].Connection_info = stubAddr
+		}
+	}
+
+	service, err := dialService(serviceAddr)
+	checkError(err)
+	defer service.Close()
+
+	var reply bool
+	err = service.Call(target.Service_info+"."+target.Entry, &chain, &reply)
+	checkError(err)
+
+	fmt.Println("Replayed hop returned:", reply)
+}
+
+//======================================= HELPER FUNCTIONS =======================================
+func stubHop(chain *rpcc.RPCChain, reply *bool) error {
+	entity := chain.CurrentEntity()
+	fmt.Println("STUB", entity.Service_info+"."+entity.Entry, "position:", chain.CurrentPosition, "IsReturnCall:", chain.IsReturnCall)
+	for i, serverEntry := range chain.EntityList {
+		if serverEntry.Args != nil {
+			fmt.Println("  Args", i, ":", serverEntry.Args)
+		}
+	}
+
+	*reply = true
+	return nil
+}
+
+// Dial the service under test, it may still be registering with the stub before it listens
+func dialService(address string) (*rpc.Client, error) {
+	service, err := rpc.Dial("tcp", address)
+	for attempt := 1; err != nil && attempt < 20; attempt++ {
+		time.Sleep(500 * time.Millisecond)
+		service, err = rpc.Dial("tcp", address)
+	}
+	return service, err
+}
+
+// If error is non-nil, print it out and halt.
+func checkError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// Register the stub under every neighbor's service name and listen for the service under test
+func initStubListener(address string, testedService string) {
+	server := rpc.NewServer()
+	for _, name := range StubServiceNames {
+		if name != testedService {
+			server.RegisterName(name, new(StubService))
+		}
+	}
+
+	ln, e := net.Listen("tcp", address)
+	if e != nil {
+		log.Fatal("listen error:", e)
+	} else {
+		go server.Accept(ln)
+	}
+}
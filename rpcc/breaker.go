@@ -0,0 +1,292 @@
+package rpcc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* === Headers === */
+
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // Hops are sent
+	BreakerOpen                         // Hops fail fast with ErrBreakerOpen
+	BreakerHalfOpen                     // A single probe hop is let through
+)
+
+// Thresholds of the circuit breakers kept per downstream address
+type BreakerConfig struct {
+	Failures int           // Failed hops in a row that open the breaker
+	OpenFor  time.Duration // How long hops fail fast before a probe is let through
+	Probes   int           // Successful probes in a row that close it again
+}
+
+// A breaker as reported by the status RPC
+type BreakerStatus struct {
+	Address  string
+	State    BreakerState
+	Failures int
+	OpenedAt time.Time
+}
+
+// Serves the state of this node's breakers, hop latencies and wire counters
+type StatusService int
+
+type StatusArgs struct{}
+
+type StatusReply struct {
+	Breakers  []BreakerStatus
+	Latencies []LatencyStats
+	Wire      WireStats
+}
+
+type breaker struct {
+	status    BreakerStatus
+	successes int
+	probing   bool
+}
+
+var DefaultBreakerConfig = BreakerConfig{Failures: 3, OpenFor: 5 * time.Second, Probes: 1}
+
+var ErrBreakerOpen = errors.New("rpcc: circuit breaker open")
+
+/* === Globals === */
+var breakerConfig = DefaultBreakerConfig
+var breakers = make(map[string]*breaker)
+var breakerMutex sync.Mutex
+
+/* === Functions === */
+func SetBreakerConfig(config BreakerConfig) {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+	breakerConfig = config
+}
+
+// Sets the breaker thresholds from a spec like "failures=3,open=5s,probes=1",
+// unset values keep their defaults
+func InitBreakers(spec string) error {
+	config, err := ParseBreakerConfig(spec)
+	if err != nil {
+		return err
+	}
+	SetBreakerConfig(config)
+	return nil
+}
+
+func ParseBreakerConfig(spec string) (BreakerConfig, error) {
+	config := DefaultBreakerConfig
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return config, fmt.Errorf("rpcc: bad breaker setting %q", field)
+		}
+
+		var err error
+		switch kv[0] {
+		case "failures":
+			config.Failures, err = strconv.Atoi(kv[1])
+		case "open":
+			config.OpenFor, err = time.ParseDuration(kv[1])
+		case "probes":
+			config.Probes, err = strconv.Atoi(kv[1])
+		default:
+			err = errors.New("unknown setting")
+		}
+		if err != nil {
+			return config, fmt.Errorf("rpcc: bad breaker setting %q: %s", field, err.Error())
+		}
+	}
+	return config, nil
+}
+
+// Every breaker of this node, by address
+func Breakers() []BreakerStatus {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	statuses := make([]BreakerStatus, 0, len(breakers))
+	for _, b := range breakers {
+		statuses = append(statuses, b.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Address < statuses[j].Address })
+	return statuses
+}
+
+// Addresses this node currently fails hops to, open or waiting on a probe
+func OpenBreakers() []string {
+	addrs := make([]string, 0)
+	for _, status := range Breakers() {
+		if status.State != BreakerClosed {
+			addrs = append(addrs, status.Address)
+		}
+	}
+	return addrs
+}
+
+// Asks the node at address for the state of its breakers
+func QueryBreakers(address string) ([]BreakerStatus, error) {
+	var reply StatusReply
+	err := transport.Call(address, "RPCCStatusService.Breakers", StatusArgs{}, &reply)
+	return reply.Breakers, err
+}
+
+func (s *StatusService) Breakers(args StatusArgs, reply *StatusReply) error {
+	reply.Breakers = Breakers()
+	reply.Latencies = Latencies()
+	reply.Wire = Wire()
+	return nil
+}
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+/* == Private Functions == */
+func resetBreakers() {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+	breakers = make(map[string]*breaker)
+}
+
+// Whether a hop may be sent to address, a half-open breaker lets one probe through at a time
+func allowHop(address string) error {
+	if address == "" {
+		return nil
+	}
+
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	b, ok := breakers[address]
+	if !ok {
+		return nil
+	}
+
+	switch b.status.State {
+	case BreakerOpen:
+		if clock.Now().Sub(b.status.OpenedAt) < breakerConfig.OpenFor {
+			return ErrBreakerOpen
+		}
+		b.status.State = BreakerHalfOpen
+		b.successes = 0
+		b.probing = true
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrBreakerOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Lets the hop at index through the breaker of its address, or moves it to the next resolved
+// address of its logical service that lets it through. Return calls and hedged copies keep
+// their address. The breaker's error is left to the caller, nothing exits on it.
+func (chain *RPCChain) allowEntity(index int) error {
+	entity := &chain.EntityList[index]
+	err := allowHop(entity.Connection_info)
+	if err == nil || entity.Logical_service == "" || chain.IsReturnCall || chain.hedged(index) {
+		return err
+	}
+
+	addrs, resolveErr := resolveAddresses(*entity)
+	if resolveErr != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if addr != entity.Connection_info && allowHop(addr) == nil {
+			entity.Connection_info = addr
+			chain.Trace[len(chain.Trace)-1].Connection = addr
+			return nil
+		}
+	}
+	return err
+}
+
+// Counts the outcome of a hop sent to address
+func reportHop(address string, failed bool) {
+	if address == "" {
+		return
+	}
+
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	b, ok := breakers[address]
+	if !ok {
+		if !failed {
+			return
+		}
+		b = &breaker{status: BreakerStatus{Address: address}}
+		breakers[address] = b
+	}
+
+	switch b.status.State {
+	case BreakerClosed:
+		if !failed {
+			b.status.Failures = 0
+			return
+		}
+		b.status.Failures++
+		if b.status.Failures >= breakerConfig.Failures {
+			b.open()
+		}
+	case BreakerHalfOpen:
+		b.probing = false
+		if failed {
+			b.open()
+			return
+		}
+		b.successes++
+		if b.successes >= breakerConfig.Probes {
+			b.status.State = BreakerClosed
+			b.status.Failures = 0
+		}
+	}
+	// Hops sent before the breaker opened don't change an open breaker
+}
+
+// Must be called with breakerMutex held
+func (b *breaker) open() {
+	b.status.State = BreakerOpen
+	b.status.OpenedAt = clock.Now()
+	b.probing = false
+}
+
+// Whether hops to address would be sent right now, without claiming a probe
+func breakerReady(address string) bool {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	b, ok := breakers[address]
+	if !ok {
+		return true
+	}
+
+	switch b.status.State {
+	case BreakerOpen:
+		return clock.Now().Sub(b.status.OpenedAt) >= breakerConfig.OpenFor
+	case BreakerHalfOpen:
+		return !b.probing
+	}
+	return true
+}
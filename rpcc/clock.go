@@ -0,0 +1,165 @@
+package rpcc
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/* === Headers === */
+
+// Source of time for timeouts, heartbeats and failure detection
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) *Ticker
+}
+
+// Delivers the time on C every period until stopped
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+// The wall clock
+type RealClock struct{}
+
+// A clock that only moves when advanced, firing timers and tickers that fall due
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration // 0 for a one-shot timer
+	ch     chan time.Time
+}
+
+/* === Globals === */
+var clock Clock = RealClock{}
+
+/* === Functions === */
+// Replaces the clock used by rpcc and the services
+func SetClock(c Clock) {
+	clock = c
+}
+
+func GetClock() Clock {
+	return clock
+}
+
+func Now() time.Time                         { return clock.Now() }
+func Sleep(d time.Duration)                  { clock.Sleep(d) }
+func After(d time.Duration) <-chan time.Time { return clock.After(d) }
+func NewTicker(d time.Duration) *Ticker      { return clock.NewTicker(d) }
+
+func (t *Ticker) Stop() {
+	t.stop()
+}
+
+/* == Real Clock == */
+func (c RealClock) Now() time.Time                         { return time.Now() }
+func (c RealClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (c RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (c RealClock) NewTicker(d time.Duration) *Ticker {
+	ticker := time.NewTicker(d)
+	return &Ticker{C: ticker.C, stop: ticker.Stop}
+}
+
+/* == Fake Clock == */
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.addWaiter(d, 0).ch
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) *Ticker {
+	waiter := c.addWaiter(d, d)
+	return &Ticker{C: waiter.ch, stop: func() { c.removeWaiter(waiter) }}
+}
+
+// Moves the clock forward, firing every timer and ticker due on the way in order
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	end := c.now.Add(d)
+
+	for {
+		sort.Slice(c.waiters, func(i, j int) bool { return c.waiters[i].at.Before(c.waiters[j].at) })
+		if len(c.waiters) == 0 || c.waiters[0].at.After(end) {
+			break
+		}
+
+		waiter := c.waiters[0]
+		c.now = waiter.at
+		if waiter.period > 0 {
+			waiter.at = waiter.at.Add(waiter.period)
+		} else {
+			c.waiters = c.waiters[1:]
+		}
+
+		// Like time.Ticker, ticks are dropped for slow receivers
+		select {
+		case waiter.ch <- c.now:
+		default:
+		}
+	}
+
+	c.now = end
+	c.mutex.Unlock()
+}
+
+// Number of timers and tickers waiting, to sync tests with sleeping goroutines
+func (c *FakeClock) Waiters() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.waiters)
+}
+
+// Blocks until at least n timers or tickers are waiting on the clock
+func (c *FakeClock) BlockUntil(n int) {
+	for c.Waiters() < n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+/* == Private Functions == */
+func (c *FakeClock) addWaiter(d time.Duration, period time.Duration) *fakeWaiter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	waiter := &fakeWaiter{at: c.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	if d <= 0 && period == 0 {
+		waiter.ch <- c.now
+		return waiter
+	}
+	c.waiters = append(c.waiters, waiter)
+	return waiter
+}
+
+func (c *FakeClock) removeWaiter(waiter *fakeWaiter) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, w := range c.waiters {
+		if w == waiter {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package rpcc
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+/* === Headers === */
+
+// net/rpc's gob codec, except chains are traced and recorded as they're decoded
+type serverCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+
+	// Replies owed to the chains being served, by sequence number
+	mutex   sync.Mutex
+	seq     uint64
+	replies map[uint64]string
+}
+
+/* === Functions === */
+// Serves connections on the listener with the default RPC server, like rpc.Accept,
+// running rpcc's receive hooks on every chain
+func Accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Print("rpcc.Accept: ", err.Error())
+			return
+		}
+		go rpc.ServeCodec(NewServerCodec(conn))
+	}
+}
+
+func NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &serverCodec{
+		rwc:     conn,
+		dec:     gob.NewDecoder(conn),
+		enc:     gob.NewEncoder(buf),
+		encBuf:  buf,
+		replies: make(map[uint64]string),
+	}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.dec.Decode(r)
+	c.seq = r.Seq
+	return err
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	err := c.dec.Decode(body)
+	if chain, ok := body.(*RPCChain); ok && err == nil {
+		chain.received()
+
+		// The handler moves the chain along, so the reply is named now
+		c.mutex.Lock()
+		c.replies[c.seq] = chain.replyMessage()
+		c.mutex.Unlock()
+	}
+	return err
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	c.mutex.Lock()
+	reply, ok := c.replies[r.Seq]
+	delete(c.replies, r.Seq)
+	c.mutex.Unlock()
+	if ok && reply != "" {
+		tracer.LogLocalEvent(reply)
+	}
+
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the header, shut down the connection
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *serverCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+/* == Private Functions == */
+// Runs once for every chain a node receives
+func (chain *RPCChain) received() {
+	if len(chain.Trace) > 0 {
+		chain.Trace[len(chain.Trace)-1].Received = clock.Now()
+	}
+	chain.traceReceive()
+	chain.Record()
+}
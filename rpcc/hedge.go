@@ -0,0 +1,216 @@
+package rpcc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/* === Headers === */
+
+// Carried by the copies of a hedged hop until one of them moves the chain on
+type HedgeClaim struct {
+	Token    string
+	Holder   string // Address of the node that hedged the hop, it settles the claims
+	Position int    // The hedged hop
+	Copy     int    // 0 for the first copy, 1 for the hedge
+}
+
+// Settles which copy of the hops this node hedged goes on
+type HedgeService int
+
+type HedgeArgs struct {
+	Token string
+	Copy  int
+}
+
+type hedgeClaim struct {
+	copy    int
+	claimed time.Time
+}
+
+type hedgeResult struct {
+	copy  int
+	chain *RPCChain
+	err   error
+}
+
+// Claims are forgotten after this long
+const HedgeTTL = 60 * time.Second
+
+var ErrHedgeLost = errors.New("rpcc: hedged hop lost to the other copy")
+
+/* === Globals === */
+var hedgeDelay time.Duration // 0 turns hedging off
+var hedgeClaims = make(map[string]hedgeClaim)
+var hedgeMutex sync.Mutex
+
+/* === Functions === */
+func SetHedgeDelay(delay time.Duration) {
+	hedgeMutex.Lock()
+	defer hedgeMutex.Unlock()
+	hedgeDelay = delay
+}
+
+// Sets the hedge delay from a duration like "150ms", "" turns hedging off
+func InitHedging(delay string) error {
+	d, err := ParseHedgeDelay(delay)
+	if err != nil {
+		return err
+	}
+	SetHedgeDelay(d)
+	return nil
+}
+
+func ParseHedgeDelay(delay string) (time.Duration, error) {
+	if delay == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(delay)
+	if err != nil {
+		return 0, fmt.Errorf("rpcc: bad hedge delay %q", delay)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("rpcc: negative hedge delay %q", delay)
+	}
+	return d, nil
+}
+
+// Calls the next hop like CallNext. If hedging is on and the hop names a logical
+// service with more than one replica, a copy of the hop is sent to the next replica
+// once the first hasn't returned within the hedge delay, or has failed. The copy that
+// moves the chain on first wins, the other one is stopped at its next hop.
+func (chain *RPCChain) HedgeNext(timeout int) error {
+	hedgeMutex.Lock()
+	delay := hedgeDelay
+	hedgeMutex.Unlock()
+
+	index := (chain.CurrentPosition + 1) % len(chain.EntityList)
+	holder := chain.CurrentEntity().Connection_info
+	entity := chain.EntityList[index]
+	if delay <= 0 || holder == "" || entity.Logical_service == "" || entity.Sub != nil || len(chain.Parents) > 0 {
+		return chain.CallNext(timeout)
+	}
+
+	addrs, err := resolveAddresses(entity)
+	if err != nil || len(addrs) < 2 {
+		return chain.CallNext(timeout)
+	}
+
+	token := generateUniqueId()
+	results := make(chan hedgeResult, 2)
+	send := func(n int) {
+		c := chain.hedgeCopy(index, addrs[n], HedgeClaim{Token: token, Holder: holder, Position: index, Copy: n})
+		go func() {
+			err := c.CallIndex(index, timeout)
+			results <- hedgeResult{copy: n, chain: c, err: err}
+		}()
+	}
+
+	send(0)
+	sent := 1
+	hedge := clock.After(delay)
+
+	var last hedgeResult
+	for received := 0; received < sent; {
+		select {
+		case <-hedge:
+			if sent == 1 {
+				send(1)
+				sent++
+			}
+		case last = <-results:
+			received++
+			if last.err == nil {
+				// The loser returns as soon as it's stopped, keep waiting for the winner
+				winner, claimed := hedgeWinner(token)
+				if !claimed || winner == last.copy {
+					chain.adopt(last.chain)
+					return nil
+				}
+				continue
+			}
+
+			// Don't wait out the delay once the first replica failed
+			if sent == 1 {
+				send(1)
+				sent++
+			}
+		}
+	}
+
+	chain.adopt(last.chain)
+	checkError(chain, last.err)
+	return last.err
+}
+
+// The first copy to claim the token goes on
+func (s *HedgeService) Claim(args HedgeArgs, reply *bool) error {
+	hedgeMutex.Lock()
+	defer hedgeMutex.Unlock()
+
+	evictHedgeClaims()
+
+	claim, ok := hedgeClaims[args.Token]
+	if !ok {
+		hedgeClaims[args.Token] = hedgeClaim{copy: args.Copy, claimed: clock.Now()}
+		*reply = true
+		return nil
+	}
+	*reply = claim.copy == args.Copy
+	return nil
+}
+
+/* == Private Functions == */
+// Whether the hop at index is a copy of a hedged hop, its address stays pinned
+// and its errors are left to HedgeNext
+func (chain *RPCChain) hedged(index int) bool {
+	return chain.Hedge != nil && chain.Hedge.Position == index
+}
+
+// Claims the chain for this copy before it moves on, false if the other copy already has.
+// If the hedging node can't be reached the copy goes on, a duplicate beats losing both.
+func (chain *RPCChain) claimHedge() bool {
+	var won bool
+	err := transport.Call(chain.Hedge.Holder, "RPCCHedgeService.Claim", HedgeArgs{Token: chain.Hedge.Token, Copy: chain.Hedge.Copy}, &won)
+	chain.Hedge = nil
+	return err != nil || won
+}
+
+func (chain *RPCChain) hedgeCopy(index int, address string, claim HedgeClaim) *RPCChain {
+	c := *chain
+	c.mutex = &sync.Mutex{}
+	c.EntityList = append([]ServerEntity{}, chain.EntityList...)
+	c.EntityList[index].Connection_info = address
+	c.Trace = append([]Hop{}, chain.Trace...)
+	c.Hedge = &claim
+	return &c
+}
+
+// Takes on the state of the copy that went on
+func (chain *RPCChain) adopt(c *RPCChain) {
+	mutex := chain.mutex
+	*chain = *c
+	chain.mutex = mutex
+	chain.Hedge = nil
+}
+
+func hedgeWinner(token string) (int, bool) {
+	hedgeMutex.Lock()
+	defer hedgeMutex.Unlock()
+
+	claim, ok := hedgeClaims[token]
+	return claim.copy, ok
+}
+
+// Must be called with hedgeMutex held
+func evictHedgeClaims() {
+	now := clock.Now()
+	for token, claim := range hedgeClaims {
+		if now.Sub(claim.claimed) > HedgeTTL {
+			delete(hedgeClaims, token)
+		}
+	}
+}
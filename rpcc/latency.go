@@ -0,0 +1,217 @@
+package rpcc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* === Headers === */
+
+// How hop timeouts are derived from the latencies observed per service and entry
+// function, the timeout passed to CallIndex is used until there are enough samples
+type TimeoutConfig struct {
+	Enabled    bool
+	Percentile float64       // Of the observed latencies, 0.99 for the p99
+	Headroom   float64       // The percentile is multiplied by this
+	Floor      time.Duration // Shortest timeout given
+	Ceiling    time.Duration // Longest timeout given
+	MinSamples int
+}
+
+// Latencies of a "Service.Entry" and the timeout its hops get, as reported by the status RPC
+type LatencyStats struct {
+	Key     string
+	Samples int
+	P50     time.Duration
+	P99     time.Duration
+	Timeout time.Duration // 0 while the caller's timeout is used
+}
+
+// The latest samples of a "Service.Entry", oldest overwritten first
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+var DefaultTimeoutConfig = TimeoutConfig{
+	Enabled:    true,
+	Percentile: 0.99,
+	Headroom:   2,
+	Floor:      250 * time.Millisecond,
+	Ceiling:    30 * time.Second,
+	MinSamples: 20,
+}
+
+// Samples kept per "Service.Entry"
+const LatencyWindow = 256
+
+/* === Globals === */
+var timeoutConfig = DefaultTimeoutConfig
+var latencies = make(map[string]*latencyWindow)
+var latencyMutex sync.Mutex
+
+/* === Functions === */
+func SetTimeoutConfig(config TimeoutConfig) {
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+	timeoutConfig = config
+}
+
+// Sets how hop timeouts are derived from a spec like "p=0.99,headroom=2,floor=250ms,ceiling=30s,samples=20",
+// unset values keep their defaults and "off" keeps the timeouts passed to CallIndex
+func InitTimeouts(spec string) error {
+	config, err := ParseTimeoutConfig(spec)
+	if err != nil {
+		return err
+	}
+	SetTimeoutConfig(config)
+	return nil
+}
+
+func ParseTimeoutConfig(spec string) (TimeoutConfig, error) {
+	config := DefaultTimeoutConfig
+	if strings.TrimSpace(spec) == "off" {
+		config.Enabled = false
+		return config, nil
+	}
+
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return config, fmt.Errorf("rpcc: bad timeout setting %q", field)
+		}
+
+		var err error
+		switch kv[0] {
+		case "p":
+			config.Percentile, err = strconv.ParseFloat(kv[1], 64)
+		case "headroom":
+			config.Headroom, err = strconv.ParseFloat(kv[1], 64)
+		case "floor":
+			config.Floor, err = time.ParseDuration(kv[1])
+		case "ceiling":
+			config.Ceiling, err = time.ParseDuration(kv[1])
+		case "samples":
+			config.MinSamples, err = strconv.Atoi(kv[1])
+		default:
+			err = errors.New("unknown setting")
+		}
+		if err != nil {
+			return config, fmt.Errorf("rpcc: bad timeout setting %q: %s", field, err.Error())
+		}
+	}
+	return config, nil
+}
+
+// Latencies observed by this node, by "Service.Entry"
+func Latencies() []LatencyStats {
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+
+	stats := make([]LatencyStats, 0, len(latencies))
+	for key, window := range latencies {
+		sorted := window.sorted()
+		stats = append(stats, LatencyStats{
+			Key:     key,
+			Samples: len(sorted),
+			P50:     percentile(sorted, 0.5),
+			P99:     percentile(sorted, 0.99),
+			Timeout: adaptiveTimeout(sorted),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Key < stats[j].Key })
+	return stats
+}
+
+/* == Private Functions == */
+// The timeout for a hop to entity, in ms like the timeouts passed to CallIndex
+func hopTimeout(entity ServerEntity, timeout int) int {
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+
+	window, ok := latencies[entity.Service_info+"."+entity.Entry]
+	if !ok {
+		return timeout
+	}
+
+	d := adaptiveTimeout(window.sorted())
+	if d == 0 {
+		return timeout
+	}
+	return int(d / time.Millisecond)
+}
+
+// Records how long a hop to entity took to return
+func recordLatency(entity ServerEntity, d time.Duration) {
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+
+	key := entity.Service_info + "." + entity.Entry
+	window, ok := latencies[key]
+	if !ok {
+		window = &latencyWindow{samples: make([]time.Duration, 0, LatencyWindow)}
+		latencies[key] = window
+	}
+
+	if len(window.samples) < LatencyWindow {
+		window.samples = append(window.samples, d)
+		return
+	}
+	window.samples[window.next] = d
+	window.next = (window.next + 1) % LatencyWindow
+}
+
+func resetLatencies() {
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+	latencies = make(map[string]*latencyWindow)
+}
+
+// Must be called with latencyMutex held, 0 if the caller's timeout should be used
+func adaptiveTimeout(sorted []time.Duration) time.Duration {
+	if !timeoutConfig.Enabled || len(sorted) < timeoutConfig.MinSamples || len(sorted) == 0 {
+		return 0
+	}
+
+	d := time.Duration(float64(percentile(sorted, timeoutConfig.Percentile)) * timeoutConfig.Headroom)
+	if d < timeoutConfig.Floor {
+		d = timeoutConfig.Floor
+	}
+	if d > timeoutConfig.Ceiling {
+		d = timeoutConfig.Ceiling
+	}
+	return d
+}
+
+func (w *latencyWindow) sorted() []time.Duration {
+	sorted := append([]time.Duration{}, w.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// Nearest-rank percentile of sorted samples
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,148 @@
+package rpcc
+
+import (
+	"errors"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* === Headers === */
+
+// A small handle carried by the chain in place of a large argument, only
+// hops that dereference it pay for the transfer
+type PayloadRef struct {
+	Id     string
+	Holder string // Address of the node buffering the payload
+	Size   int
+}
+
+// Serves the payloads buffered on this node to the hops that dereference them
+type BlobService int
+
+type BlobArgs struct {
+	Id   string
+	Data []byte
+}
+
+type blob struct {
+	data     []byte
+	buffered time.Time
+}
+
+// Payloads nobody fetched are dropped after this long
+const BlobTTL = 60 * time.Second
+
+/* === Globals === */
+var blobs = make(map[string]blob)
+var blobMutex sync.Mutex
+
+/* === Functions === */
+// Registers rpcc's own RPC services with the default RPC server
+func RegisterServices() error {
+	if err := rpc.RegisterName("RPCCBlobService", new(BlobService)); err != nil {
+		return err
+	}
+	if err := rpc.RegisterName("RPCCStatusService", new(StatusService)); err != nil {
+		return err
+	}
+	if err := rpc.RegisterName("RPCCHedgeService", new(HedgeService)); err != nil {
+		return err
+	}
+	return rpc.RegisterName("RPCCRelayService", new(RelayService))
+}
+
+// Buffers data on this node, holder is the address this node's listener is on
+func Buffer(holder string, data []byte) PayloadRef {
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+
+	evictBlobs()
+
+	id := generateUniqueId()
+	blobs[id] = blob{data: data, buffered: clock.Now()}
+	return PayloadRef{Id: id, Holder: holder, Size: len(data)}
+}
+
+// Uploads data once to the blob buffer of the node at holder
+func Upload(holder string, data []byte) (PayloadRef, error) {
+	var ref PayloadRef
+	err := transport.Call(holder, "RPCCBlobService.Put", BlobArgs{Data: data}, &ref)
+	ref.Holder = holder
+	return ref, err
+}
+
+// Dereferences a payload, transferring it from its holder
+func Fetch(ref PayloadRef) ([]byte, error) {
+	blobMutex.Lock()
+	local, ok := blobs[ref.Id]
+	blobMutex.Unlock()
+	if ok {
+		return local.data, nil
+	}
+
+	var reply BlobArgs
+	err := transport.Call(ref.Holder, "RPCCBlobService.Get", ref, &reply)
+	return reply.Data, err
+}
+
+// Drops a payload from its holder's buffer once it's no longer needed
+func Release(ref PayloadRef) error {
+	blobMutex.Lock()
+	_, ok := blobs[ref.Id]
+	delete(blobs, ref.Id)
+	blobMutex.Unlock()
+	if ok {
+		return nil
+	}
+
+	var reply bool
+	return transport.Call(ref.Holder, "RPCCBlobService.Release", ref, &reply)
+}
+
+func (ref PayloadRef) IsSet() bool {
+	return ref.Id != ""
+}
+
+/* == Service Methods == */
+func (bs *BlobService) Put(args *BlobArgs, reply *PayloadRef) error {
+	*reply = Buffer("", args.Data)
+	return nil
+}
+
+func (bs *BlobService) Get(ref *PayloadRef, reply *BlobArgs) error {
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+
+	b, ok := blobs[ref.Id]
+	if !ok {
+		return errors.New("rpcc: no payload buffered for " + ref.Id)
+	}
+	reply.Id = ref.Id
+	reply.Data = b.data
+	return nil
+}
+
+func (bs *BlobService) Release(ref *PayloadRef, reply *bool) error {
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+
+	_, *reply = blobs[ref.Id]
+	delete(blobs, ref.Id)
+	return nil
+}
+
+/* == Private Functions == */
+// Must be called with blobMutex held
+func evictBlobs() {
+	for id, b := range blobs {
+		if clock.Now().Sub(b.buffered) > BlobTTL {
+			delete(blobs, id)
+		}
+	}
+}
+
+func (ref PayloadRef) String() string {
+	return ref.Id + "@" + ref.Holder + " (" + strconv.Itoa(ref.Size) + " bytes)"
+}
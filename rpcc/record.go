@@ -0,0 +1,102 @@
+package rpcc
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* === Headers === */
+
+// A chain as it was received by a node, written out for offline replay
+type ChainRecord struct {
+	Node     string
+	Received time.Time // When the node got the chain, or gave up sending it
+	Chain    RPCChain
+	Sent     bool // Recorded by the sender, the hop at Chain.CurrentPosition never got through
+}
+
+/* === Globals === */
+var recordDir string
+var recordNode string
+var recordSeq int
+var recordMutex sync.Mutex
+
+/* === Functions === */
+// Dumps every chain passed to Record into dir, an empty dir disables recording
+func EnableRecording(node string, dir string) error {
+	recordMutex.Lock()
+	defer recordMutex.Unlock()
+
+	recordNode = node
+	recordDir = dir
+	if dir == "" {
+		return nil
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// Writes the chain (Args, Log, position and direction) to the recording directory,
+// as received by this node
+func (chain *RPCChain) Record() error {
+	return chain.record(false)
+}
+
+// The chain id as it appears in record file names, sub-chain ids contain '/'
+func RecordId(chainId string) string {
+	return strings.Replace(chainId, "/", ".", -1)
+}
+
+// Reads back a chain written by Record, the Args types must be registered with gob
+func LoadRecord(path string) (*ChainRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	record := new(ChainRecord)
+	err = gob.NewDecoder(f).Decode(record)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+/* == Private Functions == */
+// Records a chain as received, or as sent for a hop that couldn't be delivered
+func (chain *RPCChain) record(sent bool) error {
+	recordMutex.Lock()
+	defer recordMutex.Unlock()
+
+	if recordDir == "" {
+		return nil
+	}
+
+	recordSeq++
+	name := fmt.Sprintf("%s-%s-%04d.gob", recordNode, RecordId(chain.Id), recordSeq)
+	if sent {
+		name = fmt.Sprintf("%s-%s-%04d-sent.gob", recordNode, RecordId(chain.Id), recordSeq)
+	}
+	f, err := os.Create(filepath.Join(recordDir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	record := ChainRecord{
+		Node:     recordNode,
+		Received: clock.Now(),
+		Chain:    *chain,
+		Sent:     sent,
+	}
+
+	// Args of every entity have to be known to gob before encoding
+	registerArgs(chain)
+
+	return gob.NewEncoder(f).Encode(&record)
+}
@@ -0,0 +1,51 @@
+package rpcc
+
+/* === Headers === */
+
+// Sends on the hops handed back to this node by chains relayed through it
+type RelayService int
+
+type RelayArgs struct {
+	Chain   *RPCChain
+	Index   int
+	Timeout int
+}
+
+/* === Functions === */
+// Sends every hop of the chain back through the node at address, which sends it on,
+// like a client calling each service in turn with plain RPCs. The node at address
+// must serve RegisterServices. Used to compare chains with client-orchestrated calls.
+func (chain *RPCChain) RelayThrough(address string) {
+	chain.Relay = address
+}
+
+// Dispatches a hop from this node, as the node before it would have without the relay
+func (s *RelayService) Forward(args RelayArgs, reply *bool) error {
+	chain := args.Chain
+	chain.relayed = true
+	err := chain.CallIndex(args.Index, args.Timeout)
+	*reply = chain.Success == 1
+	return err
+}
+
+/* == Private Functions == */
+// Whether this node must hand its hops to the relay, instead of calling the next server
+func (chain *RPCChain) relaying() bool {
+	return chain.Relay != "" && !chain.relayed && chain.CurrentEntity().Connection_info != chain.Relay
+}
+
+// Must be called with the chain locked. An unreachable relay is returned to the caller
+// rather than handled, so a benchmark can count the hop as failed and go on.
+func (chain *RPCChain) callRelay(index int, timeout int) error {
+	registerArgs(chain)
+
+	var returnVal bool
+	err := transport.Call(chain.Relay, "RPCCRelayService.Forward", RelayArgs{Chain: chain, Index: index, Timeout: timeout}, &returnVal)
+
+	if returnVal {
+		chain.Success = 1
+	} else {
+		chain.Success = 0
+	}
+	return err
+}
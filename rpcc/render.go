@@ -0,0 +1,134 @@
+package rpcc
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* === Functions === */
+// Renders the chain's entities and traced hops as a Graphviz DOT digraph
+func RenderDOT(chain *RPCChain) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "digraph %q {\n", "chain "+chain.Id)
+	b.WriteString("\trankdir=LR;\n\tnode [shape=box];\n")
+
+	for i, entity := range chain.EntityList {
+		fmt.Fprintf(&b, "\tn%d [label=%s];\n", i, dotQuote(entityLabel(i, entity, "\\n")))
+	}
+
+	from := 0
+	for n, hop := range chain.Trace {
+		attrs := []string{fmt.Sprintf("label=%q", hopLabel(n, hop))}
+		if hop.IsReturnCall {
+			attrs = append(attrs, "style=dashed")
+		}
+		if hop.Err != "" {
+			attrs[0] = fmt.Sprintf("label=%q", hopLabel(n, hop)+" FAILED: "+hop.Err)
+			attrs = append(attrs, "color=red", "fontcolor=red")
+		}
+		fmt.Fprintf(&b, "\tn%d -> n%d [%s];\n", from, hop.Position, strings.Join(attrs, ", "))
+		from = hop.Position
+	}
+
+	if chain.Err != "" {
+		fmt.Fprintf(&b, "\terr [shape=note, color=red, label=%q];\n", "Err: "+chain.Err)
+		fmt.Fprintf(&b, "\tn%d -> err [style=dotted, color=red];\n", from)
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Renders the chain's traced hops as a Mermaid sequence diagram
+func RenderMermaid(chain *RPCChain) string {
+	var b strings.Builder
+
+	b.WriteString("sequenceDiagram\n")
+	fmt.Fprintf(&b, "\ttitle Chain %s\n", chain.Id)
+	for i, entity := range chain.EntityList {
+		fmt.Fprintf(&b, "\tparticipant n%d as %s\n", i, entityLabel(i, entity, "<br/>"))
+	}
+
+	from := 0
+	returning := false
+	for n, hop := range chain.Trace {
+		if hop.IsReturnCall != returning {
+			fmt.Fprintf(&b, "\tNote over n%d: direction changed\n", from)
+			returning = hop.IsReturnCall
+		}
+
+		arrow := "->>"
+		if hop.IsReturnCall {
+			arrow = "-->>"
+		}
+		label := hopLabel(n, hop)
+		if hop.Err != "" {
+			arrow = "-x"
+			label += " FAILED: " + mermaidEscape(hop.Err)
+		}
+		fmt.Fprintf(&b, "\tn%d%sn%d: %s\n", from, arrow, hop.Position, label)
+		from = hop.Position
+	}
+
+	if chain.Err != "" {
+		fmt.Fprintf(&b, "\tNote over n%d: Err: %s\n", from, mermaidEscape(chain.Err))
+	}
+
+	return b.String()
+}
+
+// A one line summary of the chain, the entities and where it currently is
+func (chain RPCChain) String() string {
+	direction := "forwards"
+	if chain.IsReturnCall {
+		direction = "backwards"
+	}
+
+	entities := make([]string, len(chain.EntityList))
+	for i, entity := range chain.EntityList {
+		marker := ""
+		if i == chain.CurrentPosition {
+			marker = "*"
+		}
+		entities[i] = fmt.Sprintf("%s%d %s.%s@%s", marker, i, entity.Service_info, entity.Entry, entity.Connection_info)
+	}
+
+	summary := fmt.Sprintf("chain %s %s at %d [%s] %d hops", chain.Id, direction, chain.CurrentPosition, strings.Join(entities, ", "), len(chain.Trace))
+	if chain.Err != "" {
+		summary += " err: " + chain.Err
+	}
+	return summary
+}
+
+/* == Private Functions == */
+func entityLabel(position int, entity ServerEntity, newline string) string {
+	label := fmt.Sprintf("%d: %s", position, entity.Service_info)
+	if entity.Logical_service != "" {
+		label += " (" + entity.Logical_service + ")"
+	}
+	if entity.Connection_info != "" {
+		label += newline + entity.Connection_info
+	}
+	return label
+}
+
+// The nth hop and the timeout it was given, if it got as far as being sent
+func hopLabel(n int, hop Hop) string {
+	label := fmt.Sprintf("%d. %s", n+1, hop.Entry)
+	if hop.Timeout > 0 {
+		label += fmt.Sprintf(" (%dms)", hop.Timeout)
+	}
+	return label
+}
+
+// DOT reads \n in a label as a line break, so only quotes are escaped
+func dotQuote(s string) string {
+	return "\"" + strings.Replace(s, "\"", "\\\"", -1) + "\""
+}
+
+// Mermaid ends a message at ';' and treats '#' as an entity
+func mermaidEscape(s string) string {
+	s = strings.Replace(s, ";", ",", -1)
+	return strings.Replace(s, "#", "", -1)
+}
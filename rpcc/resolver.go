@@ -0,0 +1,116 @@
+package rpcc
+
+import (
+	"errors"
+	"strings"
+)
+
+/* === Headers === */
+
+// Picks the addresses able to serve a logical service entity, most preferred first
+type Resolver interface {
+	Resolve(entity ServerEntity) ([]string, error)
+}
+
+// Arguments and reply of a resolve RPC served by a remote registry
+type ResolveArgs struct {
+	Entity ServerEntity
+}
+
+type ResolveReply struct {
+	Addrs []string
+}
+
+// Resolves logical services through an RPC on a remote registry (the frontend)
+type RemoteResolver struct {
+	Address       string // Comma separated, tried in order
+	ServiceMethod string
+}
+
+// Resolves logical services from a fixed table, for tests and simulations
+type StaticResolver map[string][]string
+
+var ErrNoLiveAddress = errors.New("rpcc: no live address for logical service")
+
+/* === Functions === */
+func RegisterResolver(r Resolver) {
+	resolver = r
+}
+
+func NewRemoteResolver(address string, serviceMethod string) *RemoteResolver {
+	return &RemoteResolver{Address: address, ServiceMethod: serviceMethod}
+}
+
+func (r *RemoteResolver) Resolve(entity ServerEntity) ([]string, error) {
+	// Args are interface values the registry may not know how to decode
+	entity.Args = nil
+
+	var err error
+	for _, address := range strings.Split(r.Address, ",") {
+		var reply ResolveReply
+		if err = transport.Call(strings.TrimSpace(address), r.ServiceMethod, ResolveArgs{Entity: entity}, &reply); err == nil {
+			return reply.Addrs, nil
+		}
+	}
+	return nil, err
+}
+
+func (r StaticResolver) Resolve(entity ServerEntity) ([]string, error) {
+	return r[entity.Logical_service], nil
+}
+
+/* == Private Functions == */
+// Pins the address of a logical entity when its hop is dispatched forwards,
+// return calls keep the address the forward hop was served by, and hedged
+// copies the replica they were sent to
+func (chain *RPCChain) resolveEntity(index int) error {
+	entity := &chain.EntityList[index]
+	if entity.Logical_service == "" {
+		return nil
+	}
+	if entity.Connection_info != "" && (chain.IsReturnCall || chain.hedged(index)) {
+		return nil
+	}
+
+	addr, err := resolveAddress(*entity)
+	if err != nil {
+		return err
+	}
+	entity.Connection_info = addr
+	return nil
+}
+
+func resolveAddress(entity ServerEntity) (string, error) {
+	addrs, err := resolveAddresses(entity)
+	if err != nil {
+		return "", err
+	}
+	return addrs[0], nil
+}
+
+// Every address able to serve the entity, nodes this node's breakers are
+// failing fast go last
+func resolveAddresses(entity ServerEntity) ([]string, error) {
+	if resolver == nil {
+		return nil, errors.New("rpcc: no resolver registered for " + entity.Logical_service)
+	}
+
+	addrs, err := resolver.Resolve(entity)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, ErrNoLiveAddress
+	}
+
+	ready := make([]string, 0, len(addrs))
+	tripped := make([]string, 0)
+	for _, addr := range addrs {
+		if breakerReady(addr) {
+			ready = append(ready, addr)
+		} else {
+			tripped = append(tripped, addr)
+		}
+	}
+	return append(ready, tripped...), nil
+}
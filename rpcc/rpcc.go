@@ -1,6 +1,7 @@
 package rpcc
 
 import (
+    "errors"
 	"fmt" 
 	"net/rpc"
 	"time"
@@ -19,6 +20,8 @@ type ServerEntity struct {
 	Service_info    string
 	Entry           string
     Args            interface{}    // The arguments passed to the first server
+    Logical_service string         // Logical service name, resolved to Connection_info at hop time
+    Sub             *RPCChain      // A whole sub-chain run as this hop, holds its result once completed
 }
 
 type RPCChain struct {
@@ -29,6 +32,25 @@ type RPCChain struct {
     mutex           *sync.Mutex
     Log             []byte 
     IsReturnCall    bool // false: forwards, true: backwards
+    Parents         []*RPCChain // Chains waiting on this sub-chain, innermost last
+    Err             string      // Error reported by a hop through Fail
+    Trace           []Hop       // Every hop dispatched so far, in order
+    Hedge           *HedgeClaim // Set on the copies of a hedged hop until one of them goes on
+    Relay           string      // Node every hop is sent through, see RelayThrough
+    relayed         bool        // Set on the relay node, which sends the hop on itself
+}
+
+// A hop dispatched along the chain, kept for tracing and rendering
+type Hop struct {
+    Position     int
+    Service      string
+    Entry        string
+    Connection   string
+    IsReturnCall bool
+    Err          string // Why the hop could not be delivered
+    Timeout      int    // Ms the hop was given before timing out
+    Sent         time.Time // On the sender's clock
+    Received     time.Time // On the node's clock, zero until the node got the hop
 }
 
 type ErrorFunc func(chain *RPCChain, error string)
@@ -38,6 +60,10 @@ type TimeoutFunc func(chain *RPCChain)
 var lastIdUsed int
 var errorHandler ErrorFunc = nil
 var timeoutHandler TimeoutFunc = nil
+var resolver Resolver = nil
+
+var ErrHopTimeout = errors.New("rpcc: hop timed out")
+var ErrNoHop = errors.New("rpcc: no hop left to call")
 
 /* === Functions === */
 // RPCC's public functions
@@ -61,10 +87,6 @@ func CreateChain() *RPCChain {
 
 // Adds an entity to a chain
 func (chain *RPCChain) AddToChain(connectionInfo string, serviceInfo string, entryFunction string, args interface{}, index int) {
-    // Acquire lock and setup for release
-    chain.MutexLock()
-    defer chain.mutex.Unlock()
-
     // Create the server entity based on info provided
 	entity := ServerEntity{
 		Connection_info: connectionInfo,
@@ -73,13 +95,20 @@ func (chain *RPCChain) AddToChain(connectionInfo string, serviceInfo string, ent
         Args:            args,
 	}
 
-    // Append the entity to our chain
-	// TODO: entity or 0
-	chain.EntityList = append(chain.EntityList, entity)
-    if (index != -1) {
-        copy(chain.EntityList[index+1:], chain.EntityList[index:])
-        chain.EntityList[index] = entity
-    }
+    chain.addEntity(entity, index)
+}
+
+// Adds an entity naming a logical service to a chain, its address is picked
+// by the registered Resolver when the hop is dispatched
+func (chain *RPCChain) AddLogicalToChain(logicalService string, serviceInfo string, entryFunction string, args interface{}, index int) {
+	entity := ServerEntity{
+		Service_info:    serviceInfo,
+		Entry:           entryFunction,
+        Args:            args,
+        Logical_service: logicalService,
+	}
+
+    chain.addEntity(entity, index)
 }
 
 func (chain *RPCChain) AddLogToChain(logBuf []byte) {
@@ -92,6 +121,11 @@ func (chain *RPCChain) ChangeDirection() {
 
 
 func (chain *RPCChain) CallNext(timeout int) error {
+    // A completed sub-chain continues its parent instead of wrapping around
+    if (chain.CurrentPosition == len(chain.EntityList)-1 && len(chain.Parents) > 0) {
+        return chain.ReturnToParent(timeout)
+    }
+
     // Forward to CallIndex function
     nextEntity := (chain.CurrentPosition+1) % len(chain.EntityList)
     return chain.CallIndex(nextEntity, timeout)
@@ -102,32 +136,87 @@ func (chain *RPCChain) CallIndex(index int, timeout int) error {
     chain.MutexLock()
     defer chain.mutex.Unlock()
 
+    // Sub-chains run once on the way out, the chain steps over them otherwise
+    index = chain.skipSubChains(index)
+    if (index < 0) {
+        return ErrNoHop
+    }
+
+    // Relayed chains go back to the relay node, it sends the hop on
+    if (chain.relaying()) {
+        return chain.callRelay(index, timeout)
+    }
+
+    // The copies of a hedged hop race to move the chain on, only the first may
+    if (chain.Hedge != nil && !chain.hedged(index) && !chain.claimHedge()) {
+        return ErrHedgeLost
+    }
+
 	// Prepare RPCC
     chain.CurrentPosition = index
+    err := chain.resolveEntity(index)
 	entity := chain.EntityList[chain.CurrentPosition]
+    chain.addTrace(entity, err)
+    if (!checkError(chain, err)) {
+        return err
+    }
+
+    // The hop is a nested chain, run it in place of a single server
+    if (entity.Sub != nil) {
+        return chain.callSubChain(index, timeout)
+    }
     
-    // Register our interface types
-    for _, serverEntry := range chain.EntityList {
-        if (serverEntry.Args != nil) {
-            gob.Register(serverEntry.Args)
-            //fmt.Println(reflect.TypeOf(serverEntry.Args))
+    // Fail fast while the node's circuit breaker is open, a logical service
+    // moves on to its next replica whose breaker lets the hop through
+    err = chain.allowEntity(index)
+    if (err != nil) {
+        chain.failTrace(err)
+        chain.Err = err.Error()
+        chain.Success = 0
+        if (errorHandler != nil && !chain.hedged(index)) {
+            errorHandler(chain, err.Error())
         }
+        return err
     }
+    entity = chain.EntityList[index]
+
+    // Register our interface types
+    registerArgs(chain)
     
-    // Setup timeout procedure
-	go chain.timeoutTrigger(timeout)
-    
-    // Dial via RPC
-    var returnVal bool
-    service, err := rpc.Dial("tcp", entity.Connection_info)
-    checkError(chain, err)
-    
-    // Call
-	err = service.Call(entity.Service_info+"."+entity.Entry, chain, &returnVal)
-    checkError(chain, err)
+    // Setup timeout procedure, from the latencies seen so far if there are enough
+    timeout = hopTimeout(entity, timeout)
+    chain.Trace[len(chain.Trace)-1].Timeout = timeout
     
-    if (service != nil) {
-        service.Close()
+    // Stamp the causal log and call via the transport, giving up once the timeout runs out
+    chain.traceSend(entity)
+    sent := clock.Now()
+    countHop()
+    returnVal, err := chain.callTransport(entity, timeout)
+    if (err == ErrHopTimeout) {
+        // The hop waits on every hop the node calls in turn, so the time may well
+        // have been lost further down. Neither the node's breaker nor its latencies
+        // are charged, and the node may still complete the hop after we gave up.
+        chain.failTrace(err)
+        chain.Err = err.Error()
+        chain.Success = 0
+        chain.timedOut()
+        return err
+    }
+    if (err != nil) {
+        chain.failTrace(err)
+    } else {
+        chain.traceReply(entity)
+    }
+
+    // Like the timeout, the latency covers the rest of the chain down from the node
+    reportHop(entity.Connection_info, err != nil)
+    if (err == nil) {
+        recordLatency(entity, clock.Now().Sub(sent))
+    }
+
+    // A hedged copy leaves its error to HedgeNext, the other copy may still get through
+    if (!chain.hedged(index)) {
+        checkError(chain, err)
     }
     
     // Check success
@@ -136,7 +225,8 @@ func (chain *RPCChain) CallIndex(index int, timeout int) error {
     } else {
         chain.Success = 0
         
-        if (errorHandler != nil) {
+        // A failed call was already handled by checkError, a hedged one is left to HedgeNext
+        if (errorHandler != nil && err == nil && !chain.hedged(index)) {
             errorHandler(chain, "Remote server returned failure")
         }
     }
@@ -177,12 +267,19 @@ func (chain *RPCChain) FindEntity(connectionInfo string) *ServerEntity {
 }
 
 func Dial(entity ServerEntity) (*rpc.Client,error) {
-    service, err := rpc.Dial("tcp", entity.Connection_info)
-    return service, err
+    if (entity.Connection_info == "" && entity.Logical_service != "") {
+        addr, err := resolveAddress(entity)
+        if (err != nil) {
+            return nil, err
+        }
+        entity.Connection_info = addr
+    }
+
+    return transport.Dial(entity.Connection_info)
 }
 
 func (chain *RPCChain) CheckDial(entity ServerEntity) bool {
-    service, err := rpc.Dial("tcp", entity.Connection_info)
+    service, err := transport.Dial(entity.Connection_info)
     
     if (service != nil) {
         service.Close()
@@ -191,6 +288,43 @@ func (chain *RPCChain) CheckDial(entity ServerEntity) bool {
     return checkError(chain, err)
 }
 
+// Nearest completed sub-chain hop before the current position, nil if there is none
+func (chain *RPCChain) LastSubChain() *RPCChain {
+    for i := chain.CurrentPosition - 1; i >= 0; i-- {
+        if (chain.EntityList[i].Sub != nil) {
+            return chain.EntityList[i].Sub
+        }
+    }
+
+    return nil
+}
+
+// How long the node of the last hop to position held the chain before sending it on,
+// on that node's own clock. False if that hop and the next weren't both traced.
+func (chain *RPCChain) HopDuration(position int) (time.Duration, bool) {
+    entity := chain.EntityList[position]
+    for k := len(chain.Trace) - 2; k >= 0; k-- {
+        hop := chain.Trace[k]
+        if (hop.Position != position || hop.Connection != entity.Connection_info) {
+            continue
+        }
+        if (hop.Err != "" || hop.Received.IsZero()) {
+            return 0, false
+        }
+        return chain.Trace[k+1].Sent.Sub(hop.Received), true
+    }
+
+    return 0, false
+}
+
+// Chain this sub-chain will return to, nil for a top level chain
+func (chain *RPCChain) Parent() *RPCChain {
+    if (len(chain.Parents) == 0) {
+        return nil
+    }
+    return chain.Parents[len(chain.Parents)-1]
+}
+
 func (chain *RPCChain) MutexLock() {
     if (chain.mutex == nil) {
         chain.mutex = &sync.Mutex{};
@@ -204,18 +338,73 @@ func (chain *RPCChain) MutexUnlock() {
 
 /* == Private Functions == */
 // RPCC's internal functions
+func (chain *RPCChain) addEntity(entity ServerEntity, index int) {
+    // Acquire lock and setup for release
+    chain.MutexLock()
+    defer chain.mutex.Unlock()
+
+    // Append the entity to our chain
+	// TODO: entity or 0
+	chain.EntityList = append(chain.EntityList, entity)
+    if (index != -1) {
+        copy(chain.EntityList[index+1:], chain.EntityList[index:])
+        chain.EntityList[index] = entity
+    }
+}
+
 func generateUniqueId() string {
     uniqueId := ""
 	lastIdUsed++
     
-    randSource := rand.NewSource(time.Now().UnixNano())
+    randSource := rand.NewSource(clock.Now().UnixNano())
     randSeed := rand.New(randSource)
     
-    unixTimestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    unixTimestamp := strconv.FormatInt(clock.Now().Unix(), 10)
     uniqueId = strconv.Itoa(lastIdUsed) + unixTimestamp + strconv.Itoa(randSeed.Intn(10000))
 	return uniqueId
 }
 
+func (chain *RPCChain) addTrace(entity ServerEntity, err error) {
+    hop := Hop{
+        Position:     chain.CurrentPosition,
+        Service:      entity.Service_info,
+        Entry:        entity.Entry,
+        Connection:   entity.Connection_info,
+        IsReturnCall: chain.IsReturnCall,
+        Sent:         clock.Now(),
+    }
+    if (err != nil) {
+        hop.Err = err.Error()
+    }
+    chain.Trace = append(chain.Trace, hop)
+
+    if (err != nil) {
+        chain.record(true)
+    }
+}
+
+// Marks the last hop as failed and keeps a record of where the chain stopped,
+// tagged as sent since the node never received it
+func (chain *RPCChain) failTrace(err error) {
+    chain.Trace[len(chain.Trace)-1].Err = err.Error()
+    chain.record(true)
+}
+
+// Registers the Args of every entity, including sub-chains and parents, with gob
+func registerArgs(chain *RPCChain) {
+    for _, serverEntry := range chain.EntityList {
+        if (serverEntry.Args != nil) {
+            gob.Register(serverEntry.Args)
+        }
+        if (serverEntry.Sub != nil) {
+            registerArgs(serverEntry.Sub)
+        }
+    }
+    for _, parent := range chain.Parents {
+        registerArgs(parent)
+    }
+}
+
 func checkError(chain *RPCChain, err error) bool {
 	if err != nil {
         if (errorHandler != nil) {
@@ -231,17 +420,32 @@ func checkError(chain *RPCChain, err error) bool {
     return true
 }
 
-func (chain *RPCChain) timeoutTrigger(timeout int) {
-    // Acquire lock and setup for release
-    chain.MutexLock()
-    defer chain.mutex.Unlock()
-
-	time.Sleep(time.Duration(timeout) * time.Millisecond)
-
-	if chain.Success == 1 {
-		return
-	}
+// Calls the hop over the transport, ErrHopTimeout once the timeout runs out. The call is
+// abandoned then, a late reply is dropped, but the node may still run the hop and
+// move the chain on. The transport gets a copy of the chain so the
+// abandoned call never sees the chain change under it.
+func (chain *RPCChain) callTransport(entity ServerEntity, timeout int) (bool, error) {
+    type result struct {
+        returnVal bool
+        err       error
+    }
+    results := make(chan result, 1)
+    sent := snapshotChain(chain)
+    go func() {
+        var returnVal bool
+        err := transport.Call(entity.Connection_info, entity.Service_info+"."+entity.Entry, sent, &returnVal)
+        results <- result{returnVal, err}
+    }()
+
+    select {
+    case r := <-results:
+        return r.returnVal, r.err
+    case <-clock.After(time.Duration(timeout) * time.Millisecond):
+        return false, ErrHopTimeout
+    }
+}
 
+func (chain *RPCChain) timedOut() {
 	if (timeoutHandler != nil) {
         // Custom Handler
         timeoutHandler(chain)
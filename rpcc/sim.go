@@ -0,0 +1,283 @@
+package rpcc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* === Headers === */
+
+// Faults injected on calls to an address, a zero Fault delivers normally
+type Fault struct {
+	Delay     time.Duration // Wait before delivering
+	Drop      bool          // Lose the call, the caller gets ErrDropped
+	Duplicate bool          // Deliver the call twice
+	Crash     bool          // Deliver the call, then crash the node before it replies
+	Times     int           // Apply to this many calls only, 0 for every call
+}
+
+// A call seen by the simulator, chain hops carry their chain's position
+type SimHop struct {
+	Address       string
+	ServiceMethod string
+	ChainId       string
+	Position      int
+	IsReturnCall  bool
+	Chain         *RPCChain // Snapshot of the chain as it was delivered
+	Err           string
+}
+
+// Hosts rpcc services in one process over an in-memory transport
+type Simulator struct {
+	mutex   sync.Mutex
+	servers map[string]*rpc.Server
+	crashed map[string]bool
+	faults  map[string][]*Fault
+	hops    []SimHop
+	errors  []string
+}
+
+var ErrDropped = errors.New("rpcc: simulated call dropped")
+var ErrCrashed = errors.New("rpcc: simulated node crashed")
+
+/* === Functions === */
+// Creates a simulator and installs it as the transport, errors from chains
+// are collected instead of halting the process. Breakers and latencies start afresh.
+func NewSimulator() *Simulator {
+	sim := &Simulator{
+		servers: make(map[string]*rpc.Server),
+		crashed: make(map[string]bool),
+		faults:  make(map[string][]*Fault),
+	}
+
+	resetBreakers()
+	resetLatencies()
+	SetTransport(sim)
+	RegisterErrorHandler(func(chain *RPCChain, error string) {
+		sim.mutex.Lock()
+		sim.errors = append(sim.errors, chain.Id+": "+error)
+		sim.mutex.Unlock()
+	})
+	return sim
+}
+
+// Puts the TCP transport and default error handling back
+func (sim *Simulator) Close() {
+	SetTransport(TCPTransport{})
+	RegisterErrorHandler(nil)
+}
+
+// Hosts a service under name at address, like rpc.RegisterName on a node's listener
+func (sim *Simulator) Host(address string, name string, rcvr interface{}) error {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	server, ok := sim.servers[address]
+	if !ok {
+		server = rpc.NewServer()
+		sim.servers[address] = server
+		server.RegisterName("RPCCBlobService", new(BlobService))
+		server.RegisterName("RPCCStatusService", new(StatusService))
+		server.RegisterName("RPCCHedgeService", new(HedgeService))
+		server.RegisterName("RPCCRelayService", new(RelayService))
+	}
+	return server.RegisterName(name, rcvr)
+}
+
+// Injects a fault on calls to address, serviceMethod "" matches every method
+func (sim *Simulator) Inject(address string, serviceMethod string, fault Fault) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	key := address + "/" + serviceMethod
+	f := fault
+	sim.faults[key] = append(sim.faults[key], &f)
+}
+
+// Clears every fault injected on address
+func (sim *Simulator) Heal(address string) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	for key := range sim.faults {
+		if strings.HasPrefix(key, address+"/") {
+			delete(sim.faults, key)
+		}
+	}
+}
+
+func (sim *Simulator) Crash(address string) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	sim.crashed[address] = true
+}
+
+func (sim *Simulator) Restart(address string) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	delete(sim.crashed, address)
+}
+
+// Every call made through the simulator, in order
+func (sim *Simulator) Hops() []SimHop {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	return append([]SimHop{}, sim.hops...)
+}
+
+// The "Service.Entry" of every chain hop delivered, in order
+func (sim *Simulator) HopSequence() []string {
+	sequence := make([]string, 0)
+	for _, hop := range sim.Hops() {
+		if hop.Chain != nil && hop.Err == "" {
+			sequence = append(sequence, hop.ServiceMethod)
+		}
+	}
+	return sequence
+}
+
+// Checks the delivered chain hops against the expected "Service.Entry" sequence
+func (sim *Simulator) ExpectHops(expected ...string) error {
+	actual := sim.HopSequence()
+	if strings.Join(actual, " ") != strings.Join(expected, " ") {
+		return fmt.Errorf("hops %v, expected %v", actual, expected)
+	}
+	return nil
+}
+
+// The chain as last delivered to a hop, the final result once it completes
+func (sim *Simulator) LastChain(chainId string) *RPCChain {
+	hops := sim.Hops()
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i].ChainId == chainId && hops[i].Chain != nil && hops[i].Err == "" {
+			return hops[i].Chain
+		}
+	}
+	return nil
+}
+
+// Errors reported by chains while the simulator was installed
+func (sim *Simulator) Errors() []string {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	return append([]string{}, sim.errors...)
+}
+
+/* == Transport == */
+func (sim *Simulator) Dial(address string) (*rpc.Client, error) {
+	sim.mutex.Lock()
+	server, ok := sim.servers[address]
+	crashed := sim.crashed[address]
+	sim.mutex.Unlock()
+
+	if !ok || crashed {
+		return nil, &net.OpError{Op: "dial", Net: "mem", Err: ErrCrashed}
+	}
+
+	clientConn, serverConn := net.Pipe()
+	go server.ServeCodec(NewServerCodec(serverConn))
+	return rpc.NewClient(clientConn), nil
+}
+
+func (sim *Simulator) Call(address string, serviceMethod string, args interface{}, reply interface{}) error {
+	hop := SimHop{Address: address, ServiceMethod: serviceMethod}
+	if chain, ok := args.(*RPCChain); ok {
+		hop.ChainId = chain.Id
+		hop.Position = chain.CurrentPosition
+		hop.IsReturnCall = chain.IsReturnCall
+		hop.Chain = snapshotChain(chain)
+	}
+
+	fault := sim.takeFault(address, serviceMethod)
+	if fault.Delay > 0 {
+		clock.Sleep(fault.Delay)
+	}
+	if fault.Drop {
+		sim.finishHop(sim.startHop(hop), ErrDropped)
+		return ErrDropped
+	}
+
+	deliveries := 1
+	if fault.Duplicate {
+		deliveries = 2
+	}
+
+	var err error
+	for i := 0; i < deliveries; i++ {
+		n := sim.startHop(hop)
+		err = sim.deliver(address, serviceMethod, args, reply)
+		sim.finishHop(n, err)
+	}
+
+	if fault.Crash {
+		sim.Crash(address)
+		return ErrCrashed
+	}
+	return err
+}
+
+/* == Private Functions == */
+func (sim *Simulator) deliver(address string, serviceMethod string, args interface{}, reply interface{}) error {
+	service, err := sim.Dial(address)
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	return service.Call(serviceMethod, args, reply)
+}
+
+// Pops the fault to apply to this call, method specific faults first
+func (sim *Simulator) takeFault(address string, serviceMethod string) Fault {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	for _, key := range []string{address + "/" + serviceMethod, address + "/"} {
+		faults := sim.faults[key]
+		if len(faults) == 0 {
+			continue
+		}
+
+		fault := faults[0]
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				sim.faults[key] = faults[1:]
+			}
+		}
+		return *fault
+	}
+	return Fault{}
+}
+
+// Hops are kept in the order they were dispatched, nested hops complete first
+func (sim *Simulator) startHop(hop SimHop) int {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	sim.hops = append(sim.hops, hop)
+	return len(sim.hops) - 1
+}
+
+func (sim *Simulator) finishHop(n int, err error) {
+	if err == nil {
+		return
+	}
+
+	sim.mutex.Lock()
+	sim.hops[n].Err = err.Error()
+	sim.mutex.Unlock()
+}
+
+func snapshotChain(chain *RPCChain) *RPCChain {
+	snapshot := *chain
+	snapshot.mutex = nil
+	snapshot.EntityList = append([]ServerEntity{}, chain.EntityList...)
+	snapshot.Trace = append([]Hop{}, chain.Trace...)
+	return &snapshot
+}
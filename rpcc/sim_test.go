@@ -0,0 +1,390 @@
+package rpcc
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A node of the test chains, it moves the chain on like the services do
+type simNode struct{}
+
+const nodeTimeout = 1000 // Ms the nodes give their next hop
+
+var hopsServed int64 // Hop calls returned since the simulator was installed
+
+func (n *simNode) Hop(chain RPCChain, reply *bool) error {
+	defer atomic.AddInt64(&hopsServed, 1)
+	*reply = true
+	if chain.CurrentPosition < len(chain.EntityList)-1 {
+		chain.CallNext(nodeTimeout)
+	}
+	return nil
+}
+
+// Installs a simulator hosting nodes A, B and C on a fake clock, both are put back when t ends
+func newTestSim(t *testing.T) (*Simulator, *FakeClock, *[]string) {
+	fake := NewFakeClock(time.Unix(0, 0))
+	SetClock(fake)
+	sim := NewSimulator()
+	atomic.StoreInt64(&hopsServed, 0)
+
+	timeouts := make([]string, 0)
+	RegisterTimeoutHandler(func(chain *RPCChain) { timeouts = append(timeouts, chain.Id) })
+
+	for _, name := range []string{"A", "B", "C"} {
+		if err := sim.Host(strings.ToLower(name), name, new(simNode)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Cleanup(func() {
+		sim.Close()
+		RegisterTimeoutHandler(nil)
+		RegisterResolver(nil)
+		SetClock(RealClock{})
+	})
+	return sim, fake, &timeouts
+}
+
+func testChain() *RPCChain {
+	chain := CreateChain()
+	chain.AddToChain("a", "A", "Hop", nil, -1)
+	chain.AddToChain("b", "B", "Hop", nil, -1)
+	chain.AddToChain("c", "C", "Hop", nil, -1)
+	return chain
+}
+
+// Runs the chain from its first hop, the clock is moved on by step once that many
+// waiters are on it. Nothing is advanced for a step of 0.
+func runChain(t *testing.T, fake *FakeClock, chain *RPCChain, waiters int, step time.Duration) {
+	done := make(chan error, 1)
+	go func() { done <- chain.CallIndex(0, 5*nodeTimeout) }()
+
+	if step > 0 {
+		fake.BlockUntil(waiters)
+		fake.Advance(step)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("chain didn't complete")
+	}
+}
+
+// Waits for the delivered hops to reach the expected sequence
+func waitHops(t *testing.T, sim *Simulator, expected ...string) {
+	deadline := time.Now().Add(time.Second)
+	for sim.ExpectHops(expected...) != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := sim.ExpectHops(expected...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimulatorFaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  string
+		method   string
+		fault    Fault
+		waiters  int           // Timers set once the chain waits on the fault
+		advance  time.Duration // How far the clock is moved then
+		hops     []string      // Delivered by the time the chain returns
+		late     []string      // Delivered once the fault's delay has run out, if not the same
+		position int           // Of the last hop the chain was delivered to
+		err      string        // Reported through the error handler, "" for none
+		timeouts int
+	}{
+		{
+			name:     "in order",
+			hops:     []string{"A.Hop", "B.Hop", "C.Hop"},
+			position: 2,
+		},
+		{
+			name:     "drop",
+			address:  "b",
+			fault:    Fault{Drop: true, Times: 1},
+			hops:     []string{"A.Hop"},
+			position: 0,
+			err:      ErrDropped.Error(),
+		},
+		{
+			name:     "duplicate",
+			address:  "c",
+			method:   "C.Hop",
+			fault:    Fault{Duplicate: true, Times: 1},
+			hops:     []string{"A.Hop", "B.Hop", "C.Hop", "C.Hop"},
+			position: 2,
+		},
+		{
+			// Outer hop, B's hop and the delay itself
+			name:     "delay",
+			address:  "b",
+			fault:    Fault{Delay: 50 * time.Millisecond},
+			waiters:  3,
+			advance:  50 * time.Millisecond,
+			hops:     []string{"A.Hop", "B.Hop", "C.Hop"},
+			position: 2,
+		},
+		{
+			name:     "delay past the timeout",
+			address:  "b",
+			fault:    Fault{Delay: 2 * nodeTimeout * time.Millisecond, Times: 1},
+			waiters:  3,
+			advance:  nodeTimeout * time.Millisecond,
+			hops:     []string{"A.Hop"},
+			late:     []string{"A.Hop", "B.Hop", "C.Hop"},
+			position: 0,
+			timeouts: 1,
+		},
+		{
+			// B is delivered and calls C before it goes down
+			name:     "crash",
+			address:  "b",
+			fault:    Fault{Crash: true, Times: 1},
+			hops:     []string{"A.Hop", "B.Hop", "C.Hop"},
+			position: 2,
+			err:      ErrCrashed.Error(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim, fake, timeouts := newTestSim(t)
+			if test.address != "" {
+				sim.Inject(test.address, test.method, test.fault)
+			}
+
+			chain := testChain()
+			runChain(t, fake, chain, test.waiters, test.advance)
+
+			if err := sim.ExpectHops(test.hops...); err != nil {
+				t.Error(err)
+			}
+			if last := sim.LastChain(chain.Id); last == nil || last.CurrentPosition != test.position {
+				t.Errorf("last delivered %+v, expected at position %d", last, test.position)
+			}
+
+			// A failed hop is reported once, not again as a failed reply
+			errors := sim.Errors()
+			if (test.err == "") != (len(errors) == 0) || len(errors) > 1 ||
+				!strings.Contains(strings.Join(errors, "\n"), test.err) {
+				t.Errorf("errors %q, expected %q once", errors, test.err)
+			}
+			if len(*timeouts) != test.timeouts {
+				t.Errorf("%d timeouts, expected %d", len(*timeouts), test.timeouts)
+			}
+			// The time may have been lost further down, the node isn't held to it
+			if test.timeouts > 0 {
+				for _, status := range Breakers() {
+					if status.Failures > 0 {
+						t.Errorf("timed out hop counted against %s", status.Address)
+					}
+				}
+			}
+
+			// The abandoned hop is still delivered once its delay runs out,
+			// the test ends once it is served all the way
+			if test.late != nil {
+				fake.Advance(test.fault.Delay)
+				waitHops(t, sim, test.late...)
+				for atomic.LoadInt64(&hopsServed) < int64(len(test.late)) {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		})
+	}
+}
+
+func TestSimulatorHealAndRestart(t *testing.T) {
+	sim, fake, _ := newTestSim(t)
+
+	sim.Inject("b", "", Fault{Drop: true})
+	runChain(t, fake, testChain(), 0, 0)
+	runChain(t, fake, testChain(), 0, 0)
+	waitHops(t, sim, "A.Hop", "A.Hop")
+
+	sim.Heal("b")
+	runChain(t, fake, testChain(), 0, 0)
+	waitHops(t, sim, "A.Hop", "A.Hop", "A.Hop", "B.Hop", "C.Hop")
+
+	sim.Crash("c")
+	runChain(t, fake, testChain(), 0, 0)
+	sim.Restart("c")
+	runChain(t, fake, testChain(), 0, 0)
+	waitHops(t, sim, "A.Hop", "A.Hop", "A.Hop", "B.Hop", "C.Hop", "A.Hop", "B.Hop", "A.Hop", "B.Hop", "C.Hop")
+
+	if len(sim.Errors()) == 0 {
+		t.Error("no errors reported for the dropped and crashed hops")
+	}
+}
+
+func TestSimulatorStaticResolver(t *testing.T) {
+	sim, fake, _ := newTestSim(t)
+	for _, addr := range []string{"b1", "b2"} {
+		if err := sim.Host(addr, "B", new(simNode)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	RegisterResolver(StaticResolver{"B": {"b1", "b2"}})
+
+	logicalChain := func() *RPCChain {
+		chain := CreateChain()
+		chain.AddToChain("a", "A", "Hop", nil, -1)
+		chain.AddLogicalToChain("B", "B", "Hop", nil, -1)
+		return chain
+	}
+	lastAddress := func() string {
+		hops := sim.Hops()
+		return hops[len(hops)-1].Address
+	}
+
+	runChain(t, fake, logicalChain(), 0, 0)
+	if addr := lastAddress(); addr != "b1" {
+		t.Fatalf("logical hop served by %s, expected the first address b1", addr)
+	}
+
+	// Enough failed hops open b1's breaker, the next chain moves on to b2
+	sim.Crash("b1")
+	for i := 0; i < DefaultBreakerConfig.Failures; i++ {
+		runChain(t, fake, logicalChain(), 0, 0)
+	}
+	runChain(t, fake, logicalChain(), 0, 0)
+	if addr := lastAddress(); addr != "b2" {
+		t.Fatalf("logical hop served by %s with b1's breaker open, expected b2", addr)
+	}
+
+	// Once the breaker lets a probe through, the restarted b1 serves again
+	sim.Restart("b1")
+	fake.Advance(DefaultBreakerConfig.OpenFor)
+	runChain(t, fake, logicalChain(), 0, 0)
+	if addr := lastAddress(); addr != "b1" {
+		t.Fatalf("logical hop served by %s after the probe, expected b1", addr)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	fake := NewFakeClock(time.Unix(0, 0))
+	timer := fake.After(time.Second)
+	ticker := fake.NewTicker(400 * time.Millisecond)
+	defer ticker.Stop()
+
+	if fake.Waiters() != 2 {
+		t.Fatalf("%d waiters, expected 2", fake.Waiters())
+	}
+
+	fake.Advance(500 * time.Millisecond)
+	select {
+	case <-timer:
+		t.Fatal("timer fired early")
+	case at := <-ticker.C:
+		if at != time.Unix(0, 0).Add(400*time.Millisecond) {
+			t.Errorf("ticked at %v", at)
+		}
+	}
+
+	fake.Advance(500 * time.Millisecond)
+	if at := <-timer; at != time.Unix(1, 0) {
+		t.Errorf("timer fired at %v", at)
+	}
+	if now := fake.Now(); now != time.Unix(1, 0) {
+		t.Errorf("clock at %v after advancing a second", now)
+	}
+	if fake.Waiters() != 1 {
+		t.Errorf("%d waiters, expected the ticker only", fake.Waiters())
+	}
+}
+
+func TestRelay(t *testing.T) {
+	tests := []struct {
+		name string
+		down bool
+		hops []string
+	}{
+		{
+			// Only the chain hops are logged, not the forwards to the relay
+			name: "relayed",
+			hops: []string{"A.Hop", "B.Hop", "C.Hop"},
+		},
+		{
+			// The caller gets the error, nothing is reported or halted
+			name: "relay down",
+			down: true,
+			hops: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim, _, _ := newTestSim(t)
+			if err := sim.Host("r", "R", new(simNode)); err != nil {
+				t.Fatal(err)
+			}
+			if test.down {
+				sim.Crash("r")
+			}
+
+			chain := testChain()
+			chain.RelayThrough("r")
+			err := chain.CallIndex(0, nodeTimeout)
+			if (err != nil) != test.down {
+				t.Errorf("relayed chain returned %v", err)
+			}
+			if err := sim.ExpectHops(test.hops...); err != nil {
+				t.Error(err)
+			}
+			if errors := sim.Errors(); len(errors) > 0 {
+				t.Errorf("errors %v", errors)
+			}
+		})
+	}
+}
+
+// Holds the chain for a while before moving it on
+type holdNode struct {
+	hold time.Duration
+}
+
+func (n *holdNode) Hop(chain RPCChain, reply *bool) error {
+	*reply = true
+	Sleep(n.hold)
+	chain.CallNext(nodeTimeout)
+	return nil
+}
+
+func TestHopDuration(t *testing.T) {
+	sim, fake, _ := newTestSim(t)
+	if err := sim.Host("h", "H", &holdNode{hold: 30 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	chain := CreateChain()
+	chain.AddToChain("a", "A", "Hop", nil, -1)
+	chain.AddToChain("h", "H", "Hop", nil, -1)
+	chain.AddToChain("c", "C", "Hop", nil, -1)
+	// The outer hop, A's hop to H and H's hold
+	runChain(t, fake, chain, 3, 30*time.Millisecond)
+
+	last := sim.LastChain(chain.Id)
+	if last == nil || last.CurrentPosition != 2 {
+		t.Fatalf("last delivered %+v, expected at C", last)
+	}
+	tests := []struct {
+		position int
+		took     time.Duration
+		ok       bool
+	}{
+		{position: 0, took: 0, ok: true},
+		{position: 1, took: 30 * time.Millisecond, ok: true},
+		{position: 2, ok: false}, // C hasn't sent the chain on
+	}
+	for _, test := range tests {
+		if took, ok := last.HopDuration(test.position); took != test.took || ok != test.ok {
+			t.Errorf("position %d held the chain %v (%v), expected %v (%v)", test.position, took, ok, test.took, test.ok)
+		}
+	}
+}
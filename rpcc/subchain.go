@@ -0,0 +1,102 @@
+package rpcc
+
+import (
+	"errors"
+	"strconv"
+)
+
+/* === Functions === */
+// Adds a hop that runs a whole sub-chain. The last hop of the sub-chain must call
+// CallNext like any other hop, that runs ReturnToParent and the parent continues at
+// the next position. A hop that can't go on returns the sub-chain early with Fail,
+// the parent's next hop finds the error in LastSubChain().Err.
+func (chain *RPCChain) AddSubChainToChain(sub *RPCChain, index int) {
+	entity := ServerEntity{
+		Service_info: "SubChain",
+		Entry:        sub.FirstEntity().Entry,
+		Sub:          sub,
+	}
+
+	chain.addEntity(entity, index)
+}
+
+// Hands the sub-chain's result back to the parent and calls its next hop
+func (chain *RPCChain) ReturnToParent(timeout int) error {
+	if len(chain.Parents) == 0 {
+		return errors.New("rpcc: chain " + chain.Id + " is not a sub-chain")
+	}
+
+	last := len(chain.Parents) - 1
+	parent := chain.Parents[last]
+	parent.Parents = chain.Parents[:last]
+
+	// The completed sub-chain is visible to the parent's next hop
+	done := *chain
+	done.Parents = nil
+	done.mutex = nil
+	parent.EntityList[parent.CurrentPosition].Sub = &done
+	parent.Log = chain.Log
+	parent.Trace = append(parent.Trace, chain.Trace...)
+
+	return parent.CallNext(timeout)
+}
+
+// Records an error on the chain, a sub-chain returns to its parent straight away
+func (chain *RPCChain) Fail(error string, timeout int) error {
+	chain.Err = error
+	if len(chain.Parents) > 0 {
+		return chain.ReturnToParent(timeout)
+	}
+	return nil
+}
+
+/* == Private Functions == */
+// Pushes the parent on the sub-chain's stack and dispatches its first hop
+func (chain *RPCChain) callSubChain(index int, timeout int) error {
+	sub := chain.EntityList[index].Sub
+	sub.MutexLock()
+	sub.Id = chain.Id + "/" + strconv.Itoa(index)
+	sub.CurrentPosition = 0
+	sub.IsReturnCall = false
+	sub.Err = ""
+	sub.Log = chain.Log
+	sub.Trace = nil
+	sub.MutexUnlock()
+
+	// Copy the parent without the sub-chain itself, gob can't encode the cycle
+	parent := *chain
+	parent.mutex = nil
+	parent.Parents = nil
+	parent.EntityList = make([]ServerEntity, len(chain.EntityList))
+	copy(parent.EntityList, chain.EntityList)
+	parent.EntityList[index].Sub = nil
+
+	sub.Parents = append(append([]*RPCChain{}, chain.Parents...), &parent)
+
+	err := sub.CallIndex(0, timeout)
+	chain.Success = sub.Success
+	return err
+}
+
+// Moves index past the sub-chain hops that mustn't run again, every one of them
+// on the way back and the completed ones on the way out. -1 if no hop is left.
+func (chain *RPCChain) skipSubChains(index int) int {
+	step := 1
+	if chain.IsReturnCall {
+		step = -1
+	}
+
+	for index >= 0 && index < len(chain.EntityList) {
+		sub := chain.EntityList[index].Sub
+		if sub == nil || (!chain.IsReturnCall && !sub.completed()) {
+			return index
+		}
+		index += step
+	}
+	return -1
+}
+
+// A sub-chain that has run and been handed back to its parent
+func (chain *RPCChain) completed() bool {
+	return len(chain.Parents) == 0 && len(chain.Trace) > 0
+}
@@ -0,0 +1,186 @@
+package rpcc
+
+import (
+	"testing"
+)
+
+// A sub-chain hop, it calls Fail instead of CallNext when its node is set to fail
+type subNode struct {
+	fail bool
+}
+
+// The parent's hop after the sub-chain, it keeps what the sub-chain left
+type afterNode struct {
+	results chan *RPCChain
+}
+
+// Turns the chain around at its last hop and walks it back to the first
+type turnNode struct{}
+
+func (n *subNode) Hop(chain RPCChain, reply *bool) error {
+	*reply = true
+	if n.fail {
+		chain.Fail("sub-hop failed", nodeTimeout)
+		return nil
+	}
+	chain.CallNext(nodeTimeout)
+	return nil
+}
+
+func (n *afterNode) Hop(chain RPCChain, reply *bool) error {
+	*reply = true
+	n.results <- chain.LastSubChain()
+	return nil
+}
+
+func (n *turnNode) Hop(chain RPCChain, reply *bool) error {
+	*reply = true
+	switch {
+	case !chain.IsReturnCall && chain.CurrentPosition < len(chain.EntityList)-1:
+		chain.CallNext(nodeTimeout)
+	case !chain.IsReturnCall:
+		chain.ChangeDirection()
+		chain.CallIndex(chain.CurrentPosition-1, nodeTimeout)
+	case chain.CurrentPosition > 0:
+		chain.CallIndex(chain.CurrentPosition-1, nodeTimeout)
+	}
+	return nil
+}
+
+func TestSubChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		nested bool   // The second sub-hop is a sub-chain of its own
+		fail   string // Address of the sub-hop that fails, "" for none
+		hops   []string
+		err    string
+	}{
+		{
+			name: "success",
+			hops: []string{"A.Hop", "S.Hop", "S.Hop", "After.Hop"},
+		},
+		{
+			// The inner sub-chain's last hop returns through both parents
+			name:   "nested success",
+			nested: true,
+			hops:   []string{"A.Hop", "S.Hop", "S.Hop", "After.Hop"},
+		},
+		{
+			name:   "nested fail",
+			nested: true,
+			fail:   "s2",
+			hops:   []string{"A.Hop", "S.Hop", "S.Hop", "After.Hop"},
+			err:    "sub-hop failed",
+		},
+		{
+			// The second sub-hop is never reached
+			name: "fail",
+			fail: "s1",
+			hops: []string{"A.Hop", "S.Hop", "After.Hop"},
+			err:  "sub-hop failed",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim, fake, _ := newTestSim(t)
+			after := &afterNode{results: make(chan *RPCChain, 1)}
+			for _, addr := range []string{"s1", "s2"} {
+				if err := sim.Host(addr, "S", &subNode{fail: addr == test.fail}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := sim.Host("after", "After", after); err != nil {
+				t.Fatal(err)
+			}
+
+			sub := CreateChain()
+			sub.AddToChain("s1", "S", "Hop", nil, -1)
+			if test.nested {
+				inner := CreateChain()
+				inner.AddToChain("s2", "S", "Hop", nil, -1)
+				sub.AddSubChainToChain(inner, -1)
+			} else {
+				sub.AddToChain("s2", "S", "Hop", nil, -1)
+			}
+
+			chain := CreateChain()
+			chain.AddToChain("a", "A", "Hop", nil, -1)
+			chain.AddSubChainToChain(sub, -1)
+			chain.AddToChain("after", "After", "Hop", nil, -1)
+			runChain(t, fake, chain, 0, 0)
+
+			if err := sim.ExpectHops(test.hops...); err != nil {
+				t.Error(err)
+			}
+			if errors := sim.Errors(); len(errors) > 0 {
+				t.Errorf("errors %v", errors)
+			}
+
+			// The parent continued after the sub-chain, with its result
+			var result *RPCChain
+			select {
+			case result = <-after.results:
+			default:
+				t.Fatal("the parent didn't continue after the sub-chain")
+			}
+			if test.nested {
+				// What the parent sees is the outer sub-chain, the inner one holds the error
+				if result == nil || result.EntityList[1].Sub == nil {
+					t.Fatalf("sub-chain %+v, expected the inner one at position 1", result)
+				}
+				result = result.EntityList[1].Sub
+				if result.Err != test.err {
+					t.Fatalf("inner sub-chain %+v, expected error %q", result, test.err)
+				}
+				return
+			}
+			if result == nil || result.Err != test.err {
+				t.Fatalf("sub-chain %+v, expected error %q", result, test.err)
+			}
+			if result.Id != chain.Id+"/1" || len(result.Parents) != 0 {
+				t.Errorf("sub-chain %s with %d parents handed back", result.Id, len(result.Parents))
+			}
+		})
+	}
+}
+
+func TestSubChainReverse(t *testing.T) {
+	sim, fake, _ := newTestSim(t)
+	for _, addr := range []string{"t1", "t2"} {
+		if err := sim.Host(addr, "T", new(turnNode)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sim.Host("s1", "S", new(subNode)); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := CreateChain()
+	sub.AddToChain("s1", "S", "Hop", nil, -1)
+	chain := CreateChain()
+	chain.AddToChain("t1", "T", "Hop", nil, -1)
+	chain.AddSubChainToChain(sub, -1)
+	chain.AddToChain("t2", "T", "Hop", nil, -1)
+	runChain(t, fake, chain, 0, 0)
+
+	// The way back steps over the sub-chain instead of running it again
+	if err := sim.ExpectHops("T.Hop", "S.Hop", "T.Hop", "T.Hop"); err != nil {
+		t.Error(err)
+	}
+	if errors := sim.Errors(); len(errors) > 0 {
+		t.Errorf("errors %v", errors)
+	}
+	last := sim.LastChain(chain.Id)
+	if last == nil || last.CurrentPosition != 0 || !last.IsReturnCall {
+		t.Errorf("last delivered %+v, expected back at position 0", last)
+	}
+}
+
+func TestReturnToParentOfTopLevelChain(t *testing.T) {
+	chain := CreateChain()
+	chain.AddToChain("a", "A", "Hop", nil, -1)
+	if err := chain.ReturnToParent(nodeTimeout); err == nil {
+		t.Error("a top level chain returned to a parent")
+	}
+}
@@ -0,0 +1,223 @@
+package rpcc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/arcaneiceman/GoVector/govec"
+)
+
+/* === Headers === */
+
+// Causal tracing of chains, invoked by rpcc on every send and receive of a chain
+type Tracer interface {
+	PrepareSend(message string, payload interface{}) []byte
+	UnpackReceive(message string, buf []byte, payload interface{})
+	LogLocalEvent(message string)
+}
+
+// The payload carried in a chain's Log next to the clock
+type TraceMsg struct {
+	Content       string
+	RealTimestamp string
+}
+
+// Drops every event
+type NoopTracer struct{}
+
+// Logs through GoVector, the log is written to [node]-Log.txt
+type GoVectorTracer struct {
+	Logger *govec.GoLog
+}
+
+// A built-in vector clock, written to [node]-Log.txt in GoVector's log format
+type VectorClockTracer struct {
+	mutex sync.Mutex
+	node  string
+	clock map[string]uint64
+	log   *os.File
+}
+
+type vectorClockPacket struct {
+	Clock   map[string]uint64
+	Payload []byte
+}
+
+/* === Globals === */
+var tracer Tracer = NoopTracer{}
+
+/* === Functions === */
+func SetTracer(t Tracer) {
+	tracer = t
+}
+
+// Sets up the tracer named by kind for this node: "govec" (the default), "vclock" or "none"
+func InitTracer(node string, kind string) error {
+	kind, err := ParseTracer(kind)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case "govec":
+		SetTracer(NewGoVectorTracer(node, node))
+	case "vclock":
+		t, err := NewVectorClockTracer(node, node)
+		if err != nil {
+			return err
+		}
+		SetTracer(t)
+	case "none":
+		SetTracer(NoopTracer{})
+	}
+	return nil
+}
+
+// The tracer kind named, "" for the default
+func ParseTracer(kind string) (string, error) {
+	switch kind {
+	case "", "govec":
+		return "govec", nil
+	case "vclock", "none":
+		return kind, nil
+	}
+	return "", fmt.Errorf("rpcc: unknown tracer %q", kind)
+}
+
+// Records an event that isn't a send or receive, like committing a file
+func LogLocalEvent(message string) {
+	tracer.LogLocalEvent(message)
+}
+
+// Stamps a plain RPC (one that isn't a chain) so its receiver can merge the clock
+func PrepareSend(message string) []byte {
+	return tracer.PrepareSend(message, TraceMsg{message, clock.Now().String()})
+}
+
+// Merges the clock of a plain RPC stamped with PrepareSend
+func UnpackReceive(message string, buf []byte) {
+	tracer.UnpackReceive(message, buf, new(TraceMsg))
+}
+
+/* == No-op Tracer == */
+func (t NoopTracer) PrepareSend(message string, payload interface{}) []byte        { return nil }
+func (t NoopTracer) UnpackReceive(message string, buf []byte, payload interface{}) {}
+func (t NoopTracer) LogLocalEvent(message string)                                  {}
+
+/* == GoVector Tracer == */
+func NewGoVectorTracer(processId string, logFile string) *GoVectorTracer {
+	return &GoVectorTracer{Logger: govec.Initialize(processId, logFile)}
+}
+
+func (t *GoVectorTracer) PrepareSend(message string, payload interface{}) []byte {
+	return t.Logger.PrepareSend(message, payload)
+}
+
+func (t *GoVectorTracer) UnpackReceive(message string, buf []byte, payload interface{}) {
+	t.Logger.UnpackReceive(message, buf, payload)
+}
+
+func (t *GoVectorTracer) LogLocalEvent(message string) {
+	t.Logger.LogLocalEvent(message)
+}
+
+/* == Vector Clock Tracer == */
+func NewVectorClockTracer(node string, logFile string) (*VectorClockTracer, error) {
+	f, err := os.Create(logFile + "-Log.txt")
+	if err != nil {
+		return nil, err
+	}
+
+	t := &VectorClockTracer{node: node, clock: make(map[string]uint64), log: f}
+	t.LogLocalEvent("Initialization Complete")
+	return t, nil
+}
+
+func (t *VectorClockTracer) PrepareSend(message string, payload interface{}) []byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.tick(message)
+
+	var payloadBuf bytes.Buffer
+	gob.NewEncoder(&payloadBuf).Encode(payload)
+
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(vectorClockPacket{Clock: t.clock, Payload: payloadBuf.Bytes()})
+	return buf.Bytes()
+}
+
+func (t *VectorClockTracer) UnpackReceive(message string, buf []byte, payload interface{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var packet vectorClockPacket
+	if len(buf) != 0 && gob.NewDecoder(bytes.NewReader(buf)).Decode(&packet) == nil {
+		for node, ticks := range packet.Clock {
+			if ticks > t.clock[node] {
+				t.clock[node] = ticks
+			}
+		}
+		if payload != nil && len(packet.Payload) != 0 {
+			gob.NewDecoder(bytes.NewReader(packet.Payload)).Decode(payload)
+		}
+	}
+
+	t.tick(message)
+}
+
+func (t *VectorClockTracer) LogLocalEvent(message string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.tick(message)
+}
+
+// Must be called with the mutex held
+func (t *VectorClockTracer) tick(message string) {
+	t.clock[t.node]++
+
+	clock, _ := json.Marshal(t.clock)
+	fmt.Fprintf(t.log, "%s %s\n%s\n", t.node, clock, message)
+}
+
+/* == Private Functions == */
+// Stamps the chain's Log before its hop is sent
+func (chain *RPCChain) traceSend(entity ServerEntity) {
+	message := chain.traceMessage(entity, "to")
+	chain.Log = tracer.PrepareSend(message, TraceMsg{message, clock.Now().String()})
+}
+
+// Merges the chain's Log into this node's clock as soon as a hop is received
+func (chain *RPCChain) traceReceive() {
+	if len(chain.EntityList) == 0 {
+		return
+	}
+	tracer.UnpackReceive(chain.traceMessage(*chain.CurrentEntity(), "received by"), chain.Log, new(TraceMsg))
+}
+
+// Replies to a hop carry no clock, so both ends log them to let the causality
+// checker join the caller's "reply from" to the callee's "replied by"
+func (chain *RPCChain) replyMessage() string {
+	if len(chain.EntityList) == 0 {
+		return ""
+	}
+	return chain.traceMessage(*chain.CurrentEntity(), "replied by")
+}
+
+func (chain *RPCChain) traceReply(entity ServerEntity) {
+	tracer.LogLocalEvent(chain.traceMessage(entity, "reply from"))
+}
+
+// "[entry] [request|return] [event] [service] [chain id]"
+func (chain *RPCChain) traceMessage(entity ServerEntity, event string) string {
+	direction := "request"
+	if chain.IsReturnCall {
+		direction = "return"
+	}
+	return fmt.Sprintf("%s %s %s %s [chain %s]", entity.Entry, direction, event, entity.Service_info, chain.Id)
+}
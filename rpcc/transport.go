@@ -0,0 +1,129 @@
+package rpcc
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync/atomic"
+	"time"
+)
+
+/* === Headers === */
+
+// Carries hops and direct calls between nodes, TCP unless replaced by SetTransport
+type Transport interface {
+	Dial(address string) (*rpc.Client, error)
+	Call(address string, serviceMethod string, args interface{}, reply interface{}) error
+}
+
+// The default transport, a fresh net/rpc TCP connection per call
+type TCPTransport struct{}
+
+// What this node sent over the connections it dialed, and the hops it dispatched.
+// Every connection is counted once, by the node that dialed it.
+type WireStats struct {
+	Connections int64
+	Hops        int64
+	BytesSent   int64
+	BytesRecv   int64
+}
+
+// Counts the bytes going through a dialed connection
+type countingConn struct {
+	net.Conn
+}
+
+/* === Globals === */
+var transport Transport = TCPTransport{}
+var wire WireStats
+
+/* === Functions === */
+func SetTransport(t Transport) {
+	transport = t
+}
+
+func (t TCPTransport) Dial(address string) (*rpc.Client, error) {
+	return dialTCP(address)
+}
+
+func (t TCPTransport) Call(address string, serviceMethod string, args interface{}, reply interface{}) error {
+	service, err := dialTCP(address)
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	return service.Call(serviceMethod, args, reply)
+}
+
+// A call outside of the chains, like the gossip's and the elections', over the transport.
+// Gives up once timeout runs out on rpcc's clock, dialing included.
+func CallTimeout(address string, serviceMethod string, args interface{}, reply interface{}, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- transport.Call(address, serviceMethod, args, reply)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-clock.After(timeout):
+		return fmt.Errorf("rpcc: %s to %s timed out", serviceMethod, address)
+	}
+}
+
+// Counters of this node since it started
+func Wire() WireStats {
+	return WireStats{
+		Connections: atomic.LoadInt64(&wire.Connections),
+		Hops:        atomic.LoadInt64(&wire.Hops),
+		BytesSent:   atomic.LoadInt64(&wire.BytesSent),
+		BytesRecv:   atomic.LoadInt64(&wire.BytesRecv),
+	}
+}
+
+// The counters gained since earlier
+func (w WireStats) Sub(earlier WireStats) WireStats {
+	return WireStats{
+		Connections: w.Connections - earlier.Connections,
+		Hops:        w.Hops - earlier.Hops,
+		BytesSent:   w.BytesSent - earlier.BytesSent,
+		BytesRecv:   w.BytesRecv - earlier.BytesRecv,
+	}
+}
+
+func (w WireStats) Add(other WireStats) WireStats {
+	return WireStats{
+		Connections: w.Connections + other.Connections,
+		Hops:        w.Hops + other.Hops,
+		BytesSent:   w.BytesSent + other.BytesSent,
+		BytesRecv:   w.BytesRecv + other.BytesRecv,
+	}
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&wire.BytesRecv, int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&wire.BytesSent, int64(n))
+	return n, err
+}
+
+/* == Private Functions == */
+// rpc.Dial, over a connection the wire counters see
+func dialTCP(address string) (*rpc.Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&wire.Connections, 1)
+	return rpc.NewClient(countingConn{conn}), nil
+}
+
+func countHop() {
+	atomic.AddInt64(&wire.Hops, 1)
+}
@@ -0,0 +1,106 @@
+// Usage: go run visualize.go [dot|mermaid] [record file or directory] [chain id]
+//
+// - [dot|mermaid] : render a Graphviz DOT graph or a Mermaid sequence diagram.
+// - [record file or directory] : a chain recorded with RPCC_RECORD_DIR, or the whole directory.
+// - [chain id] : with a directory, the chain to render. The record that got furthest
+//   along the chain is used, so hops up to where it failed are shown.
+//
+package main
+
+import (
+	"./protocol"
+	"./rpcc"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//======================================= MAIN =======================================
+
+func main() {
+
+	// parse args
+	usage := fmt.Sprintf("Usage: %s [dot|mermaid] [record file or directory] [chain id]\n", os.Args[0])
+	if len(os.Args) != 3 && len(os.Args) != 4 {
+		fmt.Print(usage)
+		os.Exit(1)
+	}
+
+	protocol.Register()
+
+	format := os.Args[1]
+	path := os.Args[2]
+	chainId := ""
+	if len(os.Args) == 4 {
+		chainId = os.Args[3]
+	}
+
+	chain, err := loadChain(path, chainId)
+	checkError(err)
+
+	switch format {
+	case "dot":
+		fmt.Print(rpcc.RenderDOT(chain))
+	case "mermaid":
+		fmt.Print(rpcc.RenderMermaid(chain))
+	default:
+		fmt.Print(usage)
+		os.Exit(1)
+	}
+}
+
+//======================================= HELPER FUNCTIONS =======================================
+// Load a single record, or the furthest record of a chain from a directory
+func loadChain(path string, chainId string) (*rpcc.RPCChain, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		record, err := rpcc.LoadRecord(path)
+		if err != nil {
+			return nil, err
+		}
+		return &record.Chain, nil
+	}
+
+	if chainId == "" {
+		return nil, fmt.Errorf("a chain id is needed to pick records from %s", path)
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*.gob"))
+	if err != nil {
+		return nil, err
+	}
+
+	var furthest *rpcc.RPCChain
+	for _, file := range files {
+		if !strings.Contains(filepath.Base(file), "-"+rpcc.RecordId(chainId)+"-") {
+			continue
+		}
+		record, err := rpcc.LoadRecord(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", file, err.Error())
+			continue
+		}
+		if furthest == nil || len(record.Chain.Trace) > len(furthest.Trace) {
+			chain := record.Chain
+			furthest = &chain
+		}
+	}
+
+	if furthest == nil {
+		return nil, fmt.Errorf("no records of chain %s in %s", chainId, path)
+	}
+	return furthest, nil
+}
+
+// If error is non-nil, print it out and halt.
+func checkError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}